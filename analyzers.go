@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Analyzer is one kind of analysis that's run on every message, like checking
+// if it's a palindrome. Each analyzer gets its own WorkOrchestrator (usually a
+// Palindromes, see NewAnalyzerWork), so work is queued, de-duplicated by hash,
+// and cancelled the same way for all of them.
+type Analyzer interface {
+	// Name identifies the analyzer, like "palindrome". It's the key of the
+	// analyzer's result in message responses (under "analyses").
+	Name() string
+	// Description is a short explanation of what the analyzer does, for
+	// clients.
+	Description() string
+	// Analyze does the work for a message. It should check cancel every so
+	// often if it's slow, and return false if it's been cancelled. The
+	// returned result should be done (status PW_DONE).
+	Analyze(msg Message, cancel <-chan bool) (PWResult, bool)
+	// Response converts a done result (from Analyze) into the format sent to
+	// clients. It's encoded as JSON.
+	Response(msg Message, result PWResult) any
+}
+
+// PALINDROME_ANALYZER is the name of PalindromeAnalyzer. Its results are also
+// used for "is_palindrome" and everything else which existed before analyzers
+// did.
+const PALINDROME_ANALYZER = "palindrome"
+
+// AnalyzerRegistry keeps track of every installed analyzer, and the
+// WorkOrchestrator that does its work. Analyzers should all be registered at
+// startup, before the registry is used: after that it's only read, so it's
+// safe for concurrent use.
+type AnalyzerRegistry struct {
+	// names of installed analyzers, in the order they were registered
+	names     []string
+	installed map[string]installedAnalyzer
+}
+
+// installedAnalyzer is an Analyzer along with the WorkOrchestrator doing its
+// work.
+type installedAnalyzer struct {
+	analyzer Analyzer
+	wo       WorkOrchestrator[Message, PWKey, PWResult]
+}
+
+// AnalyzerResult is the result of one analyzer, for one message.
+type AnalyzerResult struct {
+	analyzer Analyzer
+	result   PWResult
+}
+
+// NewAnalyzerRegistry creates an AnalyzerRegistry with nothing installed.
+func NewAnalyzerRegistry() *AnalyzerRegistry {
+	return &AnalyzerRegistry{
+		names:     []string{},
+		installed: make(map[string]installedAnalyzer),
+	}
+}
+
+// Register installs an analyzer, with the WorkOrchestrator that will do its
+// work. It returns an error if an analyzer with the same name is already
+// installed.
+func (ar *AnalyzerRegistry) Register(analyzer Analyzer, wo WorkOrchestrator[Message, PWKey, PWResult]) error {
+	name := analyzer.Name()
+	if _, ok := ar.installed[name]; ok {
+		return fmt.Errorf("analyzer %q is already installed", name)
+	}
+
+	ar.names = append(ar.names, name)
+	ar.installed[name] = installedAnalyzer{analyzer: analyzer, wo: wo}
+	return nil
+}
+
+// Analyzers returns every installed analyzer, in the order they were
+// registered.
+func (ar *AnalyzerRegistry) Analyzers() []Analyzer {
+	out := make([]Analyzer, 0, len(ar.names))
+	for _, name := range ar.names {
+		out = append(out, ar.installed[name].analyzer)
+	}
+	return out
+}
+
+// namedResultCache is the ResultCache of an installed analyzer.
+type namedResultCache struct {
+	name  string
+	cache *ResultCache
+}
+
+// ResultCaches returns the ResultCache of every installed analyzer (or only the
+// one named only, if it's not empty), in the order they were registered.
+// Analyzers without a cache (see ResultCacher) are left out. It returns false
+// if only isn't installed.
+func (ar *AnalyzerRegistry) ResultCaches(only string) ([]namedResultCache, bool) {
+	if _, ok := ar.installed[only]; only != "" && !ok {
+		return nil, false
+	}
+
+	out := []namedResultCache{}
+	for _, name := range ar.names {
+		if only != "" && name != only {
+			continue
+		}
+		if rc, ok := ar.installed[name].wo.(ResultCacher); ok && rc.ResultCache() != nil {
+			out = append(out, namedResultCache{name: name, cache: rc.ResultCache()})
+		}
+	}
+	return out, true
+}
+
+// namedWorkStats is the WorkStats of an installed analyzer.
+type namedWorkStats struct {
+	name  string
+	stats WorkStats
+}
+
+// WorkStats returns the WorkStats of every installed analyzer, in the order
+// they were registered. Analyzers whose WorkOrchestrator doesn't keep track of
+// them (see WorkStatsReporter) are left out.
+func (ar *AnalyzerRegistry) WorkStats() []namedWorkStats {
+	out := []namedWorkStats{}
+	for _, name := range ar.names {
+		if wsr, ok := ar.installed[name].wo.(WorkStatsReporter); ok {
+			out = append(out, namedWorkStats{name: name, stats: wsr.WorkStats()})
+		}
+	}
+	return out
+}
+
+// namedWorkStates is the WorkStates and WorkStats of an installed analyzer.
+type namedWorkStates struct {
+	name   string
+	stats  WorkStats
+	states []WorkState
+}
+
+// WorkStates returns the WorkStates (and WorkStats) of every installed
+// analyzer, in the order they were registered. Analyzers whose
+// WorkOrchestrator can't describe its work (see WorkStateReporter and
+// WorkStatsReporter) are left out.
+func (ar *AnalyzerRegistry) WorkStates() []namedWorkStates {
+	out := []namedWorkStates{}
+	for _, name := range ar.names {
+		wsr, ok := ar.installed[name].wo.(interface {
+			WorkStateReporter
+			WorkStatsReporter
+		})
+		if ok {
+			out = append(out, namedWorkStates{name: name, stats: wsr.WorkStats(), states: wsr.WorkStates()})
+		}
+	}
+	return out
+}
+
+// AddWork kicks off work for a message with every installed analyzer, except
+// the ones whose work is done by skip (the caller takes care of those, usually
+// the palindrome analyzer's). Full queues are ignored: the work is kicked off
+// again the next time the message is read (see Results).
+func (ar *AnalyzerRegistry) AddWork(msg Message, skip WorkOrchestrator[Message, PWKey, PWResult]) {
+	for _, name := range ar.names {
+		if ia := ar.installed[name]; ia.wo != skip {
+			ia.wo.Add(msg)
+		}
+	}
+}
+
+// RemoveWork removes a message's work from every installed analyzer, except
+// the ones whose work is done by skip (see AddWork).
+func (ar *AnalyzerRegistry) RemoveWork(key PWKey, skip WorkOrchestrator[Message, PWKey, PWResult]) {
+	for _, name := range ar.names {
+		if ia := ar.installed[name]; ia.wo != skip {
+			ia.wo.Remove(key)
+		}
+	}
+}
+
+// Results returns the result of every installed analyzer for a message, in
+// the order they were registered. Analyzers whose work is done by skip get
+// skipped as their result (the caller already has it, see messageResult). If
+// an analyzer has no work for the message, it's kicked off, and its result is
+// pending.
+func (ar *AnalyzerRegistry) Results(msg Message, skip WorkOrchestrator[Message, PWKey, PWResult], skipped PWResult) ([]AnalyzerResult, error) {
+	out := []AnalyzerResult{}
+	for _, name := range ar.names {
+		ia := ar.installed[name]
+		if ia.wo == skip {
+			out = append(out, AnalyzerResult{analyzer: ia.analyzer, result: skipped})
+			continue
+		}
+
+		found, current, _, err := ia.wo.Poll(PWorkKeyFromMsg(msg))
+		if err != nil {
+			return nil, err
+		} else if !found {
+			// if the queue is full, we'll try again next time
+			ia.wo.Add(msg)
+			current = PWResult{status: PW_PENDING, settings: msg.settings}
+		}
+
+		out = append(out, AnalyzerResult{analyzer: ia.analyzer, result: current})
+	}
+
+	return out, nil
+}
+
+// Shutdown shuts down the WorkOrchestrator of every installed analyzer, all at
+// once (see WorkOrchestrator.Shutdown). It returns their errors, joined.
+func (ar *AnalyzerRegistry) Shutdown(ctx context.Context, drain bool) error {
+	errs := make([]error, len(ar.names))
+	var wg sync.WaitGroup
+	for i, name := range ar.names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ar.installed[name].wo.Shutdown(ctx, drain); err != nil {
+				errs[i] = fmt.Errorf("analyzer %q: %w", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// BUILTIN_ANALYZERS creates every analyzer that can be installed (apart from
+// PalindromeAnalyzer, which always is), by name.
+var BUILTIN_ANALYZERS = map[string]func() Analyzer{
+	"anagram": func() Analyzer { return AnagramAnalyzer{} },
+	"stats":   func() Analyzer { return StatsAnalyzer{} },
+}
+
+// ---- Palindrome ----
+
+// PalindromeAnalyzer checks if a message is a palindrome, according to its
+// settings, and analyzes the palindromes inside it (see AnalyzeText and
+// AnalyzeNearness).
+type PalindromeAnalyzer struct{}
+
+func (PalindromeAnalyzer) Name() string {
+	return PALINDROME_ANALYZER
+}
+
+func (PalindromeAnalyzer) Description() string {
+	return "checks if the text is a palindrome, finds the longest palindrome inside it, and how close it is to being one"
+}
+
+func (PalindromeAnalyzer) Analyze(msg Message, cancel <-chan bool) (PWResult, bool) {
+	isPalindrome := TextIsPalindrome(msg.text, msg.settings)
+	analysis := AnalyzeText(msg.text, msg.settings)
+	near, ok := AnalyzeNearness(msg.text, msg.settings, cancel)
+	if !ok {
+		return PWResult{}, false
+	}
+	analysis.near = near
+
+	return PWResult{
+		isPalindrome: isPalindrome,
+		status:       PW_DONE,
+		done:         true,
+		settings:     msg.settings,
+		analysis:     analysis,
+	}, true
+}
+
+func (PalindromeAnalyzer) Response(msg Message, result PWResult) any {
+	settings := result.settings.withDefaults()
+	return PalindromeAnalyzerResponseData{
+		IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		Profile:      settings.profile,
+		Mode:         settings.mode,
+		Analysis:     AnalysisToResponse(msg.text, result),
+	}
+}
+
+// ---- Anagram ----
+
+// AnagramAnalyzer works out a message's anagram signature: its normalized
+// units (characters, words, or lines, see normalizeUnits), sorted. Two messages
+// with the same settings are anagrams of each other if they have the same
+// signature. The signature is a string, in PWResult.extra.
+type AnagramAnalyzer struct{}
+
+func (AnagramAnalyzer) Name() string {
+	return "anagram"
+}
+
+func (AnagramAnalyzer) Description() string {
+	return "sorts the normalized text, so that anagrams have the same signature"
+}
+
+func (AnagramAnalyzer) Analyze(msg Message, cancel <-chan bool) (PWResult, bool) {
+	settings := msg.settings.withDefaults()
+	units := normalizeUnits(msg.text, settings)
+
+	keys := make([]string, 0, len(units))
+	for _, u := range units {
+		keys = append(keys, u.key)
+	}
+	slices.Sort(keys)
+
+	return PWResult{
+		status:   PW_DONE,
+		done:     true,
+		settings: msg.settings,
+		extra:    strings.Join(keys, modeSeparator(settings.mode)),
+	}, true
+}
+
+func (AnagramAnalyzer) Response(msg Message, result PWResult) any {
+	signature, _ := result.extra.(string)
+	return AnagramResponseData{Signature: signature}
+}
+
+// ---- Stats ----
+
+// StatsAnalyzer counts the characters, words, and lines in a message (before
+// normalization).
+type StatsAnalyzer struct{}
+
+// textStats is what StatsAnalyzer works out, in PWResult.extra.
+type textStats struct {
+	characters  int
+	graphemes   int
+	letters     int
+	digits      int
+	spaces      int
+	punctuation int
+	words       int
+	lines       int
+}
+
+func (StatsAnalyzer) Name() string {
+	return "stats"
+}
+
+func (StatsAnalyzer) Description() string {
+	return "counts the characters, letters, digits, spaces, punctuation, words, and lines in the text"
+}
+
+func (StatsAnalyzer) Analyze(msg Message, cancel <-chan bool) (PWResult, bool) {
+	return PWResult{
+		status:   PW_DONE,
+		done:     true,
+		settings: msg.settings,
+		extra:    CountTextStats(msg.text),
+	}, true
+}
+
+func (StatsAnalyzer) Response(msg Message, result PWResult) any {
+	s, _ := result.extra.(textStats)
+	return StatsResponseData{
+		Characters:  s.characters,
+		Graphemes:   s.graphemes,
+		Letters:     s.letters,
+		Digits:      s.digits,
+		Spaces:      s.spaces,
+		Punctuation: s.punctuation,
+		Words:       s.words,
+		Lines:       s.lines,
+	}
+}
+
+// CountTextStats does the work for StatsAnalyzer. Characters are code points.
+// Empty text has no lines, otherwise lines are counted like splitLines does.
+func CountTextStats(text string) textStats {
+	out := textStats{
+		characters: utf8.RuneCountInString(text),
+		graphemes:  len(Graphemes(text)),
+		words:      len(splitWords(text)),
+	}
+	if text != "" {
+		out.lines = len(splitLines(text))
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.IsLetter(r):
+			out.letters++
+		case unicode.IsDigit(r):
+			out.digits++
+		case unicode.IsSpace(r):
+			out.spaces++
+		case unicode.IsPunct(r):
+			out.punctuation++
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnalyzerRegistry(t *testing.T) {
+	po := NewPalindromes(1, 10)
+	ao := NewAnalyzerWork(AnagramAnalyzer{}, 1, 10, nil)
+
+	ar := NewAnalyzerRegistry()
+	if err := ar.Register(PalindromeAnalyzer{}, po); err != nil {
+		t.Fatalf(`ar.Register(palindrome) has err %+v, want nil`, err)
+	}
+	if err := ar.Register(AnagramAnalyzer{}, ao); err != nil {
+		t.Fatalf(`ar.Register(anagram) has err %+v, want nil`, err)
+	}
+	if err := ar.Register(AnagramAnalyzer{}, ao); err == nil {
+		t.Fatalf(`ar.Register(anagram) again has nil err, want error`)
+	}
+
+	analyzers := ar.Analyzers()
+	if len(analyzers) != 2 || analyzers[0].Name() != PALINDROME_ANALYZER || analyzers[1].Name() != "anagram" {
+		t.Fatalf(`ar.Analyzers() = %+v, want palindrome, anagram`, analyzers)
+	}
+
+	// po's result is passed through, and the anagram work is kicked off
+	msg := newMessage(1, "dusty", PSettings{})
+	ar.AddWork(msg, po)
+	if found, _, _, _ := po.Poll(PWorkKeyFromMsg(msg)); found {
+		t.Fatalf(`ar.AddWork(%+v, po) added work to po, want it skipped`, msg)
+	}
+	results, err := ar.Results(msg, po, PWResult{isPalindrome: P_FALSE})
+	if err != nil || len(results) != 2 || results[0].result.isPalindrome != P_FALSE || results[1].analyzer.Name() != "anagram" {
+		t.Fatalf(`ar.Results(%+v, po) = %+v, %+v, want palindrome (false), anagram`, msg, results, err)
+	}
+
+	ar.RemoveWork(PWorkKeyFromMsg(msg), po)
+	if found, _, _, _ := ao.Poll(PWorkKeyFromMsg(msg)); found {
+		t.Fatalf(`ao.Poll(%+v) found after ar.RemoveWork, want not found`, msg)
+	}
+}
+
+func TestAnagramAnalyzer(t *testing.T) {
+	cases := []struct {
+		text     string
+		settings PSettings
+		expected string
+	}{
+		{"Listen", PSettings{}, "eilnst"},
+		{"Silent!", PSettings{}, "eilnst"},
+		{"fall leaves after", PSettings{mode: MODE_WORD}, "after fall leaves"},
+		{"", PSettings{}, ""},
+	}
+
+	for _, c := range cases {
+		msg := newMessage(1, c.text, c.settings)
+		result, ok := AnagramAnalyzer{}.Analyze(msg, nil)
+		if !ok || !result.done || result.extra != c.expected {
+			t.Fatalf(`AnagramAnalyzer{}.Analyze(%q) = %+v, want signature %q`, c.text, result, c.expected)
+		}
+	}
+}
+
+func TestCountTextStats(t *testing.T) {
+	text := "Hi, 2 e\u0301s!\nbye"
+	expected := textStats{characters: 14, graphemes: 13, letters: 7, digits: 1, spaces: 3, punctuation: 2, words: 4, lines: 2}
+	if result := CountTextStats(text); result != expected {
+		t.Fatalf(`CountTextStats(%q) = %+v, want %+v`, text, result, expected)
+	}
+
+	if result := CountTextStats(""); result != (textStats{}) {
+		t.Fatalf(`CountTextStats("") = %+v, want all zeros`, result)
+	}
+}
+
+func TestAnalyzerWork(t *testing.T) {
+	ao := NewAnalyzerWork(AnagramAnalyzer{}, 1, 10, nil)
+
+	msg := newMessage(1, "dusty", PSettings{})
+	_, _, onChange, err := ao.Add(msg)
+	if err != nil {
+		t.Fatalf(`ao.Add(%+v) has err %+v, want nil`, msg, err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case result := <-onChange:
+			if !result.done {
+				continue
+			}
+			if result.extra != "dstuy" {
+				t.Fatalf(`ao.Add(%+v) result signature = %v, want dstuy`, msg, result.extra)
+			}
+			return
+		case <-timeout:
+			t.Fatalf(`ao.Add(%+v) result not done after 1s`, msg)
+		}
+	}
+}
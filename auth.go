@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// This file contains API key authentication. Keys are loaded from a config
+// file (see API_KEYS_FILE in main), and every request has to have one (see
+// Authenticate), unless the route is public. Each key has scopes, which decide
+// what it can do (see ROUTE_SCOPES). If there's no config file, the API is
+// open, like it's always been.
+//
+// Keys are never stored, only their hashes: a key is 32 random bytes, so
+// there's no point in a slow hash like bcrypt (there's nothing to brute force),
+// and SHA-256 means a key can be found with a map lookup.
+
+// The scopes a key can have. They don't imply each other: a key which should
+// be able to do everything needs all three.
+const (
+	// reading messages, searching and exporting them, and listing analyzers
+	SCOPE_READ = "messages:read"
+	// creating, updating, deleting, restoring, and importing messages
+	SCOPE_WRITE = "messages:write"
+	// deleting every message, and everything under /admin and /debug
+	SCOPE_ADMIN = "messages:admin"
+	// used in ROUTE_SCOPES for routes which don't need a key at all
+	SCOPE_NONE = ""
+)
+
+// SCOPES is every scope, for validating the config file.
+var SCOPES = []string{SCOPE_READ, SCOPE_WRITE, SCOPE_ADMIN}
+
+// ROUTE_SCOPES is the scope each route needs, keyed by method and path
+// template (v2 routes use the same entry as v1, see RouteScope). Routes which
+// aren't in here need SCOPE_ADMIN, so a new route can't be left open by
+// mistake.
+var ROUTE_SCOPES = map[string]string{
+	"GET /healthz":                                SCOPE_NONE,
+	"GET /readyz":                                 SCOPE_NONE,
+	"GET /problems":                               SCOPE_NONE,
+	"GET /problems/{code}":                        SCOPE_NONE,
+	"GET /metrics":                                SCOPE_READ,
+	"GET /analyzers":                              SCOPE_READ,
+	"GET /messages":                               SCOPE_READ,
+	"GET /messages/search":                        SCOPE_READ,
+	"GET /messages/export":                        SCOPE_READ,
+	"GET /messages/{id}":                          SCOPE_READ,
+	"GET /messages/{id}/events":                   SCOPE_READ,
+	"GET /messages/{id}/revisions":                SCOPE_READ,
+	"GET /messages/{id}/revisions/{rev}":          SCOPE_READ,
+	"POST /messages":                              SCOPE_WRITE,
+	"POST /messages:batch":                        SCOPE_WRITE,
+	"POST /messages/import":                       SCOPE_WRITE,
+	"PUT /messages/{id}":                          SCOPE_WRITE,
+	"DELETE /messages/{id}":                       SCOPE_WRITE,
+	"POST /messages/{id}/revisions/{rev}/restore": SCOPE_WRITE,
+	"DELETE /messages":                            SCOPE_ADMIN,
+	"GET /debug/state":                            SCOPE_ADMIN,
+	"GET /admin/cache":                            SCOPE_ADMIN,
+	"DELETE /admin/cache":                         SCOPE_ADMIN,
+	"GET /admin/keys":                             SCOPE_ADMIN,
+	"POST /admin/keys/{id}/rotate":                SCOPE_ADMIN,
+}
+
+// API_KEY_PREFIX starts every generated key, so they're easy to spot (in logs,
+// or a leaked config file).
+const API_KEY_PREFIX = "pal_"
+
+// ErrKeyNotFound is returned by KeyStore.Rotate if there's no key with that id.
+var ErrKeyNotFound = errors.New("api key not found")
+
+// APIKey is one key from the config file. id names it (it's not secret, and
+// doesn't change when the key is rotated), hash is "sha256:" followed by the
+// hex SHA-256 of the key, scopes is what it can do, tenant is whose messages it
+// can do it to (see TenantOf), and rotatedAt is when it was last rotated (zero
+// if it never was).
+type APIKey struct {
+	id        string
+	hash      string
+	scopes    []string
+	tenant    string
+	rotatedAt time.Time
+}
+
+// hasScope returns true if the key has scope.
+func (k APIKey) hasScope(scope string) bool {
+	return slices.Contains(k.scopes, scope)
+}
+
+// storedKey is how an APIKey is written in the config file.
+type storedKey struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// keyFile is the config file: {"keys": [storedKey, ...]}.
+type keyFile struct {
+	Keys []storedKey `json:"keys"`
+}
+
+// KeyStore holds every API key, and writes them back to the config file when
+// they're rotated. It is safe for concurrent use.
+type KeyStore struct {
+	lock sync.RWMutex
+	path string
+	// in the same order as the config file
+	keys []APIKey
+	// key: hash, value: index in keys
+	byHash map[string]int
+}
+
+// LoadKeyStore reads the config file at path. Keys without a tenant belong to
+// DEFAULT_TENANT. It returns an error if the file can't be read, or any key in
+// it is invalid (no id, a duplicate id or hash, a malformed hash, an unknown
+// scope, or an invalid tenant name).
+func LoadKeyStore(path string) (*KeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ks := &KeyStore{path: path, byHash: make(map[string]int)}
+	ids := make(map[string]bool)
+	for i, sk := range file.Keys {
+		if err := validateStoredKey(sk); err != nil {
+			return nil, fmt.Errorf("%s: key %d: %w", path, i, err)
+		}
+		if ids[sk.ID] {
+			return nil, fmt.Errorf("%s: key %d: duplicate id %q", path, i, sk.ID)
+		}
+		if _, ok := ks.byHash[sk.Hash]; ok {
+			return nil, fmt.Errorf("%s: key %d: duplicate hash", path, i)
+		}
+
+		key := APIKey{id: sk.ID, hash: sk.Hash, scopes: sk.Scopes, tenant: sk.Tenant}
+		if key.scopes == nil {
+			key.scopes = []string{}
+		}
+		if key.tenant == "" {
+			key.tenant = DEFAULT_TENANT
+		}
+		if sk.RotatedAt != nil {
+			key.rotatedAt = *sk.RotatedAt
+		}
+		ids[sk.ID] = true
+		ks.byHash[sk.Hash] = len(ks.keys)
+		ks.keys = append(ks.keys, key)
+	}
+
+	return ks, nil
+}
+
+// validateStoredKey checks a key from the config file on its own (see
+// LoadKeyStore).
+func validateStoredKey(sk storedKey) error {
+	if sk.ID == "" {
+		return errors.New("id is required")
+	}
+	if digest, ok := strings.CutPrefix(sk.Hash, "sha256:"); !ok || len(digest) != sha256.Size*2 {
+		return fmt.Errorf(`hash of %q must be "sha256:" followed by 64 hex digits`, sk.ID)
+	} else if _, err := hex.DecodeString(digest); err != nil {
+		return fmt.Errorf(`hash of %q must be "sha256:" followed by 64 hex digits`, sk.ID)
+	}
+	for _, scope := range sk.Scopes {
+		if !slices.Contains(SCOPES, scope) {
+			return fmt.Errorf("unknown scope %q for %q, must be one of %s", scope, sk.ID, strings.Join(SCOPES, ", "))
+		}
+	}
+	if sk.Tenant != "" {
+		if err := ValidateTenantName(sk.Tenant); err != nil {
+			return fmt.Errorf("%q: %w", sk.ID, err)
+		}
+	}
+	return nil
+}
+
+// HashAPIKey returns the hash of key, as it's stored in the config file.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random key.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Lookup returns the APIKey matching key, or false if there isn't one. Only
+// the hash of key is compared, so how long it takes doesn't say anything about
+// the keys which exist.
+func (ks *KeyStore) Lookup(key string) (APIKey, bool) {
+	hash := HashAPIKey(key)
+
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	i, ok := ks.byHash[hash]
+	if !ok {
+		return APIKey{}, false
+	}
+	return ks.keys[i], true
+}
+
+// List returns every key, in the same order as the config file.
+func (ks *KeyStore) List() []APIKey {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	return slices.Clone(ks.keys)
+}
+
+// Rotate replaces the key with id with a new random one, and writes the config
+// file. The old key stops working straight away. It returns the new key (which
+// is the only time it's ever seen, only its hash is kept) and its APIKey, or
+// ErrKeyNotFound if there's no key with that id. If the file can't be written,
+// nothing changes.
+func (ks *KeyStore) Rotate(id string) (string, APIKey, error) {
+	secret, err := GenerateAPIKey()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	i := slices.IndexFunc(ks.keys, func(k APIKey) bool { return k.id == id })
+	if i < 0 {
+		return "", APIKey{}, ErrKeyNotFound
+	}
+
+	keys := slices.Clone(ks.keys)
+	old := keys[i]
+	keys[i].hash = HashAPIKey(secret)
+	keys[i].rotatedAt = time.Now().UTC()
+	if err := ks.save(keys); err != nil {
+		return "", APIKey{}, err
+	}
+
+	ks.keys = keys
+	delete(ks.byHash, old.hash)
+	ks.byHash[keys[i].hash] = i
+
+	return secret, keys[i], nil
+}
+
+// save writes keys to the config file. Must be called with ks.lock held.
+func (ks *KeyStore) save(keys []APIKey) error {
+	file := keyFile{Keys: make([]storedKey, 0, len(keys))}
+	for _, k := range keys {
+		sk := storedKey{ID: k.id, Hash: k.hash, Scopes: k.scopes, Tenant: k.tenant}
+		if !k.rotatedAt.IsZero() {
+			rotatedAt := k.rotatedAt
+			sk.RotatedAt = &rotatedAt
+		}
+		file.Keys = append(file.Keys, sk)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first (like DurableMessages.compact), so a
+	// crash can never leave behind a half-written config, and every key lost
+	tmpPath := ks.path + ".tmp"
+	if err := writeFileSync(tmpPath, append(data, '\n')); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, ks.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(ks.path))
+}
+
+// RouteScope returns the scope needed for a request to route (see
+// ROUTE_SCOPES), or SCOPE_ADMIN if it isn't listed.
+func RouteScope(method string, route string) string {
+	route = strings.TrimPrefix(route, "/v2")
+	if scope, ok := ROUTE_SCOPES[method+" "+route]; ok {
+		return scope
+	}
+	return SCOPE_ADMIN
+}
+
+// apiKeyContextKey is the context key of the APIKey a request was made with
+// (see Authenticate).
+type apiKeyContextKey struct{}
+
+// APIKeyFromContext returns the APIKey a request was made with, or false if it
+// didn't need one (or there are no keys).
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(APIKey)
+	return key, ok
+}
+
+// ReadAPIKey returns the key a request was made with, from either the
+// Authorization header ("Bearer <key>") or the X-API-Key header, or "" if it
+// has neither.
+func ReadAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, key, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(key)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Authenticate is middleware which checks every request has a key with the
+// scope its route needs (see RouteScope). It returns 401 if there's no key, or
+// it doesn't exist, and 403 if it doesn't have the scope. The key is added to
+// the request's context (see APIKeyFromContext). If ss.keys is nil, every
+// request is allowed. Like CountRequests, it has to be used on a mux.Router, so
+// the route is known.
+func (ss *SharedState) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ss.keys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// find which scope we need
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		scope := RouteScope(r.Method, route)
+		if scope == SCOPE_NONE {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// check the key
+		secret := ReadAPIKey(r)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="palindrome"`)
+			WriteProblem(w, r, E_UNAUTHORIZED, "an API key is required, in the Authorization or X-API-Key header")
+			return
+		}
+		key, ok := ss.keys.Lookup(secret)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="palindrome", error="invalid_token"`)
+			WriteProblem(w, r, E_UNAUTHORIZED, "the API key isn't valid")
+			return
+		}
+		if !key.hasScope(scope) {
+			WriteProblem(w, r, E_FORBIDDEN, fmt.Sprintf("the API key %q doesn't have the %q scope", key.id, scope))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// writeKeyFile writes a config file to a temporary directory, and returns its
+// path.
+func writeKeyFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf(`os.WriteFile(%s) has err %+v, want nil`, path, err)
+	}
+	return path
+}
+
+func TestLoadKeyStore(t *testing.T) {
+	hash := HashAPIKey("secret")
+	path := writeKeyFile(t, `{"keys": [{"id": "reader", "hash": "`+hash+`", "scopes": ["messages:read"]}]}`)
+
+	ks, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatalf(`LoadKeyStore(%s) has err %+v, want nil`, path, err)
+	}
+	key, ok := ks.Lookup("secret")
+	if !ok || key.id != "reader" || !key.hasScope(SCOPE_READ) || key.hasScope(SCOPE_WRITE) {
+		t.Fatalf(`ks.Lookup("secret") = %+v, %t, want reader with only %s`, key, ok, SCOPE_READ)
+	}
+	if _, ok := ks.Lookup("wrong"); ok {
+		t.Fatalf(`ks.Lookup("wrong") found, want not found`)
+	}
+
+	for _, contents := range []string{
+		`{"keys": [{"hash": "` + hash + `", "scopes": []}]}`,
+		`{"keys": [{"id": "a", "hash": "secret", "scopes": []}]}`,
+		`{"keys": [{"id": "a", "hash": "` + hash + `", "scopes": ["messages:delete"]}]}`,
+		`{"keys": [{"id": "a", "hash": "` + hash + `"}, {"id": "a", "hash": "` + HashAPIKey("other") + `"}]}`,
+		`{"keys": [{"id": "a", "hash": "` + hash + `"}, {"id": "b", "hash": "` + hash + `"}]}`,
+		`{"keys": [{"id": "a", "key": "secret"}]}`,
+	} {
+		if _, err := LoadKeyStore(writeKeyFile(t, contents)); err == nil {
+			t.Fatalf(`LoadKeyStore(%s) has no err, want one`, contents)
+		}
+	}
+}
+
+func TestKeyStoreRotate(t *testing.T) {
+	path := writeKeyFile(t, `{"keys": [{"id": "admin", "hash": "`+HashAPIKey("old")+`", "scopes": ["messages:admin"]}]}`)
+	ks, _ := LoadKeyStore(path)
+
+	secret, key, err := ks.Rotate("admin")
+	if err != nil {
+		t.Fatalf(`ks.Rotate("admin") has err %+v, want nil`, err)
+	}
+	if key.rotatedAt.IsZero() || key.hash != HashAPIKey(secret) {
+		t.Fatalf(`ks.Rotate("admin") key = %+v, want the hash of the new key, and rotatedAt`, key)
+	}
+	if _, ok := ks.Lookup("old"); ok {
+		t.Fatalf(`ks.Lookup("old") found after ks.Rotate("admin"), want not found`)
+	}
+	if _, ok := ks.Lookup(secret); !ok {
+		t.Fatalf(`ks.Lookup(new key) not found after ks.Rotate("admin")`)
+	}
+
+	// the new key survives a restart, but isn't in the file
+	reloaded, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatalf(`LoadKeyStore(%s) after ks.Rotate("admin") has err %+v, want nil`, path, err)
+	}
+	if _, ok := reloaded.Lookup(secret); !ok {
+		t.Fatalf(`reloaded.Lookup(new key) not found`)
+	}
+	if data, _ := os.ReadFile(path); len(data) == 0 || strings.Contains(string(data), secret) {
+		t.Fatalf(`config file = %s, want it to only have the hash of the new key`, data)
+	}
+
+	if _, _, err := ks.Rotate("nobody"); err != ErrKeyNotFound {
+		t.Fatalf(`ks.Rotate("nobody") has err %+v, want ErrKeyNotFound`, err)
+	}
+}
+
+func TestRouteScope(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string
+		scope  string
+	}{
+		{"GET", "/healthz", SCOPE_NONE},
+		{"GET", "/messages/{id}", SCOPE_READ},
+		{"GET", "/v2/messages/{id}", SCOPE_READ},
+		{"PUT", "/v2/messages/{id}", SCOPE_WRITE},
+		{"DELETE", "/messages", SCOPE_ADMIN},
+		{"POST", "/something/new", SCOPE_ADMIN},
+	}
+	for _, test := range tests {
+		if scope := RouteScope(test.method, test.route); scope != test.scope {
+			t.Fatalf(`RouteScope(%s, %s) = %q, want %q`, test.method, test.route, scope, test.scope)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := writeKeyFile(t, `{"keys": [{"id": "reader", "hash": "`+HashAPIKey("read-key")+`", "scopes": ["messages:read"]}]}`)
+	ks, _ := LoadKeyStore(path)
+	ss := SharedState{keys: ks}
+
+	r := mux.NewRouter()
+	r.Use(ss.Authenticate)
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if key, found := APIKeyFromContext(r.Context()); found {
+			w.Header().Set("X-Key-Id", key.id)
+		}
+	}
+	r.Methods("GET").Path("/healthz").HandlerFunc(ok)
+	r.Methods("GET").Path("/messages").HandlerFunc(ok)
+	r.Methods("DELETE").Path("/messages").HandlerFunc(ok)
+
+	tests := []struct {
+		method string
+		url    string
+		header string
+		value  string
+		status int
+	}{
+		{"GET", "/healthz", "", "", http.StatusOK},
+		{"GET", "/messages", "Authorization", "Bearer read-key", http.StatusOK},
+		{"GET", "/messages", "X-API-Key", "read-key", http.StatusOK},
+		{"GET", "/messages", "", "", http.StatusUnauthorized},
+		{"GET", "/messages", "Authorization", "Bearer wrong-key", http.StatusUnauthorized},
+		{"DELETE", "/messages", "Authorization", "Bearer read-key", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Fatalf(`%s %s with %s %q status = %d, want %d`, test.method, test.url, test.header, test.value, w.Code, test.status)
+		}
+		if test.status == http.StatusOK && test.header != "" && w.Header().Get("X-Key-Id") != "reader" {
+			t.Fatalf(`%s %s with %s %q has no key in its context`, test.method, test.url, test.header, test.value)
+		}
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Log record operations. Every change to DurableMessages is written to the log
+// as exactly one record with one of these operations.
+const (
+	LOG_ADD        = "add"
+	LOG_UPDATE     = "update"
+	LOG_DELETE     = "delete"
+	LOG_DELETE_ALL = "delete_all"
+	// records the palindrome result of a past revision
+	LOG_REVISION_RESULT = "revision_result"
+	// a batch of add, update, and delete records, applied together
+	LOG_BATCH = "batch"
+)
+
+const (
+	walFileName      = "messages.wal"
+	snapshotFileName = "messages.snapshot"
+)
+
+// DurableMessages implements MessageOrchestrator. It keeps every message
+// in-memory (using a Messages struct), but before any change is applied it's
+// appended to a log file on disk and fsync'd. On startup, the latest snapshot
+// is loaded and then the log is replayed on top of it, so messages (and
+// nextId) survive a restart. It is safe for concurrent use.
+//
+// The log grows forever unless it's compacted: compaction writes the current
+// state of all messages to a snapshot file and then empties the log. This
+// happens periodically in the background, and can also be triggered by calling
+// Compact.
+//
+// Every record is "state-setting" (store this exact message, remove this id,
+// remove everything, set this revision's result), so replaying a log on top of
+// a snapshot that already includes it gives the same result. This means a
+// crash in between writing a snapshot and emptying the log is harmless.
+type DurableMessages struct {
+	// lock serializes writes, so records are appended in the same order as
+	// they're applied in-memory. Reads don't need it.
+	lock sync.Mutex
+	mem  Messages
+	dir  string
+	wal  *os.File
+	// size of the log file, in bytes, up to the end of the last good record
+	walSize int64
+	// number of records appended since the last compaction
+	pending int
+	// why the last write (or compaction) failed, nil if it didn't. See
+	// Healthy.
+	failure error
+	// closed to stop background compaction
+	stop chan bool
+	// closed once background compaction has stopped
+	stopped chan bool
+}
+
+// logRecord is a single line in the log file (JSON, newline-terminated).
+type logRecord struct {
+	Op      string         `json:"op"`
+	ID      int            `json:"id,omitempty"`
+	Message *storedMessage `json:"message,omitempty"`
+	// only used by LOG_REVISION_RESULT
+	Rev          int  `json:"rev,omitempty"`
+	IsPalindrome *int `json:"is_palindrome,omitempty"`
+	// only used by LOG_BATCH
+	Records []logRecord `json:"records,omitempty"`
+}
+
+// storedMessage is how a Message looks on disk. The hash is not stored, it's
+// recalculated from the text. Log records don't include revisions (adding or
+// updating a message adds a revision when it's applied), only snapshots do.
+//
+// Messages written before revisions existed have no revision number, they're
+// treated as revision 1. Messages written before settings existed have no
+// profile or mode, they get the defaults.
+type storedMessage struct {
+	ID        int              `json:"id"`
+	Text      string           `json:"text"`
+	Profile   string           `json:"profile,omitempty"`
+	Mode      string           `json:"mode,omitempty"`
+	Revision  int              `json:"revision,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Revisions []storedRevision `json:"revisions,omitempty"`
+}
+
+// storedRevision is how a Revision looks on disk. Like storedMessage, the hash
+// is recalculated from the text.
+type storedRevision struct {
+	Rev          int       `json:"rev"`
+	Text         string    `json:"text"`
+	Profile      string    `json:"profile,omitempty"`
+	Mode         string    `json:"mode,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	IsPalindrome int       `json:"is_palindrome"`
+}
+
+// snapshot is the content of the snapshot file: every message, plus nextId so
+// that ids of deleted messages are not reused.
+type snapshot struct {
+	NextID   int             `json:"next_id"`
+	Messages []storedMessage `json:"messages"`
+}
+
+// toStoredMessage converts a Message to its on-disk representation.
+func toStoredMessage(msg Message) *storedMessage {
+	return &storedMessage{
+		ID:        msg.id,
+		Text:      msg.text,
+		Profile:   msg.settings.profile,
+		Mode:      msg.settings.mode,
+		Revision:  msg.revision,
+		CreatedAt: msg.createdAt,
+		UpdatedAt: msg.updatedAt,
+	}
+}
+
+// toMessage converts an on-disk message back into a Message.
+func (sm storedMessage) toMessage() Message {
+	msg := newMessage(sm.ID, sm.Text, PSettings{profile: sm.Profile, mode: sm.Mode})
+	msg.revision = max(sm.Revision, 1)
+	msg.createdAt = sm.CreatedAt
+	msg.updatedAt = sm.UpdatedAt
+	return msg
+}
+
+// toStoredRevisions converts revisions to their on-disk representation.
+func toStoredRevisions(revisions []Revision) []storedRevision {
+	out := make([]storedRevision, 0, len(revisions))
+	for _, r := range revisions {
+		out = append(out, storedRevision{
+			Rev:          r.rev,
+			Text:         r.text,
+			Profile:      r.settings.profile,
+			Mode:         r.settings.mode,
+			CreatedAt:    r.createdAt,
+			IsPalindrome: r.isPalindrome,
+		})
+	}
+	return out
+}
+
+// toRevisions converts on-disk revisions back into Revisions.
+func toRevisions(stored []storedRevision) []Revision {
+	out := make([]Revision, 0, len(stored))
+	for _, sr := range stored {
+		settings := PSettings{profile: sr.Profile, mode: sr.Mode}.withDefaults()
+		out = append(out, Revision{
+			rev:          sr.Rev,
+			text:         sr.Text,
+			settings:     settings,
+			hash:         MessageHash(sr.Text, settings),
+			createdAt:    sr.CreatedAt,
+			isPalindrome: sr.IsPalindrome,
+		})
+	}
+	return out
+}
+
+// OpenDurableMessages loads (or creates) a message store for tenant in dir.
+// Every message in it belongs to tenant, whichever tenant it was written by. If
+// compactEvery is positive, the log is compacted into a snapshot at that
+// interval (but only if something has changed). Call Close when done.
+//
+// If the last record in the log is incomplete or corrupt (like after a crash
+// in the middle of a write), it's discarded and the log is truncated to the
+// last good record.
+func OpenDurableMessages(dir string, tenant string, compactEvery time.Duration) (*DurableMessages, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &DurableMessages{
+		mem:     NewTenantMessages(tenant),
+		dir:     dir,
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+	}
+
+	if err := d.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if err := d.replayLog(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	d.wal = wal
+
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	d.walSize = info.Size()
+
+	go d.compactPeriodically(compactEvery)
+
+	return d, nil
+}
+
+// loadSnapshot reads the snapshot file into memory, if there is one.
+func (d *DurableMessages) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	for _, sm := range snap.Messages {
+		d.mem.put(sm.toMessage())
+		if len(sm.Revisions) > 0 {
+			d.mem.putRevisions(sm.ID, toRevisions(sm.Revisions))
+		}
+	}
+	d.mem.bumpNextId(snap.NextID)
+
+	return nil
+}
+
+// replayLog applies every record in the log file, in order. A torn or corrupt
+// tail is truncated away.
+func (d *DurableMessages) replayLog() error {
+	path := filepath.Join(d.dir, walFileName)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var goodOffset int64 = 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		var rec logRecord
+		if err == io.EOF || json.Unmarshal(line, &rec) != nil || d.apply(rec) != nil {
+			log.Printf("discarding log from offset %d: incomplete or corrupt record\n", goodOffset)
+			return os.Truncate(path, goodOffset)
+		}
+
+		goodOffset += int64(len(line))
+		d.pending++
+	}
+}
+
+// apply makes the in-memory change described by a record.
+func (d *DurableMessages) apply(rec logRecord) error {
+	switch rec.Op {
+	case LOG_ADD, LOG_UPDATE:
+		if rec.Message == nil {
+			return errors.New("record is missing a message")
+		}
+		d.mem.put(rec.Message.toMessage())
+	case LOG_DELETE:
+		d.mem.Delete(rec.ID)
+	case LOG_DELETE_ALL:
+		d.mem.DeleteAll()
+	case LOG_REVISION_RESULT:
+		if rec.IsPalindrome == nil {
+			return errors.New("record is missing a result")
+		}
+		// the message may have been deleted since, which is fine
+		d.mem.SetRevisionResult(rec.ID, rec.Rev, *rec.IsPalindrome)
+	case LOG_BATCH:
+		for _, r := range rec.Records {
+			if r.Op == LOG_BATCH {
+				return errors.New("batch records can't be nested")
+			}
+			if err := d.apply(r); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown record op: " + rec.Op)
+	}
+
+	return nil
+}
+
+// write appends a record to the log and fsyncs it, then applies it in-memory.
+// Must be called with d.lock held.
+func (d *DurableMessages) write(rec logRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := d.wal.Write(line); err != nil {
+		// don't leave a partial record behind, it would hide every record
+		// written after it during replay
+		d.wal.Truncate(d.walSize)
+		d.failure = err
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		d.wal.Truncate(d.walSize)
+		d.failure = err
+		return err
+	}
+	d.failure = nil
+	d.walSize += int64(len(line))
+	d.pending++
+
+	return d.apply(rec)
+}
+
+// SetQuota sets the most messages there can be (see Messages.SetQuota). The
+// quota isn't persisted, and doesn't apply to replaying the log.
+func (d *DurableMessages) SetQuota(quota int) {
+	d.mem.SetQuota(quota)
+}
+
+// Add takes in some text and settings and returns a Message, with a unique id
+// and the hash of that text (and settings). It returns ErrQuotaExceeded if
+// there's no room for it (see SetQuota), or an error if the message couldn't
+// be written to disk, in which case the message is not added (but its id is
+// still used up).
+func (d *DurableMessages) Add(text string, settings PSettings) (Message, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// nothing else writes to d.mem while we hold d.lock
+	d.mem.lock.RLock()
+	err := d.mem.checkQuota(len(d.mem.messages))
+	d.mem.lock.RUnlock()
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := d.mem.newMessage(d.mem.allocateId(), text, settings)
+	if err := d.write(logRecord{Op: LOG_ADD, Message: toStoredMessage(msg)}); err != nil {
+		return Message{}, err
+	}
+
+	return msg, nil
+}
+
+// Get returns a Message by id. It will return false if the message doesn't
+// exist. It never reads from disk, so will never throw an error.
+func (d *DurableMessages) Get(id int) (Message, bool, error) {
+	return d.mem.Get(id)
+}
+
+// Update takes in a Message id, some text, and settings. It will completely
+// replace the corresponding Message's text and settings and update it's hash if
+// the Message exists. If not, it will throw ErrMessageNotFound, and if the
+// change couldn't be written to disk, some other error.
+func (d *DurableMessages) Update(id int, text string, settings PSettings) (Message, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old, found, _ := d.mem.Get(id)
+	if !found {
+		return Message{}, ErrMessageNotFound
+	}
+
+	return d.update(old, text, settings)
+}
+
+// CompareAndUpdate is like Update, but only if the Message is still at
+// revision rev, otherwise it will throw ErrRevisionMismatch (or
+// ErrMessageNotFound, if it doesn't exist anymore).
+func (d *DurableMessages) CompareAndUpdate(id int, text string, settings PSettings, rev int) (Message, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old, found, _ := d.mem.Get(id)
+	if !found {
+		return Message{}, ErrMessageNotFound
+	} else if old.revision != rev {
+		return Message{}, ErrRevisionMismatch
+	}
+
+	return d.update(old, text, settings)
+}
+
+// update writes the next revision of old, with new text and settings. Must be
+// called with d.lock held.
+func (d *DurableMessages) update(old Message, text string, settings PSettings) (Message, error) {
+	msg := d.mem.newMessage(old.id, text, settings)
+	msg.createdAt = old.createdAt
+	msg.revision = old.revision + 1
+	if err := d.write(logRecord{Op: LOG_UPDATE, Message: toStoredMessage(msg)}); err != nil {
+		return Message{}, err
+	}
+
+	return msg, nil
+}
+
+// Delete removes a Message by id. Deleting a message that doesn't exist is not
+// an error (and isn't written to disk).
+func (d *DurableMessages) Delete(id int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, found, _ := d.mem.Get(id); !found {
+		return nil
+	}
+
+	return d.write(logRecord{Op: LOG_DELETE, ID: id})
+}
+
+// CompareAndDelete is like Delete, but only if the Message is still at revision
+// rev. If it isn't, or the message doesn't exist, it will throw
+// ErrRevisionMismatch.
+func (d *DurableMessages) CompareAndDelete(id int, rev int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if msg, found, _ := d.mem.Get(id); !found || msg.revision != rev {
+		return ErrRevisionMismatch
+	}
+
+	return d.write(logRecord{Op: LOG_DELETE, ID: id})
+}
+
+// Apply runs a batch of operations in order (see Messages.Apply). Every
+// change is written to the log as a single record, so after a crash either
+// all of them are there or none are. It returns an error if the batch couldn't
+// be written to disk, in which case nothing is applied (but ids of created
+// messages are still used up).
+func (d *DurableMessages) Apply(ops []MessageOp, atomic bool) ([]MessageOpResult, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// nothing else writes to d.mem while we hold d.lock
+	d.mem.lock.RLock()
+	results := d.mem.plan(ops, atomic)
+	d.mem.lock.RUnlock()
+
+	batch := logRecord{Op: LOG_BATCH}
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+		switch ops[i].op {
+		case MESSAGE_OP_CREATE:
+			batch.Records = append(batch.Records, logRecord{Op: LOG_ADD, Message: toStoredMessage(r.msg)})
+		case MESSAGE_OP_UPDATE:
+			batch.Records = append(batch.Records, logRecord{Op: LOG_UPDATE, Message: toStoredMessage(r.msg)})
+		case MESSAGE_OP_DELETE:
+			batch.Records = append(batch.Records, logRecord{Op: LOG_DELETE, ID: r.msg.id})
+		}
+	}
+	if len(batch.Records) == 0 {
+		return results, nil
+	}
+
+	if err := d.write(batch); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// GetAll returns all messages in the system, sorted by id in ascending order.
+func (d *DurableMessages) GetAll() ([]Message, error) {
+	return d.mem.GetAll()
+}
+
+// StoreHealthReporter is implemented by MessageOrchestrators which can fail
+// in ways that don't show up in Stats, like DurableMessages when its log can't
+// be written. See GetReadiness.
+type StoreHealthReporter interface {
+	Healthy() error
+}
+
+// Healthy returns an error if the log can't be written: if the last write (or
+// compaction) failed, or the log file can't be looked at. It implements
+// StoreHealthReporter.
+func (d *DurableMessages) Healthy() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.failure != nil {
+		return fmt.Errorf("the log can't be written: %w", d.failure)
+	}
+	if _, err := d.wal.Stat(); err != nil {
+		return fmt.Errorf("the log can't be read: %w", err)
+	}
+	return nil
+}
+
+// Stats returns how many messages and revisions there are, and the last id
+// handed out (see MessageStats).
+func (d *DurableMessages) Stats() (MessageStats, error) {
+	return d.mem.Stats()
+}
+
+// List returns a page of messages, as described by opts (see ListOptions).
+func (d *DurableMessages) List(opts ListOptions) ([]Message, error) {
+	return d.mem.List(opts)
+}
+
+// Search returns every message which matches the query, best match first.
+func (d *DurableMessages) Search(q SearchQuery) ([]SearchHit, error) {
+	return d.mem.Search(q)
+}
+
+// Revisions returns every revision of a message, oldest first, or false if the
+// message doesn't exist.
+func (d *DurableMessages) Revisions(id int) ([]Revision, bool, error) {
+	return d.mem.Revisions(id)
+}
+
+// SetRevisionResult records the palindrome result of a revision. It will throw
+// an error if the revision doesn't exist, or if the change couldn't be written
+// to disk.
+func (d *DurableMessages) SetRevisionResult(id int, rev int, isPalindrome int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	revisions, _, _ := d.mem.Revisions(id)
+	if _, ok := FindRevision(revisions, rev); !ok {
+		return errors.New("No such revision")
+	}
+
+	return d.write(logRecord{Op: LOG_REVISION_RESULT, ID: id, Rev: rev, IsPalindrome: &isPalindrome})
+}
+
+// DeleteAll removes all messages from the system, and returns them (sorted by
+// id in ascending order). Ids of removed messages are still not reused.
+func (d *DurableMessages) DeleteAll() ([]Message, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// nothing else can change d.mem while we hold d.lock
+	deleted, _ := d.mem.GetAll()
+	if err := d.write(logRecord{Op: LOG_DELETE_ALL}); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// Compact writes every message to a new snapshot file, then empties the log.
+func (d *DurableMessages) Compact() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.failure = d.compact()
+	return d.failure
+}
+
+// compact does the work for Compact. Must be called with d.lock held.
+func (d *DurableMessages) compact() error {
+	messages, _ := d.mem.GetAll()
+
+	snap := snapshot{
+		NextID:   int(d.mem.nextId.Load()),
+		Messages: make([]storedMessage, 0, len(messages)),
+	}
+	for _, msg := range messages {
+		sm := toStoredMessage(msg)
+		revisions, _, _ := d.mem.Revisions(msg.id)
+		sm.Revisions = toStoredRevisions(revisions)
+		snap.Messages = append(snap.Messages, *sm)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash can never leave behind a
+	// half-written snapshot
+	tmpPath := filepath.Join(d.dir, snapshotFileName+".tmp")
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(d.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(d.dir); err != nil {
+		return err
+	}
+
+	// everything in the log is now in the snapshot
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		return err
+	}
+	d.walSize = 0
+	d.pending = 0
+
+	return nil
+}
+
+// compactPeriodically calls compact every interval, if anything has changed,
+// until Close is called. It does nothing if interval is not positive.
+func (d *DurableMessages) compactPeriodically(interval time.Duration) {
+	defer close(d.stopped)
+
+	if interval <= 0 {
+		<-d.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.lock.Lock()
+			if d.pending > 0 {
+				d.failure = d.compact()
+				if d.failure != nil {
+					log.Println(d.failure)
+				}
+			}
+			d.lock.Unlock()
+		}
+	}
+}
+
+// Close stops background compaction and closes the log file. The store must not
+// be used afterwards.
+func (d *DurableMessages) Close() error {
+	close(d.stop)
+	<-d.stopped
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.wal.Close()
+}
+
+// writeFileSync writes data to a new file at path and fsyncs it before closing.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir fsyncs a directory, so that renames inside it are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
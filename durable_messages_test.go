@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDurableMessages(t *testing.T, dir string) *DurableMessages {
+	mo, err := OpenDurableMessages(dir, DEFAULT_TENANT, 0)
+	if err != nil {
+		t.Fatalf(`OpenDurableMessages(%s) has err %+v, want nil`, dir, err)
+	}
+	return mo
+}
+
+func TestDurableMessagesReplay(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	msg1, _ := mo.Add("hello", PSettings{})
+	msg2, _ := mo.Add("goodbye", PSettings{})
+	mo.Update(msg1.id, "racecar", PSettings{})
+	mo.Delete(msg2.id)
+	mo.Close()
+
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	msg, found, _ := mo.Get(msg1.id)
+	if !found {
+		t.Fatalf(`mo.Get(%d) not found`, msg1.id)
+	}
+	if msg.text != "racecar" {
+		t.Fatalf(`mo.Get(%d) msg.text = %s, want racecar`, msg1.id, msg.text)
+	}
+	if msg.hash != MessageHash("racecar", PSettings{}.withDefaults()) {
+		t.Fatalf(`mo.Get(%d) msg.hash = %s, want %s`, msg1.id, msg.hash, MessageHash("racecar", PSettings{}.withDefaults()))
+	}
+
+	if _, found, _ := mo.Get(msg2.id); found {
+		t.Fatalf(`mo.Get(%d) found, want not found`, msg2.id)
+	}
+
+	// ids are not reused, even for deleted messages
+	msg3, _ := mo.Add("again", PSettings{})
+	if msg3.id != 3 {
+		t.Fatalf(`mo.Add("again") msg.id = %d, want 3`, msg3.id)
+	}
+}
+
+func TestDurableMessagesDeleteAllReplay(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	mo.Add("hello", PSettings{})
+	mo.Add("goodbye", PSettings{})
+	mo.DeleteAll()
+	mo.Close()
+
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	messages, _ := mo.GetAll()
+	if len(messages) != 0 {
+		t.Fatalf(`len(mo.GetAll()) = %d, want 0`, len(messages))
+	}
+
+	msg, _ := mo.Add("again", PSettings{})
+	if msg.id != 3 {
+		t.Fatalf(`mo.Add("again") msg.id = %d, want 3`, msg.id)
+	}
+}
+
+func TestDurableMessagesCompact(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	mo.Add("hello", PSettings{})
+	msg2, _ := mo.Add("goodbye", PSettings{})
+	mo.Delete(msg2.id)
+
+	if err := mo.Compact(); err != nil {
+		t.Fatalf(`mo.Compact() has err %+v, want nil`, err)
+	}
+
+	info, _ := os.Stat(filepath.Join(dir, walFileName))
+	if info.Size() != 0 {
+		t.Fatalf(`log size after mo.Compact() = %d, want 0`, info.Size())
+	}
+
+	mo.Add("after", PSettings{})
+	mo.Close()
+
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	messages, _ := mo.GetAll()
+	if len(messages) != 2 {
+		t.Fatalf(`len(mo.GetAll()) = %d, want 2`, len(messages))
+	}
+
+	msg, _ := mo.Add("last", PSettings{})
+	if msg.id != 4 {
+		t.Fatalf(`mo.Add("last") msg.id = %d, want 4`, msg.id)
+	}
+}
+
+func TestDurableMessagesTornLog(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	mo.Add("hello", PSettings{})
+	mo.Close()
+
+	// simulate a crash in the middle of writing a record
+	f, _ := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"op":"add","message":{"id":2,"te`)
+	f.Close()
+
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	messages, _ := mo.GetAll()
+	if len(messages) != 1 {
+		t.Fatalf(`len(mo.GetAll()) = %d, want 1`, len(messages))
+	}
+
+	msg, _ := mo.Add("goodbye", PSettings{})
+	if msg.id != 2 {
+		t.Fatalf(`mo.Add("goodbye") msg.id = %d, want 2`, msg.id)
+	}
+}
+
+func TestDurableMessagesRevisions(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	msg, _ := mo.Add("hello", PSettings{})
+	mo.Update(msg.id, "racecar", PSettings{})
+	mo.SetRevisionResult(msg.id, 1, P_FALSE)
+	mo.Compact()
+	mo.Update(msg.id, "kayak", PSettings{})
+	mo.Close()
+
+	// the first two revisions come from the snapshot, the last from the log
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	msg, _, _ = mo.Get(msg.id)
+	if msg.revision != 3 {
+		t.Fatalf(`mo.Get(%d) msg.revision = %d, want 3`, msg.id, msg.revision)
+	}
+
+	revisions, _, _ := mo.Revisions(msg.id)
+	if len(revisions) != 3 {
+		t.Fatalf(`len(mo.Revisions(%d)) = %d, want 3`, msg.id, len(revisions))
+	}
+	if revisions[0].text != "hello" || revisions[0].isPalindrome != P_FALSE {
+		t.Fatalf(`mo.Revisions(%d)[0] = %+v, want hello, P_FALSE`, msg.id, revisions[0])
+	}
+	if revisions[2].text != "kayak" || revisions[2].hash != MessageHash("kayak", PSettings{}.withDefaults()) {
+		t.Fatalf(`mo.Revisions(%d)[2] = %+v, want kayak`, msg.id, revisions[2])
+	}
+}
+
+func TestDurableMessagesApplyReplay(t *testing.T) {
+	dir := t.TempDir()
+	mo := openTestDurableMessages(t, dir)
+
+	msg1, _ := mo.Add("hello", PSettings{})
+	ops := []MessageOp{
+		{op: MESSAGE_OP_CREATE, text: "racecar"},
+		{op: MESSAGE_OP_DELETE, id: msg1.id},
+	}
+	if _, err := mo.Apply(ops, true); err != nil {
+		t.Fatalf(`mo.Apply() has err %+v, want nil`, err)
+	}
+	mo.Close()
+
+	mo = openTestDurableMessages(t, dir)
+	defer mo.Close()
+
+	if _, found, _ := mo.Get(msg1.id); found {
+		t.Fatalf(`mo.Get(%d) found, want not found`, msg1.id)
+	}
+	if msg, found, _ := mo.Get(2); !found || msg.text != "racecar" {
+		t.Fatalf(`mo.Get(2) = %+v, %t, want racecar`, msg, found)
+	}
+}
+
+func TestDurableMessagesHealthy(t *testing.T) {
+	mo := openTestDurableMessages(t, t.TempDir())
+	defer mo.Close()
+
+	if err := mo.Healthy(); err != nil {
+		t.Fatalf(`mo.Healthy() has err %+v, want nil`, err)
+	}
+
+	// the log can't be written anymore
+	mo.wal.Close()
+	if _, err := mo.Add("hello", PSettings{}); err == nil {
+		t.Fatalf(`mo.Add("hello") with a closed log has no err, want one`)
+	}
+	if err := mo.Healthy(); err == nil {
+		t.Fatalf(`mo.Healthy() after a failed write has no err, want one`)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// This file contains the formats messages can be exported in and imported from
+// (see ExportMessages and ImportMessages). Every format is streamed, one
+// message at a time, so an export never has to fit in memory.
+
+// FORMAT_NDJSON is one JSON object (an ExportMessageData) per line,
+// FORMAT_CSV has a header row followed by one row per message (see
+// CSV_COLUMNS), and FORMAT_JSON is a JSON array of ExportMessageData.
+const (
+	FORMAT_NDJSON = "ndjson"
+	FORMAT_CSV    = "csv"
+	FORMAT_JSON   = "json"
+	// used when there's no format
+	DEFAULT_FORMAT = FORMAT_NDJSON
+)
+
+// FORMAT_CONTENT_TYPES is the Content-Type of each export format.
+var FORMAT_CONTENT_TYPES = map[string]string{
+	FORMAT_NDJSON: "application/x-ndjson",
+	FORMAT_CSV:    "text/csv; charset=utf-8",
+	FORMAT_JSON:   "application/json",
+}
+
+// CSV_COLUMNS are the columns of a CSV export, in order. They're named after
+// the fields of ExportMessageData. A CSV import only needs a "text" column,
+// the rest can be in any order, and unknown columns are ignored.
+var CSV_COLUMNS = []string{"id", "text", "profile", "mode", "revision", "is_palindrome", "status", "created_at", "updated_at"}
+
+// ExportWriter writes messages in one of the export formats.
+type ExportWriter interface {
+	// Write writes a single message.
+	Write(m ExportMessageData) error
+	// Close finishes the export (like closing the JSON array). It doesn't close
+	// the underlying io.Writer.
+	Close() error
+}
+
+// ExportReader reads messages in one of the export formats.
+type ExportReader interface {
+	// Read returns the next message, or io.EOF if there are no more.
+	Read() (ExportMessageData, error)
+}
+
+// NewExportWriter creates an ExportWriter for format, which writes to w. It
+// returns an error if the format doesn't exist.
+func NewExportWriter(w io.Writer, format string) (ExportWriter, error) {
+	switch format {
+	case FORMAT_NDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+	case FORMAT_CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FORMAT_JSON:
+		return &jsonWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// NewExportReader creates an ExportReader for format, which reads from r. It
+// returns an error if the format doesn't exist.
+func NewExportReader(r io.Reader, format string) (ExportReader, error) {
+	switch format {
+	case FORMAT_NDJSON:
+		return &ndjsonReader{dec: json.NewDecoder(r)}, nil
+	case FORMAT_CSV:
+		return &csvReader{r: csv.NewReader(r)}, nil
+	case FORMAT_JSON:
+		return &jsonReader{dec: json.NewDecoder(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// ---- NDJSON ----
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) Write(m ExportMessageData) error {
+	// Encode adds the newline
+	return nw.enc.Encode(m)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
+
+type ndjsonReader struct {
+	dec *json.Decoder
+}
+
+func (nr *ndjsonReader) Read() (ExportMessageData, error) {
+	// the decoder doesn't care about newlines, any whitespace separates
+	// values
+	var m ExportMessageData
+	err := nr.dec.Decode(&m)
+	return m, err
+}
+
+// ---- JSON ----
+
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (jw *jsonWriter) Write(m ExportMessageData) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	prefix := ",\n"
+	if jw.count == 0 {
+		prefix = "[\n"
+	}
+	jw.count++
+
+	_, err = io.WriteString(jw.w, prefix+string(line))
+	return err
+}
+
+func (jw *jsonWriter) Close() error {
+	suffix := "\n]\n"
+	if jw.count == 0 {
+		suffix = "[]\n"
+	}
+
+	_, err := io.WriteString(jw.w, suffix)
+	return err
+}
+
+type jsonReader struct {
+	dec *json.Decoder
+	// true once the opening bracket has been read
+	started bool
+	// true once the closing bracket has been read
+	done bool
+}
+
+func (jr *jsonReader) Read() (ExportMessageData, error) {
+	if jr.done {
+		return ExportMessageData{}, io.EOF
+	}
+
+	if !jr.started {
+		if tok, err := jr.dec.Token(); err != nil {
+			return ExportMessageData{}, err
+		} else if tok != json.Delim('[') {
+			return ExportMessageData{}, errors.New("expected a JSON array")
+		}
+		jr.started = true
+	}
+
+	if !jr.dec.More() {
+		if _, err := jr.dec.Token(); err != nil {
+			return ExportMessageData{}, err
+		}
+		jr.done = true
+		return ExportMessageData{}, io.EOF
+	}
+
+	var m ExportMessageData
+	err := jr.dec.Decode(&m)
+	return m, err
+}
+
+// ---- CSV ----
+
+type csvWriter struct {
+	w *csv.Writer
+	// true once the header row has been written
+	started bool
+}
+
+func (cw *csvWriter) Write(m ExportMessageData) error {
+	if !cw.started {
+		if err := cw.w.Write(CSV_COLUMNS); err != nil {
+			return err
+		}
+		cw.started = true
+	}
+
+	isPalindrome := ""
+	if m.IsPalindrome != nil {
+		isPalindrome = strconv.FormatBool(*m.IsPalindrome)
+	}
+
+	cw.w.Write([]string{
+		strconv.Itoa(m.ID),
+		m.Text,
+		m.Profile,
+		m.Mode,
+		strconv.Itoa(m.Revision),
+		isPalindrome,
+		m.Status,
+		m.CreatedAt.Format(time.RFC3339Nano),
+		m.UpdatedAt.Format(time.RFC3339Nano),
+	})
+
+	// don't hold rows back, the export is streamed
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter) Close() error {
+	if !cw.started {
+		cw.w.Write(CSV_COLUMNS)
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+	// key: column name, value: index in each row. Set once the header row has
+	// been read.
+	columns map[string]int
+}
+
+func (cr *csvReader) Read() (ExportMessageData, error) {
+	if cr.columns == nil {
+		header, err := cr.r.Read()
+		if err == io.EOF {
+			return ExportMessageData{}, errors.New("missing the header row")
+		} else if err != nil {
+			return ExportMessageData{}, err
+		}
+
+		cr.columns = make(map[string]int)
+		for i, name := range header {
+			cr.columns[name] = i
+		}
+		if _, ok := cr.columns["text"]; !ok {
+			return ExportMessageData{}, errors.New(`missing the "text" column`)
+		}
+	}
+
+	row, err := cr.r.Read()
+	if err != nil {
+		return ExportMessageData{}, err
+	}
+	column := func(name string) string {
+		if i, ok := cr.columns[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+
+	m := ExportMessageData{
+		Text:    column("text"),
+		Profile: column("profile"),
+		Mode:    column("mode"),
+	}
+	if id := column("id"); id != "" {
+		if m.ID, err = strconv.Atoi(id); err != nil {
+			return ExportMessageData{}, fmt.Errorf("id: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// IsFormat returns true if format is one of the export formats.
+func IsFormat(format string) bool {
+	_, ok := FORMAT_CONTENT_TYPES[format]
+	return ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	yes := true
+	now := time.Now().UTC()
+	messages := []ExportMessageData{
+		{ID: 1, Text: "racecar", Profile: PROFILE_ASCII, Mode: MODE_CHAR, Revision: 1, IsPalindrome: &yes, Status: "done", CreatedAt: now, UpdatedAt: now},
+		{ID: 3, Text: "hello, \"world\"\nbye", Revision: 2, Status: "pending", CreatedAt: now, UpdatedAt: now},
+	}
+
+	for format := range FORMAT_CONTENT_TYPES {
+		var buf bytes.Buffer
+		ew, err := NewExportWriter(&buf, format)
+		if err != nil {
+			t.Fatalf(`NewExportWriter(%s) has err %+v, want nil`, format, err)
+		}
+		for _, m := range messages {
+			if err := ew.Write(m); err != nil {
+				t.Fatalf(`ew.Write(%+v) (%s) has err %+v, want nil`, m, format, err)
+			}
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatalf(`ew.Close() (%s) has err %+v, want nil`, format, err)
+		}
+
+		er, _ := NewExportReader(&buf, format)
+		for _, m := range messages {
+			got, err := er.Read()
+			if err != nil {
+				t.Fatalf(`er.Read() (%s) has err %+v, want nil`, format, err)
+			}
+			// only these are imported, so CSV doesn't keep the rest
+			if got.ID != m.ID || got.Text != m.Text || got.Profile != m.Profile || got.Mode != m.Mode {
+				t.Fatalf(`er.Read() (%s) = %+v, want %+v`, format, got, m)
+			}
+		}
+		if _, err := er.Read(); err != io.EOF {
+			t.Fatalf(`er.Read() (%s) at the end has err %+v, want io.EOF`, format, err)
+		}
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	for format := range FORMAT_CONTENT_TYPES {
+		var buf bytes.Buffer
+		ew, _ := NewExportWriter(&buf, format)
+		ew.Close()
+
+		er, _ := NewExportReader(&buf, format)
+		if _, err := er.Read(); err != io.EOF {
+			t.Fatalf(`er.Read() (%s) of an empty export has err %+v, want io.EOF`, format, err)
+		}
+	}
+}
+
+func TestExportReaderCSVColumns(t *testing.T) {
+	er, _ := NewExportReader(bytes.NewBufferString("mode,text,extra\nword,a man a plan,x\n"), FORMAT_CSV)
+	got, err := er.Read()
+	if err != nil {
+		t.Fatalf(`er.Read() has err %+v, want nil`, err)
+	}
+	if got.Text != "a man a plan" || got.Mode != "word" || got.ID != 0 {
+		t.Fatalf(`er.Read() = %+v, want text "a man a plan" and mode word`, got)
+	}
+
+	er, _ = NewExportReader(bytes.NewBufferString("id,mode\n1,word\n"), FORMAT_CSV)
+	if _, err := er.Read(); err == nil {
+		t.Fatalf(`er.Read() without a text column has err nil, want an error`)
+	}
+}
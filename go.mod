@@ -3,3 +3,5 @@ module github.com/cruncha-cruncha/palindrome
 go 1.23.6
 
 require github.com/gorilla/mux v1.8.1
+
+require golang.org/x/text v0.28.0
@@ -1,54 +1,125 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// sseHeartbeatInterval is how often StreamMessageEvents sends a comment to
+	// keep idle connections open.
+	sseHeartbeatInterval = 15 * time.Second
+	// waitPollInterval is how often awaitResult re-checks palindrome work, in
+	// case someone else read from the same listener.
+	waitPollInterval = 500 * time.Millisecond
+	// importBatchSize is how many messages ImportMessages creates at once.
+	importBatchSize = 1000
+	// maxImportErrors is the most errors ImportMessages reports, the rest are
+	// only counted.
+	maxImportErrors = 100
 )
 
-// CreateMessage expects a JSON payload with a "text" field and returns 200 with
-// a JSON response, which has an "id" field (a positive integer).
+// CreateMessage expects a JSON payload with a "text" field and returns 201 with
+// a JSON response, which has an "id" field (a positive integer). If there's no
+// room to queue palindrome work, no message is created and it returns 503 with
+// a Retry-After header. If the tenant already has as many messages as its quota
+// allows, it returns 403.
+//
+// An optional "wait" query parameter (a duration, like "10s") makes it block
+// until the palindrome calculation is done, the wait is over, or the client
+// goes away, whichever comes first. The response then also has "text" and
+// "is_palindrome" fields, just like GetMessage.
 func (ss *SharedState) CreateMessage(w http.ResponseWriter, r *http.Request) {
-	// verify payload (need some text)
-	decoder := json.NewDecoder(r.Body)
-	var payload CreateMessageRequestData
-	if err := decoder.Decode(&payload); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+	// get how long we're willing to wait for a result
+	wait, err := ParseWaitFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
 		return
 	}
 
-	// create the message
-	msg, err := ss.mo.Add(payload.Text)
+	// verify payload (need some text, and maybe settings)
+	payload, settings, err := ReadMessagePayload[CreateMessageRequestData](w, r, ss.limits)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
 		return
 	}
 
-	// kick off the palindrome work
-	_, _, _, err = ss.po.Add(msg)
-	if err != nil {
+	// create the message and kick off the palindrome work
+	msg, result, onChange, err := ss.createMessage(payload.Text, settings)
+	var queueFull *QueueFullError
+	if errors.As(err, &queueFull) {
+		SetRetryAfter(w, queueFull.RetryAfter)
+		WriteProblem(w, r, E_QUEUE_FULL, queueFull.Error())
+		return
+	} else if errors.Is(err, ErrQuotaExceeded) {
+		WriteProblem(w, r, E_QUOTA_EXCEEDED, err.Error())
+		return
+	} else if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// maybe wait for the result, and respond with it as well as the id
+	if wait > 0 {
+		result = ss.awaitResult(r.Context(), PWorkKeyFromMsg(msg), result, onChange, wait)
+		if r.Context().Err() != nil {
+			// the client went away, no one to respond to
+			return
+		}
+
+		w.Header().Set("ETag", ss.messageETag(msg, result))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateMessageWaitResponseData{
+			ID:           msg.id,
+			Text:         msg.text,
+			IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		})
 		return
 	}
 
 	// respond with message id
+	w.Header().Set("ETag", ss.messageETag(msg, result))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(CreateMessageResponseData{ID: msg.id})
 }
 
-// GetMessage expects an ID in the path and returns a JSON response with two
-// fields: "text" and "is_palindrome". The "is_palindrome" field is a boolean
-// but can be null. It will return 404 if the message is not found.
+// GetMessage expects an ID in the path and returns a JSON response with three
+// fields: "text", "is_palindrome", and "analysis". The "is_palindrome" field is
+// a boolean but can be null, and "analysis" is null until the calculation is
+// done (see AnalysisResponseData). It will return 404 if the message is not
+// found.
+//
+// An optional "wait" query parameter (a duration, like "10s") makes it block
+// until the palindrome calculation is done, the wait is over, or the client
+// goes away, whichever comes first.
+//
+// The response has an ETag header (see MessageETag). If it matches the
+// If-None-Match header, it returns 304, no body.
 func (ss *SharedState) GetMessage(w http.ResponseWriter, r *http.Request) {
 	// get the message id we're looking for
 	id, err := ParseIdFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// get how long we're willing to wait for a result
+	wait, err := ParseWaitFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
 		return
 	}
 
@@ -56,36 +127,44 @@ func (ss *SharedState) GetMessage(w http.ResponseWriter, r *http.Request) {
 	msg, found, err := ss.mo.Get(id)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	} else if !found {
-		w.WriteHeader(http.StatusNotFound)
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
 		return
 	}
 
 	// get the palindrome work result corresponding to the message
-	workKey := PWorkKeyFromMsg(msg)
-	found, result, _, err := ss.po.Poll(workKey)
+	result, onChange, err := ss.messageResult(msg)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
-	} else if !found {
-		// This can happen on Add or Update: adding new work requires a message
-		// id, which doesn't exist until the message is created, so it's 
-		// possible for a message to exist with no corresponding palindrome work
-		// (for a brief moment in time).
-		// 
-		// It shouldn't happen on Delete or DeleteAll: messages are deleted
-		// before their work. But it's also a possible bug. In any case, there's
-		// no harm in inserting more work (duplicate work is handled / ignored).
+	}
 
-		// Kick off more work, so next time we'll have a result.
-		ss.po.Add(msg)
+	// maybe wait for the result
+	if wait > 0 {
+		result = ss.awaitResult(r.Context(), PWorkKeyFromMsg(msg), result, onChange, wait)
+		if r.Context().Err() != nil {
+			// the client went away, no one to respond to
+			return
+		}
+	}
+
+	// get the results of every analyzer
+	analyses, err := ss.messageAnalyses(msg, result)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
 
-		// Can safely return P_UNKNOWN, even though it could be annoying for the
-		// user.
-		result = PWResult{isPalindrome: P_UNKNOWN}
+	// skip the body if the client already has this version of the message
+	etag := MessageETag(msg, result, analyses...)
+	w.Header().Set("ETag", etag)
+	if ETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	// respond with the message text and palindrome status
@@ -94,152 +173,588 @@ func (ss *SharedState) GetMessage(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(GetMessageResponseData{
 		Text:         msg.text,
 		IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		Analysis:     AnalysisToResponse(msg.text, result),
+		Analyses:     AnalysesToResponse(msg, analyses),
 	})
 }
 
 // UpdateMessage expects an ID in the path as well as a JSON payload with a
 // "text" field. It will return 404 if the message to be updated is not found,
-// otherwise it will return 200, no body.
+// 412 if there's an If-Match header and it doesn't match the message (see
+// IfMatchMessage), 503 if there's no room to queue palindrome work for the new
+// text (the message is left unchanged), otherwise it will return 200, no body
+// (but with the new ETag).
 func (ss *SharedState) UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	// get the message id we want to update
 	id, err := ParseIdFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
 		return
 	}
 
-	// verify payload (need some text)
-	decoder := json.NewDecoder(r.Body)
-	var payload UpdateMessageRequestData
-	if err := decoder.Decode(&payload); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	// verify payload (need some text, and maybe settings)
+	payload, settings, err := ReadMessagePayload[UpdateMessageRequestData](w, r, ss.limits)
+	if err != nil {
+		WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
 		return
 	}
 
-	// verify that we're updating an existing message
-	oldMsg, found, err := ss.mo.Get(id)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// update the message (if it's the version the client expects), and swap
+	// out its palindrome work
+	msg, result, _, err := ss.updateMessage(id, payload.Text, settings, r.Header.Get("If-Match"))
+	var queueFull *QueueFullError
+	if errors.Is(err, ErrMessageNotFound) {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
 		return
-	} else if !found {
-		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		WriteProblem(w, r, E_PRECONDITION_FAILED, "the message doesn't match If-Match")
+		return
+	} else if errors.As(err, &queueFull) {
+		SetRetryAfter(w, queueFull.RetryAfter)
+		WriteProblem(w, r, E_QUEUE_FULL, queueFull.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// update the message
-	newMsg, err := ss.mo.Update(id, payload.Text)
+	// respond
+	w.Header().Set("ETag", ss.messageETag(msg, result))
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteMessage expects an ID in the path. It will return 404 if the message
+// to be deleted doesn't exist, 412 if there's an If-Match header and it
+// doesn't match the message, otherwise it will return 204, no body.
+func (ss *SharedState) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	// get the message id we want to delete
+	id, err := ParseIdFromPath(r)
 	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// delete the message (if it's the version the client expects) and cancel
+	// its palindrome work
+	err = ss.deleteMessage(id, r.Header.Get("If-Match"))
+	if errors.Is(err, ErrMessageNotFound) {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		WriteProblem(w, r, E_PRECONDITION_FAILED, "the message doesn't match If-Match")
+		return
+	} else if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// kick off palindrome work for the new message
-	_, _, _, err = ss.po.Add(newMsg)
+	// respond
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAllMessages returns a JSON response with a 'messages' field, which is an
+// array of objects with 'id', 'text', and 'is_palindrome' fields. The array
+// is sorted by 'id' in ascending order.
+//
+// Query parameters can limit, order, and filter the messages (see
+// ParseListQuery). If there are more messages than the limit allows, the
+// response also has a 'next_cursor' field, which can be passed back as the
+// 'cursor' query parameter to get the next page. It returns 400 if any query
+// parameter is invalid.
+//
+// The response has an ETag header for the whole page (see ListETag). If it
+// matches the If-None-Match header, it returns 304, no body.
+func (ss *SharedState) GetAllMessages(w http.ResponseWriter, r *http.Request) {
+	// get the page we want
+	query, err := ParseListQuery(r)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
 		return
 	}
 
-	// cancel palindrome work for the old message
-	oldWorkKey := PWorkKeyFromMsg(oldMsg)
-	err = ss.po.Remove(oldWorkKey)
+	// get the messages, and their palindrome results
+	listed, nextCursor, err := ss.listMessages(query)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
+	// skip the body if the client already has this version of the page
+	etag := ListETag(listed, nextCursor)
+	w.Header().Set("ETag", etag)
+	if ETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// format the response data, messages are already sorted
+	data := GetAllMessagesResponseData{
+		Messages:   make([]GetAllMessagesResponseItem, 0, len(listed)),
+		NextCursor: nextCursor,
+	}
+	for _, lm := range listed {
+		data.Messages = append(data.Messages, GetAllMessagesResponseItem{
+			ID:           lm.msg.id,
+			Text:         lm.msg.text,
+			IsPalindrome: PStatusToBoolPointer(lm.result.isPalindrome),
+		})
+	}
+
 	// respond
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
 }
 
-// DeleteMessage expects an ID in the path. It will return 404 if the message
-// to be deleted doesn't exist, otherwise it will return 204, no body.
-func (ss *SharedState) DeleteMessage(w http.ResponseWriter, r *http.Request) {
-	// get the message id we want to delete
-	id, err := ParseIdFromPath(r)
+// DeleteAllMessages deletes all messages and returns 204, no body.
+func (ss *SharedState) DeleteAllMessages(w http.ResponseWriter, r *http.Request) {
+	// no message id or payload to parse
+
+	// delete all messages and cancel all palindrome work
+	err := ss.deleteAllMessages()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// verify that the message exists
-	msg, found, err := ss.mo.Get(id)
+	// respond
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BatchMessages expects a JSON payload with an "operations" field: an array of
+// creates, updates, and deletes, which are run in order, as a single change
+// (see BatchRequestData). If the "atomic" query parameter is true, either every
+// operation is applied or none are. It returns a JSON response with a
+// "results" field, which has the outcome of each operation (in the same order),
+// including the status code it would have had on its own. The status is 200,
+// or 409 if the batch was atomic and wasn't applied. It will return 400 (and
+// apply nothing) if the payload or query is invalid, 413 if the body is
+// bigger than MAX_BATCH_BYTES, or 429 if the client doesn't have a work token
+// for every create and update, or a full bucket of them for a bigger batch
+// (see AllowWork).
+//
+// Work for created and updated messages isn't waited for, and isn't refused
+// if the work queue is full (see applyBatch).
+func (ss *SharedState) BatchMessages(w http.ResponseWriter, r *http.Request) {
+	// all or nothing?
+	atomic, err := ParseBoolFromQuery(r, "atomic")
 	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// get the operations
+	var body io.Reader = r.Body
+	if ss.limits.maxBatchBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, ss.limits.maxBatchBytes)
+	}
+	var payload BatchRequestData
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WritePayloadProblem(w, r, E_INVALID_JSON, err)
 		return
-	} else if !found {
-		w.WriteHeader(http.StatusNotFound)
+	}
+	ops, err := ParseBatchOperations(payload.Operations, ss.limits)
+	if err != nil {
+		WritePayloadProblem(w, r, E_INVALID_BATCH, err)
+		return
+	}
+
+	// every create and update starts work, so takes a work token (but never
+	// more than the client's whole bucket, or a big batch could never run)
+	work := 0
+	for _, op := range ops {
+		if op.op != MESSAGE_OP_DELETE {
+			work++
+		}
+	}
+	if ok, detail := ss.AllowWork(w, r, work); !ok {
+		WriteProblem(w, r, E_RATE_LIMITED, detail)
 		return
 	}
 
-	// delete the message
-	err = ss.mo.Delete(id)
+	// run them, and start or cancel work to match
+	results, err := ss.applyBatch(ops, atomic)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// cancel the corresponding palindrome work
-	workKey := PWorkKeyFromMsg(msg)
-	err = ss.po.Remove(workKey)
+	// format the response data
+	data := BatchResponseData{Atomic: atomic, Results: []BatchResultResponseItem{}}
+	failed := -1
+	for i, result := range results {
+		data.Results = append(data.Results, MessageOpResultToResponse(ops[i], result))
+		if failed < 0 && result.err != nil && !errors.Is(result.err, ErrBatchAborted) {
+			failed = i
+		}
+	}
+
+	// an atomic batch which wasn't applied is an error, but still has results
+	if atomic && failed >= 0 {
+		problem := NewProblem(r, E_BATCH_FAILED, fmt.Sprintf("operations[%d] failed: %s", failed, results[failed].err))
+		w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+		w.WriteHeader(problem.Status)
+		json.NewEncoder(w).Encode(BatchProblemResponseData{problem, data})
+		return
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// ExportMessages streams every message, with its palindrome result, in
+// ascending order by id. The optional "format" query parameter is "ndjson"
+// (the default), "csv", or "json" (see export.go). It returns 400 if the format
+// is invalid, otherwise 200 with a Content-Disposition header, so browsers
+// save it as a file.
+//
+// Unlike GetAllMessages, the whole list is never in memory: messages are
+// fetched a batch at a time, and each batch is written (and flushed) before
+// the next one is fetched. So the export isn't a snapshot, messages changed
+// while it's running may or may not be included. If something goes wrong part
+// way through, the response just ends early. Exporting never kicks off
+// palindrome work: messages without any (like after a restart) are exported
+// with an unknown result.
+func (ss *SharedState) ExportMessages(w http.ResponseWriter, r *http.Request) {
+	// get the format
+	format, err := ParseFormatFromQuery(r)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
 		return
 	}
 
+	// start the response, we can't change the status after this
+	w.Header().Set("Content-Type", FORMAT_CONTENT_TYPES[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="messages.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+	ew, _ := NewExportWriter(w, format)
+	flusher, _ := w.(http.Flusher)
+
+	// write the messages, a batch at a time
+	page := ListOptions{Limit: listBatchSize}
+	for {
+		messages, err := ss.mo.List(page)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, m := range messages {
+			// only look: an export (like after a restart) shouldn't kick off
+			// work for every message, those without any are unknown
+			found, result, _, err := ss.po.Poll(PWorkKeyFromMsg(m))
+			if err != nil {
+				log.Println(err)
+				return
+			} else if !found {
+				result = PWResult{isPalindrome: P_UNKNOWN, status: PW_PENDING, settings: m.settings}
+			}
+			if err := ew.Write(MessageToExport(m, result)); err != nil {
+				// probably the client went away
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// we've seen every message
+		if len(messages) < page.Limit {
+			break
+		}
+		page.IdGt = messages[len(messages)-1].id
+	}
+
 	// respond
-	w.WriteHeader(http.StatusNoContent)
+	ew.Close()
 }
 
-// GetAllMessages returns a JSON response with a 'messages' field, which is an
-// array of objects with 'id', 'text', and 'is_palindrome' fields. The array
-// is sorted by 'id' in ascending order.
-func (ss *SharedState) GetAllMessages(w http.ResponseWriter, r *http.Request) {
-	// no message id or payload to parse
+// ImportMessages creates a message for every record in the body, which is in
+// the same format as an export (see ExportMessages and ExportMessageData). The
+// optional "format" query parameter is "ndjson" (the default), "csv", or
+// "json". Only the text, profile, and mode of each record are used. If the
+// "preserve_ids" query parameter is true, messages keep the id they have in the
+// import (if any), and new messages get ids after the largest one. Otherwise
+// every message gets a new id.
+//
+// The body is read as it arrives, and messages are created in batches of
+// importBatchSize, so the import doesn't have to fit in memory. A record that
+// can't be imported (its settings are invalid, or its id is taken) is skipped.
+// It returns a JSON response with "imported" and "failed" counts, and why the
+// first few records failed (see ImportResponseData). The status is 200, 400 if
+// the format is invalid or the body can't be read, or 413 if the body is bigger
+// than MAX_IMPORT_BYTES. If it stops partway, the records before the one it
+// stopped at are still imported. Each record takes a work token from the
+// client's rate limit, and once they run out the import waits for more (see
+// WaitForWork), so it's slowed down, not refused.
+//
+// Like BatchMessages, work for new messages isn't waited for, and isn't
+// refused if the work queue is full.
+func (ss *SharedState) ImportMessages(w http.ResponseWriter, r *http.Request) {
+	// get the format, and whether to keep ids
+	format, err := ParseFormatFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+	preserveIds, err := ParseBoolFromQuery(r, "preserve_ids")
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+	var body io.Reader = r.Body
+	if ss.limits.maxImportBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, ss.limits.maxImportBytes)
+	}
+	er, _ := NewExportReader(body, format)
 
-	// this will be our response data
-	data := GetAllMessagesResponseData{
-		Messages: []GetAllMessagesResponseItem{},
+	data := ImportResponseData{Errors: []ImportErrorResponseItem{}}
+	fail := func(record int, id int, code ErrorCode, err error) {
+		data.Failed++
+		if len(data.Errors) < maxImportErrors {
+			data.Errors = append(data.Errors, ImportErrorResponseItem{Record: record, ID: id, Code: code, Error: err.Error()})
+		}
+	}
+
+	// create messages a batch at a time. records[i] is where ops[i] came from.
+	ops := make([]MessageOp, 0, importBatchSize)
+	records := make([]int, 0, importBatchSize)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		// every record starts work, so waits for a work token
+		if err := ss.WaitForWork(w, r, len(ops)); err != nil {
+			return err
+		}
+		results, err := ss.applyBatch(ops, false)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.err != nil {
+				fail(records[i], ops[i].id, ErrorCodeOf(result.err), result.err)
+			} else {
+				data.Imported++
+			}
+		}
+		ops = ops[:0]
+		records = records[:0]
+		return nil
+	}
+
+	// read the records
+	var stopErr error
+	stopCode := E_INVALID_IMPORT
+	for record := 1; ; record++ {
+		m, err := er.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// can't tell where the next record starts (or there's no room
+			// for it), so stop here
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				stopCode = E_BODY_TOO_LARGE
+			}
+			fail(record, 0, stopCode, err)
+			stopErr = fmt.Errorf("record %d: %w", record, err)
+			break
+		}
+
+		op, err := ExportToMessageOp(m, preserveIds, ss.limits)
+		if err != nil {
+			fail(record, m.ID, E_INVALID_RECORD, err)
+			continue
+		}
+
+		ops = append(ops, op)
+		records = append(records, record)
+
+		if len(ops) == importBatchSize {
+			if err := flush(); err != nil {
+				log.Println(err)
+				WriteProblem(w, r, E_INTERNAL, "")
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
 	}
 
-	// get all messages
-	messages, err := ss.mo.GetAll()
+	// records which failed before they got to a batch are reported first
+	slices.SortStableFunc(data.Errors, func(a, b ImportErrorResponseItem) int {
+		return a.Record - b.Record
+	})
+
+	// an import which stopped before the end is an error, but still has
+	// counts
+	if stopErr != nil {
+		problem := NewProblem(r, stopCode, stopErr.Error())
+		w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+		w.WriteHeader(problem.Status)
+		json.NewEncoder(w).Encode(ImportProblemResponseData{problem, data})
+		return
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// StreamMessageEvents expects an ID in the path and streams Server-Sent Events
+// about that message until it's deleted or the client goes away. It will
+// return 404 if the message is not found. Otherwise it responds 200 and sends:
+//
+//   - a "result" event (see MessageEventData) straight away, and then again
+//     whenever the message text or palindrome result changes
+//   - a "deleted" event (see MessageDeletedEventData) if the message is
+//     deleted, after which the stream ends
+//   - a heartbeat comment every sseHeartbeatInterval, to keep the connection
+//     open
+//
+// Event ids describe the state of the message (not a position in some
+// history), so if the client reconnects with a Last-Event-ID header that
+// matches the current state, the initial "result" event is skipped.
+func (ss *SharedState) StreamMessageEvents(w http.ResponseWriter, r *http.Request) {
+	// get the message id we want to watch
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// verify that the message exists before starting the stream
+	_, found, err := ss.mo.Get(id)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	} else if !found {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("streaming not supported by response writer")
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// for each message, get the corresponding palindrome work, then format and
-	// add to the response data
-	for _, m := range messages {
-		workKey := PWorkKeyFromMsg(m)
-		found, result, _, err := ss.po.Poll(workKey)
+	// start the stream
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	for {
+		// get the latest version of the message, it may have been updated or
+		// deleted since we last looked
+		msg, found, err := ss.mo.Get(id)
 		if err != nil {
 			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
 			return
 		} else if !found {
-			// This should never happen, but we can handle it. See GetMessage
-			// for more details.
+			WriteEvent(w, "", "deleted", MessageDeletedEventData{ID: id})
+			flusher.Flush()
+			return
+		}
+
+		// poll the result, which (re-)creates work if there is none, but
+		// never for text the message doesn't have anymore (see messageResult).
+		// If the work queue is full, we'll try again on the next heartbeat.
+		result, onChange, err := ss.messageResult(msg)
+		if err != nil {
 			result = PWResult{isPalindrome: P_UNKNOWN}
-			ss.po.Add(m)
 		}
 
-		// Sort the response while we insert. Messages will end up in ascending
-		// order by ID.
-		insertIndex := BinarySearch(data.Messages, func(m *GetAllMessagesResponseItem) int { return m.ID }, m.id)
-		data.Messages = slices.Insert(data.Messages, insertIndex, GetAllMessagesResponseItem{
-			ID:           m.id,
-			Text:         m.text,
-			IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		// only send an event if something changed
+		eventId := MessageEventId(msg, result)
+		if eventId != lastEventId {
+			err := WriteEvent(w, eventId, "result", MessageEventData{
+				ID:            msg.id,
+				Text:          msg.text,
+				IsPalindrome:  PStatusToBoolPointer(result.isPalindrome),
+				Done:          result.done,
+				QueuePosition: result.queuePosition,
+			})
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			lastEventId = eventId
+		}
+
+		// Wait for something to happen. The onChange channel receives the new
+		// result when work finishes, and is closed when the message is updated
+		// or deleted. onChange is shared by everything watching this message,
+		// so another reader might get to an update first: re-checking on every
+		// heartbeat makes sure we never miss it for long.
+		select {
+		case <-onChange:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-ss.shuttingDown:
+			// the client can reconnect (with Last-Event-ID) once we're back
+			return
+		}
+	}
+}
+
+// SearchMessages expects a "q" query parameter (see ParseSearchQuery) and
+// returns a JSON response with a 'messages' field, which is an array of
+// objects with 'id', 'text', 'is_palindrome', and 'score' fields, best match
+// first. It also accepts "is_palindrome" and "limit" query parameters. It will
+// return 400 if the query is missing or invalid.
+func (ss *SharedState) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	// get what we're searching for
+	q, isPalindrome, limit, err := ParseSearchFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// search
+	found, err := ss.searchMessages(q, isPalindrome, limit)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// format the response data, messages are already ranked
+	data := SearchMessagesResponseData{
+		Messages: make([]SearchMessagesResponseItem, 0, len(found)),
+	}
+	for _, fm := range found {
+		data.Messages = append(data.Messages, SearchMessagesResponseItem{
+			ID:           fm.msg.id,
+			Text:         fm.msg.text,
+			IsPalindrome: PStatusToBoolPointer(fm.result.isPalindrome),
+			Score:        fm.score,
 		})
 	}
 
@@ -249,26 +764,477 @@ func (ss *SharedState) GetAllMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// DeleteAllMessages deletes all messages and returns 204, no body.
-func (ss *SharedState) DeleteAllMessages(w http.ResponseWriter, r *http.Request) {
-	// no message id or payload to parse
+// GetMessageRevisions expects an ID in the path and returns a JSON response
+// with a "revisions" field, which is an array of every revision of the
+// message (see RevisionResponseData), oldest first. It will return 404 if the
+// message is not found.
+func (ss *SharedState) GetMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	// get the message id we're looking for
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// get the revisions, return 404 if not found
+	revisions, err := ss.messageRevisions(id)
+	if errors.Is(err, ErrMessageNotFound) {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
+		return
+	} else if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// format the response data, revisions are already sorted
+	data := GetRevisionsResponseData{
+		Revisions: make([]RevisionResponseData, 0, len(revisions)),
+	}
+	for _, rev := range revisions {
+		data.Revisions = append(data.Revisions, RevisionToResponse(rev))
+	}
 
-	// delete all messages
-	err := ss.mo.DeleteAll()
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetMessageRevision expects an ID and a revision number in the path, and
+// returns a JSON response with that revision of the message (see
+// RevisionResponseData). It will return 404 if the message or the revision is
+// not found.
+func (ss *SharedState) GetMessageRevision(w http.ResponseWriter, r *http.Request) {
+	// get the message id and revision we're looking for
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+	rev, err := ParseRevFromPath(r)
 	if err != nil {
+		WriteProblem(w, r, E_INVALID_REVISION, err.Error())
+		return
+	}
+
+	// get the revision, return 404 if not found
+	revision, err := ss.messageRevision(id, rev)
+	if errors.Is(err, ErrMessageNotFound) || errors.Is(err, ErrRevisionNotFound) {
+		WriteProblem(w, r, ErrorCodeOf(err), fmt.Sprintf("there's no revision %d of message %d", rev, id))
+		return
+	} else if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
-	// cancel all palindrome work
-	err = ss.po.Clear()
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RevisionToResponse(revision))
+}
+
+// RestoreMessageRevision expects an ID and a revision number in the path. It
+// updates the message back to the text of that revision, just like
+// UpdateMessage (the palindrome work is redone, and the message gets a new
+// revision), then returns 200 with the new revision (see
+// RevisionResponseData). It will return 404 if the message or the revision is
+// not found, 412 if there's an If-Match header and it doesn't match the
+// message, or 503 if there's no room to queue palindrome work (the message is
+// left unchanged).
+func (ss *SharedState) RestoreMessageRevision(w http.ResponseWriter, r *http.Request) {
+	// get the message id and revision we want to restore
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+	rev, err := ParseRevFromPath(r)
 	if err != nil {
+		WriteProblem(w, r, E_INVALID_REVISION, err.Error())
+		return
+	}
+
+	// update the message to the old text (if it's the version the client
+	// expects), and swap out its palindrome work
+	msg, result, _, err := ss.restoreRevision(id, rev, r.Header.Get("If-Match"))
+	var queueFull *QueueFullError
+	if errors.Is(err, ErrMessageNotFound) || errors.Is(err, ErrRevisionNotFound) {
+		WriteProblem(w, r, ErrorCodeOf(err), fmt.Sprintf("there's no revision %d of message %d", rev, id))
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		WriteProblem(w, r, E_PRECONDITION_FAILED, "the message doesn't match If-Match")
+		return
+	} else if errors.As(err, &queueFull) {
+		SetRetryAfter(w, queueFull.RetryAfter)
+		WriteProblem(w, r, E_QUEUE_FULL, queueFull.Error())
+		return
+	} else if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteProblem(w, r, E_INTERNAL, "")
 		return
 	}
 
+	// respond with the new revision
+	w.Header().Set("ETag", ss.messageETag(msg, result))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RevisionToResponse(Revision{
+		rev:          msg.revision,
+		text:         msg.text,
+		settings:     msg.settings,
+		hash:         msg.hash,
+		createdAt:    msg.updatedAt,
+		isPalindrome: result.isPalindrome,
+	}))
+}
+
+// GetAnalyzers returns a JSON response with an "analyzers" field, which is an
+// array of every installed analyzer (with a "name" and "description"), in the
+// order they run. Each one's result is under "analyses" in message responses.
+func (ss *SharedState) GetAnalyzers(w http.ResponseWriter, r *http.Request) {
+	// format the response data
+	data := GetAnalyzersResponseData{Analyzers: []AnalyzerResponseItem{}}
+	for _, analyzer := range ss.analyzers.Analyzers() {
+		data.Analyzers = append(data.Analyzers, AnalyzerResponseItem{
+			Name:        analyzer.Name(),
+			Description: analyzer.Description(),
+		})
+	}
+
 	// respond
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetResultCache returns a JSON response with a "caches" field, describing the
+// result cache of every analyzer (or just the one in the "analyzer" query
+// parameter), with up to "limit" cached results each. Analyzers with caching
+// turned off are left out. It will return 404 if there's no such analyzer.
+func (ss *SharedState) GetResultCache(w http.ResponseWriter, r *http.Request) {
+	// get which caches we're looking at, and how much of them
+	only, limit, err := ParseCacheQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// find the caches
+	caches, found := ss.analyzers.ResultCaches(only)
+	if !found {
+		WriteProblem(w, r, E_ANALYZER_NOT_FOUND, fmt.Sprintf("there's no analyzer %q", only))
+		return
+	}
+
+	// format the response data
+	data := GetCacheResponseData{Caches: []CacheResponseItem{}}
+	for _, nc := range caches {
+		stats := nc.cache.Stats()
+		item := CacheResponseItem{
+			Analyzer:   nc.name,
+			Size:       stats.entries,
+			MaxSize:    stats.maxEntries,
+			TTLSeconds: int(stats.ttl.Seconds()),
+			Hits:       stats.hits,
+			Misses:     stats.misses,
+			Evictions:  stats.evictions,
+			Entries:    []CachedResultResponseItem{},
+		}
+		if limit > 0 {
+			for _, cr := range nc.cache.Entries(limit) {
+				item.Entries = append(item.Entries, CachedResultToResponse(cr))
+			}
+		}
+		data.Caches = append(data.Caches, item)
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// PurgeResultCache empties the result cache of every analyzer (or just the one
+// in the "analyzer" query parameter), and returns a JSON response with a
+// "purged" field: how many results were removed, by analyzer. Work that's
+// still in use by a message is not affected. It will return 404 if there's no
+// such analyzer.
+func (ss *SharedState) PurgeResultCache(w http.ResponseWriter, r *http.Request) {
+	// get which caches we're purging
+	only, _, err := ParseCacheQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// find the caches
+	caches, found := ss.analyzers.ResultCaches(only)
+	if !found {
+		WriteProblem(w, r, E_ANALYZER_NOT_FOUND, fmt.Sprintf("there's no analyzer %q", only))
+		return
+	}
+
+	// purge them
+	data := PurgeCacheResponseData{Purged: make(map[string]int)}
+	for _, nc := range caches {
+		data.Purged[nc.name] = nc.cache.Purge()
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetAPIKeys returns a JSON response with a "keys" field, which is an array
+// describing every API key (see APIKeyResponseItem), but not the keys
+// themselves. It's empty if the API is open.
+func (ss *SharedState) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	// format the response data
+	data := GetAPIKeysResponseData{Keys: []APIKeyResponseItem{}}
+	if ss.keys != nil {
+		for _, key := range ss.keys.List() {
+			data.Keys = append(data.Keys, APIKeyToResponse(key))
+		}
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// RotateAPIKey expects an API key id in the path. It replaces that key with a
+// new one, saves it (hashed) to the config file, and returns 200 with a JSON
+// response including the new key (see RotateAPIKeyResponseData). The old key
+// stops working straight away, even if it's the one making this request. It
+// will return 404 if there's no key with that id (which is every id, if the API
+// is open).
+func (ss *SharedState) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// find the key
+	id := mux.Vars(r)["id"]
+	if ss.keys == nil {
+		WriteProblem(w, r, E_KEY_NOT_FOUND, "there are no API keys, the API is open")
+		return
+	}
+
+	// rotate it
+	secret, key, err := ss.keys.Rotate(id)
+	if errors.Is(err, ErrKeyNotFound) {
+		WriteProblem(w, r, E_KEY_NOT_FOUND, fmt.Sprintf("there's no API key %q", id))
+		return
+	} else if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+	log.Printf("Rotated API key %q\n", id)
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RotateAPIKeyResponseData{APIKeyToResponse(key), secret})
+}
+
+// GetMetrics returns metrics about requests, messages (for every tenant), and
+// work (for every analyzer), in the Prometheus text format (see metrics.go).
+func (ss *SharedState) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	// count the messages
+	counts := make([]int, 0)
+	stores := ss.tenants.All()
+	for _, ns := range stores {
+		stats, err := ns.mo.Stats()
+		if err != nil {
+			log.Println(err)
+			WriteProblem(w, r, E_INTERNAL, "")
+			return
+		}
+		counts = append(counts, stats.messages)
+	}
+
+	// write everything out
+	var buf bytes.Buffer
+	ss.metrics.write(&buf)
+	writeMetricHeader(&buf, "palindrome_messages", "gauge", "Number of messages stored, by tenant.")
+	for i, ns := range stores {
+		fmt.Fprintf(&buf, "palindrome_messages%s %d\n", formatLabels("tenant", ns.name), counts[i])
+	}
+	if ss.limiter != nil {
+		rejected := ss.limiter.Rejected()
+		writeMetricHeader(&buf, "palindrome_rate_limited_total", "counter", "Requests refused because their client made too many, by kind.")
+		for _, class := range RATE_CLASSES {
+			fmt.Fprintf(&buf, "palindrome_rate_limited_total%s %d\n", formatLabels("class", class), rejected[class])
+		}
+	}
+	writeWorkStats(&buf, ss.analyzers.WorkStats())
+
+	// respond
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// GetHealth is a liveness check: it always returns 200, with a JSON response
+// whose "status" field is "ok".
+func (ss *SharedState) GetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HealthResponseData{Status: "ok"})
+}
+
+// GetReadiness is a readiness check: it returns 200 if the server can take
+// requests right now, otherwise 503. That means the message store is
+// reachable (and, if it's on disk, its last write worked, see
+// StoreHealthReporter), every analyzer has room in its work queue, and the
+// server isn't shutting down. The JSON response says how each check went (see
+// ReadyResponseData).
+func (ss *SharedState) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	data := ReadyResponseData{Ready: true, Checks: make(map[string]string)}
+	fail := func(check string, reason string) {
+		data.Ready = false
+		data.Checks[check] = reason
+	}
+
+	// can we get at the messages (of every tenant), and change them?
+	data.Checks["store"] = "ok"
+	for _, ns := range ss.tenants.All() {
+		_, err := ns.mo.Stats()
+		if shr, ok := ns.mo.(StoreHealthReporter); ok && err == nil {
+			err = shr.Healthy()
+		}
+		if err != nil {
+			fail("store", fmt.Sprintf("tenant %q: %v", ns.name, err))
+			break
+		}
+	}
+
+	// is there room for more work?
+	data.Checks["workers"] = "ok"
+	for _, nws := range ss.analyzers.WorkStats() {
+		if nws.stats.closing {
+			fail("workers", fmt.Sprintf("analyzer %q has stopped", nws.name))
+			break
+		} else if nws.stats.queued >= nws.stats.queueDepth {
+			fail("workers", fmt.Sprintf("analyzer %q queue is full", nws.name))
+			break
+		}
+	}
+
+	// are we on our way out?
+	data.Checks["shutdown"] = "ok"
+	if ss.isShuttingDown() {
+		fail("shutdown", "shutting down")
+	}
+
+	// not being ready is an error, but still has the checks
+	if !data.Ready {
+		problem := NewProblem(r, E_NOT_READY, "")
+		w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+		w.WriteHeader(problem.Status)
+		json.NewEncoder(w).Encode(ReadyProblemResponseData{problem, data})
+		return
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetDebugState returns a JSON dump of the server's internal state (see
+// DebugStateResponseData): counts from the message store of every tenant, and
+// every piece of work of every analyzer, with the tenants and ids of the
+// messages listening to it. It's meant for debugging the hash and listener
+// bookkeeping, and can be large.
+func (ss *SharedState) GetDebugState(w http.ResponseWriter, r *http.Request) {
+	// describe the messages of every tenant
+	data := DebugStateResponseData{
+		Tenants:   []DebugMessagesResponseData{},
+		Analyzers: []DebugAnalyzerResponseData{},
+	}
+	for _, ns := range ss.tenants.All() {
+		stats, err := ns.mo.Stats()
+		if err != nil {
+			log.Println(err)
+			WriteProblem(w, r, E_INTERNAL, "")
+			return
+		}
+		data.Tenants = append(data.Tenants, DebugMessagesResponseData{
+			Tenant:    ns.name,
+			Count:     stats.messages,
+			Revisions: stats.revisions,
+			NextID:    stats.nextId,
+		})
+	}
+
+	// describe the work
+	now := time.Now()
+	for _, nws := range ss.analyzers.WorkStates() {
+		item := DebugAnalyzerResponseData{
+			Analyzer:   nws.name,
+			Workers:    nws.stats.workers,
+			Running:    nws.stats.running,
+			QueueDepth: nws.stats.queueDepth,
+			Queued:     nws.stats.queued,
+			Closing:    nws.stats.closing,
+			Work:       []DebugWorkResponseItem{},
+		}
+		for _, state := range nws.states {
+			item.Work = append(item.Work, WorkStateToResponse(state, now))
+		}
+		data.Analyzers = append(data.Analyzers, item)
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetProblemTypes returns a JSON response with a "problems" field, which is an
+// array describing every kind of error in the catalogue (see
+// ProblemTypeResponseData), sorted by code.
+func (ss *SharedState) GetProblemTypes(w http.ResponseWriter, r *http.Request) {
+	// format the response data
+	data := GetProblemTypesResponseData{Problems: []ProblemTypeResponseData{}}
+	for _, code := range ErrorCodes() {
+		data.Problems = append(data.Problems, ProblemTypeToResponse(code, ERROR_CATALOGUE[code]))
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetProblemType expects an error code in the path (the end of an error's
+// "type") and returns a JSON response describing it (see
+// ProblemTypeResponseData). It will return 404 if there's no such code.
+func (ss *SharedState) GetProblemType(w http.ResponseWriter, r *http.Request) {
+	// find the code
+	code := ErrorCode(mux.Vars(r)["code"])
+	pt, ok := ERROR_CATALOGUE[code]
+	if !ok {
+		WriteProblem(w, r, E_ROUTE_NOT_FOUND, fmt.Sprintf("there's no error code %q", code))
+		return
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ProblemTypeToResponse(code, pt))
+}
+
+// NotFound responds to requests which don't match any route, with 404.
+func (ss *SharedState) NotFound(w http.ResponseWriter, r *http.Request) {
+	WriteProblem(w, r, E_ROUTE_NOT_FOUND, "")
+}
+
+// MethodNotAllowed responds to requests which match the path of a route, but
+// not its method, with 405.
+func (ss *SharedState) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteProblem(w, r, E_METHOD_NOT_ALLOWED, fmt.Sprintf("%s isn't supported here", r.Method))
 }
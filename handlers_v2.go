@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// The v2 handlers behave like their v1 counterparts, except every response that
+// includes a message uses MessageResponseDataV2, which has an explicit
+// "status" field as well as timestamps. DELETE endpoints don't return a
+// payload, so v2 re-uses the v1 handlers for them.
+
+// CreateMessageV2 expects a JSON payload with a "text" field and returns 201
+// with the new message. If there's no room to queue palindrome work, no message
+// is created and it returns 503 with a Retry-After header, and if the tenant's
+// quota is used up it returns 403. Like CreateMessage, it accepts an optional
+// "wait" query parameter.
+func (ss *SharedState) CreateMessageV2(w http.ResponseWriter, r *http.Request) {
+	// get how long we're willing to wait for a result
+	wait, err := ParseWaitFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// verify payload (need some text, and maybe settings)
+	payload, settings, err := ReadMessagePayload[CreateMessageRequestData](w, r, ss.limits)
+	if err != nil {
+		WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
+		return
+	}
+
+	// create the message and kick off the palindrome work
+	msg, result, onChange, err := ss.createMessage(payload.Text, settings)
+	var queueFull *QueueFullError
+	if errors.As(err, &queueFull) {
+		SetRetryAfter(w, queueFull.RetryAfter)
+		WriteProblem(w, r, E_QUEUE_FULL, queueFull.Error())
+		return
+	} else if errors.Is(err, ErrQuotaExceeded) {
+		WriteProblem(w, r, E_QUOTA_EXCEEDED, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// maybe wait for the result
+	if wait > 0 {
+		result = ss.awaitResult(r.Context(), PWorkKeyFromMsg(msg), result, onChange, wait)
+		if r.Context().Err() != nil {
+			// the client went away, no one to respond to
+			return
+		}
+	}
+
+	// get the results of every analyzer
+	analyses, err := ss.messageAnalyses(msg, result)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// respond with the new message
+	w.Header().Set("ETag", MessageETag(msg, result, analyses...))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MessageToV2(msg, result, analyses))
+}
+
+// GetMessageV2 expects an ID in the path and returns the message. It will
+// return 404 if the message is not found. Like GetMessage, it accepts an
+// optional "wait" query parameter, and handles ETags.
+func (ss *SharedState) GetMessageV2(w http.ResponseWriter, r *http.Request) {
+	// get the message id we're looking for
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// get how long we're willing to wait for a result
+	wait, err := ParseWaitFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// get the message, return 404 if not found
+	msg, found, err := ss.mo.Get(id)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	} else if !found {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
+		return
+	}
+
+	// get the palindrome work result corresponding to the message
+	result, onChange, err := ss.messageResult(msg)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// maybe wait for the result
+	if wait > 0 {
+		result = ss.awaitResult(r.Context(), PWorkKeyFromMsg(msg), result, onChange, wait)
+		if r.Context().Err() != nil {
+			// the client went away, no one to respond to
+			return
+		}
+	}
+
+	// get the results of every analyzer
+	analyses, err := ss.messageAnalyses(msg, result)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// skip the body if the client already has this version of the message
+	etag := MessageETag(msg, result, analyses...)
+	w.Header().Set("ETag", etag)
+	if ETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// respond with the message
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MessageToV2(msg, result, analyses))
+}
+
+// UpdateMessageV2 expects an ID in the path as well as a JSON payload with a
+// "text" field, and returns 200 with the updated message. It will return 404
+// if the message to be updated is not found, 412 if there's an If-Match header
+// and it doesn't match the message, or 503 if there's no room to queue
+// palindrome work for the new text (the message is left unchanged).
+func (ss *SharedState) UpdateMessageV2(w http.ResponseWriter, r *http.Request) {
+	// get the message id we want to update
+	id, err := ParseIdFromPath(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_ID, err.Error())
+		return
+	}
+
+	// verify payload (need some text, and maybe settings)
+	payload, settings, err := ReadMessagePayload[UpdateMessageRequestData](w, r, ss.limits)
+	if err != nil {
+		WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
+		return
+	}
+
+	// update the message (if it's the version the client expects), and swap
+	// out its palindrome work
+	msg, result, _, err := ss.updateMessage(id, payload.Text, settings, r.Header.Get("If-Match"))
+	var queueFull *QueueFullError
+	if errors.Is(err, ErrMessageNotFound) {
+		WriteProblem(w, r, E_MESSAGE_NOT_FOUND, fmt.Sprintf("there's no message %d", id))
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		WriteProblem(w, r, E_PRECONDITION_FAILED, "the message doesn't match If-Match")
+		return
+	} else if errors.As(err, &queueFull) {
+		SetRetryAfter(w, queueFull.RetryAfter)
+		WriteProblem(w, r, E_QUEUE_FULL, queueFull.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// get the results of every analyzer
+	analyses, err := ss.messageAnalyses(msg, result)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// respond with the updated message
+	w.Header().Set("ETag", MessageETag(msg, result, analyses...))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MessageToV2(msg, result, analyses))
+}
+
+// GetAllMessagesV2 returns a JSON response with a "messages" field, which is an
+// array of messages sorted by id in ascending order. Like GetAllMessages, it
+// accepts query parameters to limit, order, and filter the messages, the
+// response may have a "next_cursor" field, and it handles ETags.
+func (ss *SharedState) GetAllMessagesV2(w http.ResponseWriter, r *http.Request) {
+	// get the page we want
+	query, err := ParseListQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// get the messages, and their palindrome results
+	listed, nextCursor, err := ss.listMessages(query)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// skip the body if the client already has this version of the page
+	etag := ListETag(listed, nextCursor)
+	w.Header().Set("ETag", etag)
+	if ETagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// format the response data, messages are already sorted
+	data := GetAllMessagesResponseDataV2{
+		Messages:   make([]MessageResponseDataV2, 0, len(listed)),
+		NextCursor: nextCursor,
+	}
+	for _, lm := range listed {
+		data.Messages = append(data.Messages, MessageToV2(lm.msg, lm.result, lm.analyses))
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// SearchMessagesV2 is the same as SearchMessages, except every message also has
+// the fields of MessageResponseDataV2.
+func (ss *SharedState) SearchMessagesV2(w http.ResponseWriter, r *http.Request) {
+	// get what we're searching for
+	q, isPalindrome, limit, err := ParseSearchFromQuery(r)
+	if err != nil {
+		WriteProblem(w, r, E_INVALID_QUERY, err.Error())
+		return
+	}
+
+	// search
+	found, err := ss.searchMessages(q, isPalindrome, limit)
+	if err != nil {
+		log.Println(err)
+		WriteProblem(w, r, E_INTERNAL, "")
+		return
+	}
+
+	// format the response data, messages are already ranked
+	data := SearchMessagesResponseDataV2{
+		Messages: make([]SearchMessagesResponseItemV2, 0, len(found)),
+	}
+	for _, fm := range found {
+		data.Messages = append(data.Messages, SearchMessagesResponseItemV2{
+			MessageResponseDataV2: MessageToV2(fm.msg, fm.result, fm.analyses),
+			Score:                 fm.score,
+		})
+	}
+
+	// respond
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
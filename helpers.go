@@ -2,11 +2,16 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // CalculateHash returns the SHA-256 hash of some given text.
@@ -17,6 +22,14 @@ func CalculateHash(text string) string {
 	return fmt.Sprintf("%x", bs)
 }
 
+// MessageHash returns the hash of a message's text along with its settings (see
+// CalculateHash). Two messages with the same text but different settings can
+// have different palindrome results, so they need different hashes. Settings
+// should already have defaults filled in.
+func MessageHash(text string, settings PSettings) string {
+	return CalculateHash(settings.profile + "\x00" + settings.mode + "\x00" + text)
+}
+
 // ParseIdFromPath extracts the "id" parameter from the request path. It uses
 // the gorilla/mux package. It returns 0 and an error if the "id" parameter is
 // not found or if it is not a valid integer.
@@ -29,12 +42,459 @@ func ParseIdFromPath(r *http.Request) (int, error) {
 
 	id, err := strconv.Atoi(str_id)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("id %q is not an integer", str_id)
 	}
 
 	return id, nil
 }
 
+// ParseRevFromPath extracts the "rev" variable (a revision number) from the
+// path of a request. It returns an error if "rev" is missing or not an integer.
+func ParseRevFromPath(r *http.Request) (int, error) {
+	params := mux.Vars(r)
+	str_rev, ok := params["rev"]
+	if !ok {
+		return 0, errors.New("rev not found in path")
+	}
+
+	rev, err := strconv.Atoi(str_rev)
+	if err != nil {
+		return 0, fmt.Errorf("rev %q is not an integer", str_rev)
+	}
+
+	return rev, nil
+}
+
+// maxWait is the longest a request can ask to wait for a result.
+const maxWait = 60 * time.Second
+
+// ParseWaitFromQuery extracts the optional "wait" query parameter, which is a
+// duration like "10s" or "500ms". It returns 0 if there is no "wait" parameter,
+// and an error if it can't be parsed or is negative. Waits longer than maxWait
+// are cut down to maxWait.
+func ParseWaitFromQuery(r *http.Request) (time.Duration, error) {
+	str_wait := r.URL.Query().Get("wait")
+	if str_wait == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(str_wait)
+	if err != nil {
+		return 0, err
+	} else if wait < 0 {
+		return 0, errors.New("wait can't be negative")
+	}
+
+	return min(wait, maxWait), nil
+}
+
+// maxListLimit is the most messages a request can ask for in one page.
+const maxListLimit = 1000
+
+// ListQuery describes which messages a request wants listed: a page (bounds,
+// order, and limit) and an optional filter on the palindrome result.
+type ListQuery struct {
+	page ListOptions
+	// only include messages with this palindrome result (P_UNKNOWN, P_TRUE,
+	// or P_FALSE). nil means no filter.
+	isPalindrome *int
+}
+
+// ParseListQuery extracts listing parameters from the request's query string:
+//
+//   - limit: the maximum number of messages (at most maxListLimit, default: no
+//     limit)
+//   - order: "asc" (the default) or "desc", by id
+//   - id_gt, id_lt: only include messages with ids in this (exclusive) range
+//   - is_palindrome: "true", "false", or "null"
+//   - cursor: an opaque value from a previous response's "next_cursor", to get
+//     the next page
+//
+// It returns an error if any parameter is invalid, or if the order doesn't
+// match the cursor's.
+func ParseListQuery(r *http.Request) (ListQuery, error) {
+	params := r.URL.Query()
+	q := ListQuery{}
+
+	// parse all the non-negative integers
+	intParams := map[string]*int{
+		"limit": &q.page.Limit,
+		"id_gt": &q.page.IdGt,
+		"id_lt": &q.page.IdLt,
+	}
+	for name, dest := range intParams {
+		str_value := params.Get(name)
+		if str_value == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(str_value)
+		if err != nil {
+			return ListQuery{}, fmt.Errorf("%s: %w", name, err)
+		} else if value < 0 {
+			return ListQuery{}, fmt.Errorf("%s can't be negative", name)
+		}
+		*dest = value
+	}
+	q.page.Limit = min(q.page.Limit, maxListLimit)
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.page.Descending = true
+	default:
+		return ListQuery{}, errors.New(`order must be "asc" or "desc"`)
+	}
+
+	isPalindrome, err := ParseIsPalindromeFromQuery(r)
+	if err != nil {
+		return ListQuery{}, err
+	}
+	q.isPalindrome = isPalindrome
+
+	// the cursor narrows the id range to after the last message returned
+	if cursor := params.Get("cursor"); cursor != "" {
+		descending, lastId, err := DecodeListCursor(cursor)
+		if err != nil {
+			return ListQuery{}, err
+		} else if params.Get("order") != "" && descending != q.page.Descending {
+			return ListQuery{}, errors.New("order doesn't match cursor")
+		}
+
+		q.page.Descending = descending
+		if descending && (q.page.IdLt == 0 || lastId < q.page.IdLt) {
+			q.page.IdLt = lastId
+		} else if !descending && lastId > q.page.IdGt {
+			q.page.IdGt = lastId
+		}
+	}
+
+	return q, nil
+}
+
+// ParseIsPalindromeFromQuery extracts the optional "is_palindrome" query
+// parameter, used to filter messages by their palindrome result. It returns
+// P_TRUE for "true", P_FALSE for "false", P_UNKNOWN for "null", nil if there's
+// no "is_palindrome" parameter, and an error for anything else.
+func ParseIsPalindromeFromQuery(r *http.Request) (*int, error) {
+	str_filter := r.URL.Query().Get("is_palindrome")
+	if str_filter == "" {
+		return nil, nil
+	}
+
+	filter, ok := map[string]int{"true": P_TRUE, "false": P_FALSE, "null": P_UNKNOWN}[str_filter]
+	if !ok {
+		return nil, errors.New(`is_palindrome must be "true", "false", or "null"`)
+	}
+
+	return &filter, nil
+}
+
+// ParseSearchFromQuery extracts the search parameters for GET
+// /messages/search: "q" (required, see ParseSearchQuery), "is_palindrome" (see
+// ParseIsPalindromeFromQuery), and "limit" (default and maximum:
+// maxListLimit). It returns an error if any of them are invalid.
+func ParseSearchFromQuery(r *http.Request) (q SearchQuery, isPalindrome *int, limit int, err error) {
+	q, err = ParseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		return SearchQuery{}, nil, 0, err
+	}
+
+	isPalindrome, err = ParseIsPalindromeFromQuery(r)
+	if err != nil {
+		return SearchQuery{}, nil, 0, err
+	}
+
+	limit = maxListLimit
+	if str_limit := r.URL.Query().Get("limit"); str_limit != "" {
+		limit, err = strconv.Atoi(str_limit)
+		if err != nil {
+			return SearchQuery{}, nil, 0, err
+		} else if limit <= 0 {
+			return SearchQuery{}, nil, 0, errors.New("limit must be positive")
+		}
+		limit = min(limit, maxListLimit)
+	}
+
+	return q, isPalindrome, limit, nil
+}
+
+// defaultCacheLimit is how many cached results GET /admin/cache shows by
+// default.
+const defaultCacheLimit = 100
+
+// ParseCacheQuery extracts the parameters for the /admin/cache endpoints:
+// "analyzer" (optional, the name of a single analyzer), and "limit" (how many
+// cached results to show, default defaultCacheLimit, at most maxListLimit, 0
+// for none). It returns an error if limit is invalid.
+func ParseCacheQuery(r *http.Request) (analyzer string, limit int, err error) {
+	analyzer = r.URL.Query().Get("analyzer")
+
+	limit = defaultCacheLimit
+	if str_limit := r.URL.Query().Get("limit"); str_limit != "" {
+		limit, err = strconv.Atoi(str_limit)
+		if err != nil {
+			return "", 0, err
+		} else if limit < 0 {
+			return "", 0, errors.New("limit must not be negative")
+		}
+		limit = min(limit, maxListLimit)
+	}
+
+	return analyzer, limit, nil
+}
+
+// maxBatchSize is the most operations a batch can have.
+const maxBatchSize = 10000
+
+// ParseBoolFromQuery extracts an optional boolean query parameter (like
+// "atomic=true" or "preserve_ids=1"), which is false if it's missing.
+func ParseBoolFromQuery(r *http.Request, name string) (bool, error) {
+	str_value := r.URL.Query().Get(name)
+	if str_value == "" {
+		return false, nil
+	}
+
+	value, err := strconv.ParseBool(str_value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return value, nil
+}
+
+// ParseFormatFromQuery extracts the optional "format" query parameter, used to
+// export and import messages (see export.go). It returns DEFAULT_FORMAT if
+// there's no "format" parameter, and an error if it isn't a format.
+func ParseFormatFromQuery(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		return DEFAULT_FORMAT, nil
+	} else if !IsFormat(format) {
+		return "", errors.New(`format must be "ndjson", "csv", or "json"`)
+	}
+
+	return format, nil
+}
+
+// MessageToExport converts a message and its palindrome result into the format
+// used by exports.
+func MessageToExport(msg Message, result PWResult) ExportMessageData {
+	return ExportMessageData{
+		ID:           msg.id,
+		Text:         msg.text,
+		Profile:      msg.settings.profile,
+		Mode:         msg.settings.mode,
+		Revision:     msg.revision,
+		IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		Status:       PWStatusToString(result.status),
+		CreatedAt:    msg.createdAt,
+		UpdatedAt:    msg.updatedAt,
+	}
+}
+
+// ExportToMessageOp converts an imported message into a MessageOp which
+// creates it. The id is kept if preserveIds is true (and there is one),
+// otherwise the message gets a new one. It returns an error if the id is
+// negative or the message is invalid (see ValidateMessage).
+func ExportToMessageOp(m ExportMessageData, preserveIds bool, limits ValidationLimits) (MessageOp, error) {
+	if m.ID < 0 {
+		return MessageOp{}, errors.New("id can't be negative")
+	}
+
+	settings, err := ValidateMessage(m.Text, m.Profile, m.Mode, limits)
+	if err != nil {
+		return MessageOp{}, err
+	}
+
+	op := MessageOp{op: MESSAGE_OP_CREATE, text: m.Text, settings: settings}
+	if preserveIds {
+		op.id = m.ID
+	}
+	return op, nil
+}
+
+// ParseBatchOperations converts the operations of a batch request into
+// MessageOps. It returns a *ValidationError (saying what's wrong with each
+// operation, with fields like "operations[2].text") if there are more than
+// maxBatchSize of them, an op isn't "create", "update", or "delete", an update
+// or delete is missing its id, an id or revision is negative, or a create or
+// update isn't a valid message (see ValidateMessage).
+func ParseBatchOperations(operations []BatchOperationRequestData, limits ValidationLimits) ([]MessageOp, error) {
+	if len(operations) > maxBatchSize {
+		return nil, &ValidationError{fields: []FieldError{{field: "operations", code: FIELD_TOO_LONG, detail: fmt.Sprintf("a batch can have at most %d operations", maxBatchSize)}}}
+	}
+
+	fields := []FieldError{}
+	invalid := func(i int, field string, code string, detail string) {
+		name := fmt.Sprintf("operations[%d].%s", i, field)
+		fields = append(fields, FieldError{field: name, code: code, detail: fmt.Sprintf("%s %s", name, detail)})
+	}
+
+	ops := make([]MessageOp, 0, len(operations))
+	for i, o := range operations {
+		settings := PSettings{}
+		switch o.Op {
+		case MESSAGE_OP_CREATE, MESSAGE_OP_UPDATE:
+			if o.Op == MESSAGE_OP_CREATE && o.ID < 0 {
+				invalid(i, "id", FIELD_INVALID, "can't be negative")
+			} else if o.Op == MESSAGE_OP_UPDATE && o.ID <= 0 {
+				invalid(i, "id", FIELD_REQUIRED, "is required")
+			}
+
+			// same as a message payload, just with different field names
+			var err error
+			settings, err = ValidateMessage(o.Text, o.Profile, o.Mode, limits)
+			var ve *ValidationError
+			if errors.As(err, &ve) {
+				for _, f := range ve.fields {
+					name := fmt.Sprintf("operations[%d].%s", i, f.field)
+					fields = append(fields, FieldError{field: name, code: f.code, detail: strings.Replace(f.detail, f.field, name, 1)})
+				}
+			}
+		case MESSAGE_OP_DELETE:
+			if o.ID <= 0 {
+				invalid(i, "id", FIELD_REQUIRED, "is required")
+			}
+		default:
+			invalid(i, "op", FIELD_INVALID, `must be "create", "update", or "delete"`)
+		}
+
+		if o.Rev < 0 {
+			invalid(i, "rev", FIELD_INVALID, "can't be negative")
+		}
+
+		ops = append(ops, MessageOp{op: o.Op, id: o.ID, text: o.Text, settings: settings, rev: o.Rev})
+	}
+
+	if err := validationErrorOrNil(fields); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// MessageOpResultToResponse converts the result of a MessageOp into the format
+// sent to clients, with the status code the operation would have had on its
+// own.
+func MessageOpResultToResponse(op MessageOp, result MessageOpResult) BatchResultResponseItem {
+	out := BatchResultResponseItem{Op: op.op}
+
+	if result.err != nil {
+		out.Code = ErrorCodeOf(result.err)
+		out.Status = ERROR_CATALOGUE[out.Code].Status
+		out.Error = result.err.Error()
+		return out
+	}
+
+	switch op.op {
+	case MESSAGE_OP_CREATE:
+		out.Status = http.StatusCreated
+	case MESSAGE_OP_DELETE:
+		out.Status = http.StatusNoContent
+	default:
+		out.Status = http.StatusOK
+	}
+
+	out.ID = result.msg.id
+	if op.op != MESSAGE_OP_DELETE {
+		out.Rev = result.msg.revision
+	}
+	return out
+}
+
+// ProblemTypeToResponse converts an entry in ERROR_CATALOGUE into the format
+// sent to clients.
+func ProblemTypeToResponse(code ErrorCode, pt ProblemType) ProblemTypeResponseData {
+	return ProblemTypeResponseData{
+		Type:        ProblemTypeURI(code),
+		Code:        code,
+		Status:      pt.Status,
+		Title:       pt.Title,
+		Description: pt.Description,
+	}
+}
+
+// APIKeyToResponse converts an APIKey into the format sent to clients.
+func APIKeyToResponse(key APIKey) APIKeyResponseItem {
+	out := APIKeyResponseItem{
+		ID:     key.id,
+		Scopes: key.scopes,
+		Tenant: key.tenant,
+	}
+	if !key.rotatedAt.IsZero() {
+		out.RotatedAt = &key.rotatedAt
+	}
+	return out
+}
+
+// CachedResultToResponse converts a CachedResult into the format sent to
+// clients.
+func CachedResultToResponse(cr CachedResult) CachedResultResponseItem {
+	out := CachedResultResponseItem{
+		Hash:     cr.hash,
+		Status:   PWStatusToString(cr.result.status),
+		StoredAt: cr.storedAt,
+	}
+	if !cr.expires.IsZero() {
+		out.ExpiresAt = &cr.expires
+	}
+	return out
+}
+
+// WorkStateToResponse converts a WorkState into the format sent to clients.
+// Its age is how long before now it was added.
+func WorkStateToResponse(state WorkState, now time.Time) DebugWorkResponseItem {
+	listeners := make([]DebugListenerResponseItem, 0, len(state.listeners))
+	for _, ref := range state.listeners {
+		listeners = append(listeners, DebugListenerResponseItem{Tenant: ref.tenant, ID: ref.id})
+	}
+
+	return DebugWorkResponseItem{
+		Hash:          state.hash,
+		Status:        PWStatusToString(state.result.status),
+		Done:          state.result.done,
+		IsPalindrome:  PStatusToBoolPointer(state.result.isPalindrome),
+		QueuePosition: state.result.queuePosition,
+		Listeners:     listeners,
+		CreatedAt:     state.created,
+		AgeSeconds:    now.Sub(state.created).Seconds(),
+	}
+}
+
+// EncodeListCursor creates an opaque cursor which points just past the message
+// with lastId, in some order.
+func EncodeListCursor(descending bool, lastId int) string {
+	order := "asc"
+	if descending {
+		order = "desc"
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", order, lastId)))
+}
+
+// DecodeListCursor is the reverse of EncodeListCursor. It returns an error if
+// the cursor wasn't created by EncodeListCursor.
+func DecodeListCursor(cursor string) (descending bool, lastId int, err error) {
+	invalid := errors.New("invalid cursor")
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return false, 0, invalid
+	}
+
+	order, str_id, ok := strings.Cut(string(raw), ":")
+	if !ok || (order != "asc" && order != "desc") {
+		return false, 0, invalid
+	}
+
+	lastId, err = strconv.Atoi(str_id)
+	if err != nil || lastId < 0 {
+		return false, 0, invalid
+	}
+
+	return order == "desc", lastId, nil
+}
+
 // BinarySearch performs a binary search on a slice of any type, assuming that
 // it's already sorted. The selector function is used to determine an elements
 // value for the purpose of comparison. So every element E has a an associated
@@ -70,6 +530,218 @@ func BinarySearch[T any](arr []T, selector func(*T) int, target int) int {
 func PWorkKeyFromMsg(msg Message) PWKey {
 	return PWKey{
 		hash:      msg.hash,
+		tenant:    msg.tenant,
 		messageId: msg.id,
 	}
 }
+
+// ref returns a MessageRef to the message.
+func (msg Message) ref() MessageRef {
+	return MessageRef{tenant: msg.tenant, id: msg.id}
+}
+
+// ref returns a MessageRef to the message the work key is for.
+func (key PWKey) ref() MessageRef {
+	return MessageRef{tenant: key.tenant, id: key.messageId}
+}
+
+// CompareMessageRefs orders MessageRefs by tenant, then id (for
+// slices.SortFunc).
+func CompareMessageRefs(a, b MessageRef) int {
+	if c := strings.Compare(a.tenant, b.tenant); c != 0 {
+		return c
+	}
+	return a.id - b.id
+}
+
+// SetRetryAfter sets the Retry-After response header to d, rounded up to a
+// whole number of seconds.
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// MessageToV2 converts a Message, its palindrome result, and the results of
+// every analyzer (see SharedState.messageAnalyses) into the message
+// representation used by the v2 API. The profile and mode come from the
+// message, as the result's settings are empty until its work is done.
+func MessageToV2(msg Message, result PWResult, analyses []AnalyzerResult) MessageResponseDataV2 {
+	settings := msg.settings.withDefaults()
+	return MessageResponseDataV2{
+		ID:           msg.id,
+		Text:         msg.text,
+		Status:       PWStatusToString(result.status),
+		IsPalindrome: PStatusToBoolPointer(result.isPalindrome),
+		Profile:      settings.profile,
+		Mode:         settings.mode,
+		Analysis:     AnalysisToResponse(msg.text, result),
+		Analyses:     AnalysesToResponse(msg, analyses),
+		CreatedAt:    msg.createdAt,
+		UpdatedAt:    msg.updatedAt,
+	}
+}
+
+// WriteEvent writes a single Server-Sent Event, with data encoded as JSON. The
+// id line is left out if id is empty. It doesn't flush.
+func WriteEvent(w http.ResponseWriter, id string, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	if id != "" {
+		fmt.Fprintf(&sb, "id: %s\n", id)
+	}
+	fmt.Fprintf(&sb, "event: %s\ndata: %s\n\n", event, payload)
+
+	_, err = w.Write([]byte(sb.String()))
+	return err
+}
+
+// MessageEventId identifies the state of a message and its palindrome result,
+// for use as a Server-Sent Event id. Two events have the same id if and only if
+// they would have the same data.
+func MessageEventId(msg Message, result PWResult) string {
+	return fmt.Sprintf("%d-%s-%d-%t-%d", msg.id, msg.hash, result.isPalindrome, result.done, result.queuePosition)
+}
+
+// FindRevision returns the index of a revision in a slice of revisions (sorted
+// by rev, like from MessageOrchestrator.Revisions), and whether it was found.
+func FindRevision(revisions []Revision, rev int) (int, bool) {
+	i := BinarySearch(revisions, func(r *Revision) int { return r.rev }, rev)
+	return i, i < len(revisions) && revisions[i].rev == rev
+}
+
+// RevisionToResponse converts a Revision into the format sent to clients.
+func RevisionToResponse(r Revision) RevisionResponseData {
+	return RevisionResponseData{
+		Rev:          r.rev,
+		Text:         r.text,
+		IsPalindrome: PStatusToBoolPointer(r.isPalindrome),
+		Profile:      r.settings.profile,
+		Mode:         r.settings.mode,
+		CreatedAt:    r.createdAt,
+	}
+}
+
+// messageVersion identifies a revision of a message: its revision number and
+// the start of its hash. It's the part of an ETag that If-Match looks at.
+func messageVersion(msg Message) string {
+	return fmt.Sprintf("%d-%s", msg.revision, msg.hash[:min(16, len(msg.hash))])
+}
+
+// MessageETag returns the ETag for a message, like "3-1a2b3c4d5e6f7a8b-2". It's
+// made of the message's revision, the start of its hash, and the status of its
+// palindrome work (so a client doesn't hold on to a pending result just
+// because the text hasn't changed). If there are any analyses, their statuses
+// are added on the end too, like "3-1a2b3c4d5e6f7a8b-2.2.1".
+func MessageETag(msg Message, result PWResult, analyses ...AnalyzerResult) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d", result.status)
+	for _, a := range analyses {
+		fmt.Fprintf(&sb, ".%d", a.result.status)
+	}
+	return fmt.Sprintf(`"%s-%s"`, messageVersion(msg), sb.String())
+}
+
+// ListETag returns the ETag for a page of messages. It's a hash of the ETag of
+// every message on the page, and the next cursor, so it changes if anything on
+// the page does.
+func ListETag(listed []listedMessage, nextCursor string) string {
+	h := sha256.New()
+	for _, lm := range listed {
+		fmt.Fprintf(h, "%d:%s\n", lm.msg.id, MessageETag(lm.msg, lm.result, lm.analyses...))
+	}
+	fmt.Fprintf(h, "%s\n", nextCursor)
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// ETagMatches checks an If-None-Match header against an ETag. The header can be
+// "*" or a comma-separated list of ETags. Weak ETags ("W/...") match their
+// strong counterpart, as If-None-Match uses weak comparison. An empty header
+// never matches.
+func ETagMatches(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IfMatchMessage checks an If-Match header against a message. The header can be
+// "*" (any message matches) or a comma-separated list of ETags (see
+// MessageETag); it matches if any of them are for the message's current
+// revision, whatever the palindrome status was at the time. Weak ETags never
+// match, as If-Match uses strong comparison.
+func IfMatchMessage(header string, msg Message) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	version := messageVersion(msg)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+
+		tag = tag[1 : len(tag)-1]
+		if tag == version || strings.HasPrefix(tag, version+"-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AnalysisToResponse converts the analysis in a result into the format sent to
+// clients, cutting the longest palindrome out of text. It returns nil unless
+// the work is done.
+func AnalysisToResponse(text string, result PWResult) *AnalysisResponseData {
+	if result.status != PW_DONE {
+		return nil
+	}
+
+	a := result.analysis
+	out := &AnalysisResponseData{MaximalPalindromes: a.maximalCount}
+	if a.longestLength > 0 {
+		runes := []rune(text)
+		out.LongestPalindrome = &LongestPalindromeResponseData{
+			Text:   string(runes[min(a.longestStart, len(runes)):min(a.longestEnd, len(runes))]),
+			Start:  a.longestStart,
+			End:    a.longestEnd,
+			Length: a.longestLength,
+		}
+	}
+	if a.near.computed {
+		out.NearPalindrome = &NearPalindromeResponseData{
+			Insertions:     a.near.insertions,
+			Substitutions:  a.near.substitutions,
+			Repaired:       a.near.repaired,
+			Palindromicity: a.near.score,
+		}
+	}
+
+	return out
+}
+
+// AnalysesToResponse converts the results of every analyzer for a message into
+// the format sent to clients, by analyzer name. Results are null unless the
+// work is done.
+func AnalysesToResponse(msg Message, analyses []AnalyzerResult) map[string]AnalyzerResultResponseData {
+	out := make(map[string]AnalyzerResultResponseData, len(analyses))
+	for _, a := range analyses {
+		data := AnalyzerResultResponseData{Status: PWStatusToString(a.result.status)}
+		if a.result.status == PW_DONE {
+			data.Result = a.analyzer.Response(msg, a.result)
+		}
+		out[a.analyzer.Name()] = data
+	}
+	return out
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"net/http/httptest"
 	"slices"
 	"testing"
+	"time"
 )
 
 func TestBinaryInsertionSortCaseOne(t *testing.T) {
@@ -137,3 +140,206 @@ func TestCalculateHash(t *testing.T) {
 		t.Fatalf(`CalculateHash(%v) = %v, want %v`, input, result, expected)
 	}
 }
+
+func TestParseWaitFromQuery(t *testing.T) {
+	cases := map[string]time.Duration{
+		"/messages/1":            0,
+		"/messages/1?wait=10s":   10 * time.Second,
+		"/messages/1?wait=250ms": 250 * time.Millisecond,
+		"/messages/1?wait=1h":    maxWait,
+	}
+
+	for url, expected := range cases {
+		r := httptest.NewRequest("GET", url, nil)
+		wait, err := ParseWaitFromQuery(r)
+		if err != nil {
+			t.Fatalf(`ParseWaitFromQuery(%s) has err %+v, want nil`, url, err)
+		}
+		if wait != expected {
+			t.Fatalf(`ParseWaitFromQuery(%s) = %s, want %s`, url, wait, expected)
+		}
+	}
+}
+
+func TestParseWaitFromQueryInvalid(t *testing.T) {
+	for _, url := range []string{"/messages/1?wait=soon", "/messages/1?wait=-1s"} {
+		r := httptest.NewRequest("GET", url, nil)
+		if _, err := ParseWaitFromQuery(r); err == nil {
+			t.Fatalf(`ParseWaitFromQuery(%s) has no err, it should`, url)
+		}
+	}
+}
+
+func TestListCursorRoundTrip(t *testing.T) {
+	for _, descending := range []bool{false, true} {
+		cursor := EncodeListCursor(descending, 42)
+		d, lastId, err := DecodeListCursor(cursor)
+		if err != nil {
+			t.Fatalf(`DecodeListCursor(%s) has err %+v, want nil`, cursor, err)
+		}
+		if d != descending || lastId != 42 {
+			t.Fatalf(`DecodeListCursor(%s) = %t, %d, want %t, 42`, cursor, d, lastId, descending)
+		}
+	}
+
+	if _, _, err := DecodeListCursor("nonsense"); err == nil {
+		t.Fatalf(`DecodeListCursor("nonsense") has no err, it should`)
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	cursor := EncodeListCursor(true, 10)
+	r := httptest.NewRequest("GET", "/messages?limit=5&is_palindrome=null&id_lt=20&id_gt=2&cursor="+cursor, nil)
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		t.Fatalf(`ParseListQuery(%s) has err %+v, want nil`, r.URL, err)
+	}
+
+	expected := ListOptions{IdGt: 2, IdLt: 10, Limit: 5, Descending: true}
+	if q.page != expected {
+		t.Fatalf(`ParseListQuery(%s) page = %+v, want %+v`, r.URL, q.page, expected)
+	}
+	if q.isPalindrome == nil || *q.isPalindrome != P_UNKNOWN {
+		t.Fatalf(`ParseListQuery(%s) isPalindrome = %v, want P_UNKNOWN`, r.URL, q.isPalindrome)
+	}
+}
+
+func TestParseListQueryInvalid(t *testing.T) {
+	urls := []string{
+		"/messages?limit=-1",
+		"/messages?limit=some",
+		"/messages?order=sideways",
+		"/messages?is_palindrome=maybe",
+		"/messages?order=asc&cursor=" + EncodeListCursor(true, 10),
+	}
+
+	for _, url := range urls {
+		r := httptest.NewRequest("GET", url, nil)
+		if _, err := ParseListQuery(r); err == nil {
+			t.Fatalf(`ParseListQuery(%s) has no err, it should`, url)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := `"2-abc-2"`
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{``, false},
+		{`*`, true},
+		{`"2-abc-2"`, true},
+		{`W/"2-abc-2"`, true},
+		{`"1-abc-2", "2-abc-2"`, true},
+		{`"2-abc-1"`, false},
+	}
+
+	for _, c := range cases {
+		if ETagMatches(c.header, etag) != c.expected {
+			t.Fatalf(`ETagMatches(%s, %s) = %t, want %t`, c.header, etag, !c.expected, c.expected)
+		}
+	}
+}
+
+func TestIfMatchMessage(t *testing.T) {
+	msg := newMessage(1, "racecar", PSettings{})
+	version := messageVersion(msg)
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{`*`, true},
+		{MessageETag(msg, PWResult{status: PW_PENDING}), true},
+		{MessageETag(msg, PWResult{status: PW_DONE}), true},
+		{`"` + version + `"`, true},
+		{`"nope", "` + version + `-2"`, true},
+		{`W/"` + version + `-2"`, false},
+		{`"` + version + `0-2"`, false},
+		{`"2-` + msg.hash[:16] + `-2"`, false},
+	}
+
+	for _, c := range cases {
+		if IfMatchMessage(c.header, msg) != c.expected {
+			t.Fatalf(`IfMatchMessage(%s) = %t, want %t`, c.header, !c.expected, c.expected)
+		}
+	}
+}
+
+func TestAnalysisToResponse(t *testing.T) {
+	text := "¡Éte té!"
+	if data := AnalysisToResponse(text, PWResult{status: PW_RUNNING}); data != nil {
+		t.Fatalf(`AnalysisToResponse() while running = %+v, want nil`, data)
+	}
+
+	result := PWResult{status: PW_DONE, analysis: AnalyzeText(text, PSettings{profile: PROFILE_UNICODE_LOOSE})}
+	data := AnalysisToResponse(text, result)
+	if data == nil || data.LongestPalindrome == nil {
+		t.Fatalf(`AnalysisToResponse() = %+v, want a longest palindrome`, data)
+	}
+	if data.LongestPalindrome.Text != "Éte té" {
+		t.Fatalf(`AnalysisToResponse() longest text = %q, want "Éte té"`, data.LongestPalindrome.Text)
+	}
+	if data.NearPalindrome != nil {
+		t.Fatalf(`AnalysisToResponse() near palindrome = %+v, want nil`, data.NearPalindrome)
+	}
+
+	result.analysis.near, _ = AnalyzeNearness(text, PSettings{profile: PROFILE_UNICODE_LOOSE}, nil)
+	data = AnalysisToResponse(text, result)
+	if data.NearPalindrome == nil || data.NearPalindrome.Insertions != 0 {
+		t.Fatalf(`AnalysisToResponse() near palindrome = %+v, want 0 insertions`, data.NearPalindrome)
+	}
+}
+
+func TestMessageToV2Settings(t *testing.T) {
+	msg := Message{id: 1, text: "racecar", settings: PSettings{profile: PROFILE_ASCII, mode: MODE_WORD}}
+	data := MessageToV2(msg, PWResult{isPalindrome: P_UNKNOWN, status: PW_PENDING}, nil)
+	if data.Profile != PROFILE_ASCII || data.Mode != MODE_WORD {
+		t.Fatalf(`MessageToV2() while pending has profile %q and mode %q, want %q and %q`, data.Profile, data.Mode, PROFILE_ASCII, MODE_WORD)
+	}
+}
+
+func TestParseBatchOperations(t *testing.T) {
+	ops, err := ParseBatchOperations([]BatchOperationRequestData{
+		{Op: "create", Text: "racecar", Mode: "word"},
+		{Op: "update", ID: 1, Text: "level", Rev: 2},
+		{Op: "delete", ID: 2},
+	}, DEFAULT_VALIDATION_LIMITS)
+	if err != nil {
+		t.Fatalf(`ParseBatchOperations() has err %+v, want nil`, err)
+	}
+	if len(ops) != 3 || ops[0].settings.mode != MODE_WORD || ops[1].rev != 2 || ops[2].id != 2 {
+		t.Fatalf(`ParseBatchOperations() = %+v, want create, update, delete`, ops)
+	}
+
+	invalid := [][]BatchOperationRequestData{
+		{{Op: "upsert"}},
+		{{Op: "delete"}},
+		{{Op: "update", ID: 1, Text: "level", Rev: -1}},
+		{{Op: "create", Text: "racecar", Mode: "sentence"}},
+		{{Op: "create"}},
+	}
+	for _, operations := range invalid {
+		if _, err := ParseBatchOperations(operations, DEFAULT_VALIDATION_LIMITS); err == nil {
+			t.Fatalf(`ParseBatchOperations(%+v) has no err, it should`, operations)
+		}
+	}
+
+	// every invalid field is reported, by where it is in the batch
+	_, err = ParseBatchOperations([]BatchOperationRequestData{
+		{Op: "create", Text: "racecar"},
+		{Op: "update", Mode: "sentence"},
+	}, DEFAULT_VALIDATION_LIMITS)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf(`ParseBatchOperations() has err %+v, want *ValidationError`, err)
+	}
+	fields := []string{}
+	for _, f := range ve.fields {
+		fields = append(fields, f.field)
+	}
+	if !slices.Equal(fields, []string{"operations[1].id", "operations[1].text", "operations[1].mode"}) {
+		t.Fatalf(`ParseBatchOperations() invalid fields = %v, want id, text, and mode of operations[1]`, fields)
+	}
+}
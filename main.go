@@ -2,34 +2,470 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // Main sets up routing, shared state, and starts the server. It listens on port
 // 8090 by default, overridden by the PORT environment variable.
+//
+// Palindrome work is done by WORKERS worker goroutines (default: the number of
+// CPUs), with at most QUEUE_DEPTH (default 1000) pieces of work waiting.
+//
+// Messages are kept in-memory by default. If the DATA_DIR environment variable
+// is set, they're persisted to that directory instead, and compacted every
+// COMPACT_INTERVAL seconds (default 60). Every tenant has its own messages: the
+// default tenant's are in DATA_DIR itself, and the rest are in
+// DATA_DIR/tenants/<name>. A tenant can have at most MAX_MESSAGES_PER_TENANT
+// messages (default 0, which means no limit). If TENANTS is set (comma
+// separated), or API_KEYS_FILE is, only those tenants, the tenants of the API
+// keys, and the default tenant can be written to. Otherwise any tenant can,
+// and its messages are created the first time it is, up to MAX_TENANTS
+// tenants (default 100, including the default tenant; 0 means no limit).
+//
+// Every message is run through the palindrome analyzer, as well as every
+// analyzer listed (comma separated) in ANALYZERS (default: all of
+// BUILTIN_ANALYZERS). Each analyzer has its own WORKERS and QUEUE_DEPTH.
+//
+// Finished results are cached (per analyzer) after their messages are gone, up
+// to CACHE_SIZE results (default 10000, 0 turns caching off), for CACHE_TTL
+// seconds (default 3600, 0 means forever).
+//
+// Bodies of requests to create or update a message can be at most
+// MAX_BODY_BYTES (default 1 MiB), batches at most MAX_BATCH_BYTES (default 32
+// MiB), and imports at most MAX_IMPORT_BYTES (default 256 MiB). Message text
+// can be at most MAX_TEXT_BYTES (default 64 KiB) and MAX_TEXT_RUNES characters
+// (default 16384). 0 means no limit.
+//
+// If API_KEYS_FILE is set, every request needs an API key from that file (a
+// JSON config, see auth.go), with the scope its route needs. Otherwise the API
+// is open to anyone.
+//
+// Requests aren't rate limited unless RATE_LIMIT_READ, RATE_LIMIT_WRITE, or
+// RATE_LIMIT_WORK is set: then each client (an API key, or an IP address if
+// there's no key) can make that many reads, writes, or writes which start
+// palindrome work a minute, in bursts of up to that many. Batches and imports
+// count against RATE_LIMIT_WORK once per message they create or update. Unset
+// or 0 means no limit (see ratelimit.go).
+//
+// On SIGINT or SIGTERM the server stops accepting connections, and gives
+// in-flight requests and palindrome work SHUTDOWN_TIMEOUT seconds (default 30)
+// to finish. If SHUTDOWN_WORK is "cancel" (instead of the default, "drain"),
+// work isn't waited for: it's cancelled as soon as the requests are done.
 func main() {
+	tenants, err := newTenants()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tenants.Close()
+
+	po := newPalindromes()
+	analyzers, err := newAnalyzerRegistry(po)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	r := mux.NewRouter()
-	ss := NewSharedState()
+	ss := NewSharedState(tenants, po, analyzers)
+	ss.limits = validationLimits()
+
+	ss.keys, err = newKeyStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := restrictTenants(tenants, ss.keys); err != nil {
+		log.Fatal(err)
+	}
+	ss.limiter = newRateLimiter()
 
-	r.Methods("POST").Path("/messages").HandlerFunc(ss.CreateMessage)
-	r.Methods("GET").Path("/messages").HandlerFunc(ss.GetAllMessages)
-	r.Methods("DELETE").Path("/messages").HandlerFunc(ss.DeleteAllMessages)
-	r.Methods("GET").Path("/messages/{id}").HandlerFunc(ss.GetMessage)
-	r.Methods("PUT").Path("/messages/{id}").HandlerFunc(ss.UpdateMessage) // not PATCH, as we're effectively replacing the whole message
-	r.Methods("DELETE").Path("/messages/{id}").HandlerFunc(ss.DeleteMessage)
+	// count every request, see GET /metrics
+	r.Use(ss.CountRequests)
+	// then check its API key, see auth.go
+	r.Use(ss.Authenticate)
+	// then make sure its client isn't making too many, see ratelimit.go
+	r.Use(ss.RateLimit)
+
+	// errors are always problem details (see problems.go), even if no route
+	// matches
+	r.NotFoundHandler = http.HandlerFunc(ss.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(ss.MethodNotAllowed)
+
+	r.Methods("GET").Path("/healthz").HandlerFunc(ss.GetHealth)
+	r.Methods("GET").Path("/readyz").HandlerFunc(ss.GetReadiness)
+	r.Methods("GET").Path("/debug/state").HandlerFunc(ss.GetDebugState)
+	r.Methods("GET").Path("/metrics").HandlerFunc(ss.GetMetrics)
+	r.Methods("GET").Path("/analyzers").HandlerFunc(ss.GetAnalyzers)
+	r.Methods("GET").Path("/problems").HandlerFunc(ss.GetProblemTypes)
+	r.Methods("GET").Path("/problems/{code}").HandlerFunc(ss.GetProblemType)
+	r.Methods("GET").Path("/admin/cache").HandlerFunc(ss.GetResultCache)
+	r.Methods("DELETE").Path("/admin/cache").HandlerFunc(ss.PurgeResultCache)
+	r.Methods("GET").Path("/admin/keys").HandlerFunc(ss.GetAPIKeys)
+	r.Methods("POST").Path("/admin/keys/{id}/rotate").HandlerFunc(ss.RotateAPIKey)
+	r.Methods("POST").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).CreateMessage))
+	r.Methods("GET").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).GetAllMessages))
+	r.Methods("DELETE").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).DeleteAllMessages))
+	r.Methods("POST").Path("/messages:batch").HandlerFunc(ss.Tenanted((*SharedState).BatchMessages))
+	r.Methods("GET").Path("/messages/search").HandlerFunc(ss.Tenanted((*SharedState).SearchMessages)) // before /messages/{id}, which would also match
+	r.Methods("GET").Path("/messages/export").HandlerFunc(ss.Tenanted((*SharedState).ExportMessages)) // same
+	r.Methods("POST").Path("/messages/import").HandlerFunc(ss.Tenanted((*SharedState).ImportMessages))
+	r.Methods("GET").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).GetMessage))
+	r.Methods("PUT").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).UpdateMessage)) // not PATCH, as we're effectively replacing the whole message
+	r.Methods("DELETE").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).DeleteMessage))
+	r.Methods("GET").Path("/messages/{id}/events").HandlerFunc(ss.Tenanted((*SharedState).StreamMessageEvents))
+	r.Methods("GET").Path("/messages/{id}/revisions").HandlerFunc(ss.Tenanted((*SharedState).GetMessageRevisions))
+	r.Methods("GET").Path("/messages/{id}/revisions/{rev}").HandlerFunc(ss.Tenanted((*SharedState).GetMessageRevision))
+	r.Methods("POST").Path("/messages/{id}/revisions/{rev}/restore").HandlerFunc(ss.Tenanted((*SharedState).RestoreMessageRevision))
+
+	// v2 has the same routes, but a consistent message type with an explicit
+	// status (see network_types.go)
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.Methods("GET").Path("/analyzers").HandlerFunc(ss.GetAnalyzers)
+	v2.Methods("POST").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).CreateMessageV2))
+	v2.Methods("GET").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).GetAllMessagesV2))
+	v2.Methods("DELETE").Path("/messages").HandlerFunc(ss.Tenanted((*SharedState).DeleteAllMessages))
+	v2.Methods("POST").Path("/messages:batch").HandlerFunc(ss.Tenanted((*SharedState).BatchMessages))
+	v2.Methods("GET").Path("/messages/search").HandlerFunc(ss.Tenanted((*SharedState).SearchMessagesV2))
+	v2.Methods("GET").Path("/messages/export").HandlerFunc(ss.Tenanted((*SharedState).ExportMessages))
+	v2.Methods("POST").Path("/messages/import").HandlerFunc(ss.Tenanted((*SharedState).ImportMessages))
+	v2.Methods("GET").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).GetMessageV2))
+	v2.Methods("PUT").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).UpdateMessageV2))
+	v2.Methods("DELETE").Path("/messages/{id}").HandlerFunc(ss.Tenanted((*SharedState).DeleteMessage))
+	v2.Methods("GET").Path("/messages/{id}/revisions").HandlerFunc(ss.Tenanted((*SharedState).GetMessageRevisions))
+	v2.Methods("GET").Path("/messages/{id}/revisions/{rev}").HandlerFunc(ss.Tenanted((*SharedState).GetMessageRevision))
+	v2.Methods("POST").Path("/messages/{id}/revisions/{rev}/restore").HandlerFunc(ss.Tenanted((*SharedState).RestoreMessageRevision))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8090"
 	}
 
+	shutdownTimeout, drainWork := shutdownConfig()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: r,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
 	log.Printf("Listening on port %s\n", port)
 
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), r)
-	log.Fatal(err)
+	// wait for a signal, or for the server to fail on its own
+	select {
+	case err := <-serverErr:
+		// log.Fatal doesn't run deferred functions
+		tenants.Close()
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// a second signal kills us straight away
+	stop()
+
+	log.Printf("Shutting down, waiting up to %s\n", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// stop listening, and let in-flight requests finish (event streams and
+	// waiting requests are told to wrap up)
+	ss.BeginShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Some requests didn't finish: %v\n", err)
+	}
+
+	// then finish (or cancel) the palindrome work
+	if err := analyzers.Shutdown(shutdownCtx, drainWork); err != nil {
+		log.Printf("Some work didn't finish, and was cancelled: %v\n", err)
+	}
+
+	log.Println("Shut down")
+}
+
+// shutdownConfig reads SHUTDOWN_TIMEOUT and SHUTDOWN_WORK from the environment
+// (see main).
+func shutdownConfig() (timeout time.Duration, drainWork bool) {
+	timeout = 30 * time.Second
+	if v, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && v >= 0 {
+		timeout = time.Duration(v) * time.Second
+	}
+
+	drainWork = os.Getenv("SHUTDOWN_WORK") != "cancel"
+
+	return timeout, drainWork
+}
+
+// validationLimits reads MAX_BODY_BYTES, MAX_BATCH_BYTES, MAX_IMPORT_BYTES,
+// MAX_TEXT_BYTES, and MAX_TEXT_RUNES from the environment (see main). Anything
+// missing or invalid is left as DEFAULT_VALIDATION_LIMITS.
+func validationLimits() ValidationLimits {
+	limits := DEFAULT_VALIDATION_LIMITS
+	if v, err := strconv.ParseInt(os.Getenv("MAX_BODY_BYTES"), 10, 64); err == nil && v >= 0 {
+		limits.maxBodyBytes = v
+	}
+	if v, err := strconv.ParseInt(os.Getenv("MAX_BATCH_BYTES"), 10, 64); err == nil && v >= 0 {
+		limits.maxBatchBytes = v
+	}
+	if v, err := strconv.ParseInt(os.Getenv("MAX_IMPORT_BYTES"), 10, 64); err == nil && v >= 0 {
+		limits.maxImportBytes = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAX_TEXT_BYTES")); err == nil && v >= 0 {
+		limits.maxTextBytes = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAX_TEXT_RUNES")); err == nil && v >= 0 {
+		limits.maxTextRunes = v
+	}
+
+	return limits
+}
+
+// newKeyStore loads the API keys in API_KEYS_FILE (see main). It returns nil
+// (and no error) if it isn't set, which leaves the API open.
+func newKeyStore() (*KeyStore, error) {
+	path := os.Getenv("API_KEYS_FILE")
+	if path == "" {
+		log.Println("API_KEYS_FILE isn't set, so the API is open to anyone")
+		return nil, nil
+	}
+
+	ks, err := LoadKeyStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d API keys from %s\n", len(ks.List()), path)
+
+	return ks, nil
+}
+
+// restrictTenants restricts tenants to the ones in TENANTS and the tenants of
+// the keys in ks (see main and Tenants.Restrict). If TENANTS isn't set and ks
+// is nil, any tenant is allowed, up to MAX_TENANTS of them (see
+// Tenants.SetMaxTenants). It returns an error if TENANTS has an invalid name.
+func restrictTenants(tenants *Tenants, ks *KeyStore) error {
+	maxTenants := DEFAULT_MAX_TENANTS
+	if v, err := strconv.Atoi(os.Getenv("MAX_TENANTS")); err == nil && v >= 0 {
+		maxTenants = v
+	}
+	tenants.SetMaxTenants(maxTenants)
+
+	env := os.Getenv("TENANTS")
+	if env == "" && ks == nil {
+		if maxTenants > 0 {
+			log.Printf("TENANTS isn't set, so up to %d tenants can be created by anyone\n", maxTenants)
+		}
+		return nil
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(env, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := ValidateTenantName(name); err != nil {
+			return fmt.Errorf("TENANTS: %w", err)
+		}
+		names = append(names, name)
+	}
+	if ks != nil {
+		for _, key := range ks.List() {
+			names = append(names, key.tenant)
+		}
+	}
+	names = append(names, DEFAULT_TENANT)
+	slices.Sort(names)
+	names = slices.Compact(names)
+	tenants.Restrict(names)
+
+	log.Printf("Only allowing tenants %s\n", strings.Join(names, ", "))
+
+	return nil
+}
+
+// newRateLimiter creates a RateLimiter with the limits in RATE_LIMIT_READ,
+// RATE_LIMIT_WRITE, and RATE_LIMIT_WORK (see main). Anything missing or invalid
+// is 0, no limit. It returns nil if every limit is 0.
+func newRateLimiter() *RateLimiter {
+	limits := make(map[string]int)
+	limited := false
+	for _, class := range RATE_CLASSES {
+		if v, err := strconv.Atoi(os.Getenv("RATE_LIMIT_" + strings.ToUpper(class))); err == nil && v >= 0 {
+			limits[class] = v
+		}
+		limited = limited || limits[class] > 0
+	}
+
+	if !limited {
+		log.Println("No RATE_LIMIT is set, so requests aren't rate limited")
+		return nil
+	}
+	return NewRateLimiter(limits)
+}
+
+// newTenants creates a Tenants whose stores are picked based on the
+// environment: in-memory if DATA_DIR is not set, otherwise file-backed (see
+// main). Every tenant already in DATA_DIR is opened straight away, so they all
+// show up in GET /metrics and GET /debug/state. Tenants.Close should be called
+// on exit.
+//
+// Each store gets the MAX_MESSAGES_PER_TENANT quota. It only holds for a
+// client when its tenant comes from its API key or TENANTS (see
+// restrictTenants): otherwise it can switch to another tenant with the
+// X-Tenant-ID header, and only MAX_TENANTS bounds the total.
+func newTenants() (*Tenants, error) {
+	quota := 0
+	if v, err := strconv.Atoi(os.Getenv("MAX_MESSAGES_PER_TENANT")); err == nil && v >= 0 {
+		quota = v
+	}
+
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		tenants := NewTenants(func(tenant string) (MessageOrchestrator, func(), error) {
+			mo := NewTenantMessages(tenant)
+			mo.SetQuota(quota)
+			return &mo, func() {}, nil
+		})
+		_, err := tenants.Get(DEFAULT_TENANT)
+		return tenants, err
+	}
+
+	compactInterval := 60 * time.Second
+	if v, err := strconv.Atoi(os.Getenv("COMPACT_INTERVAL")); err == nil && v > 0 {
+		compactInterval = time.Duration(v) * time.Second
+	}
+
+	tenants := NewTenants(func(tenant string) (MessageOrchestrator, func(), error) {
+		mo, err := OpenDurableMessages(tenantDataDir(dataDir, tenant), tenant, compactInterval)
+		if err != nil {
+			return nil, nil, err
+		}
+		mo.SetQuota(quota)
+		return mo, func() { mo.Close() }, nil
+	})
+
+	names := []string{DEFAULT_TENANT}
+	entries, err := os.ReadDir(filepath.Join(dataDir, "tenants"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateTenantName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, name := range names {
+		if _, err := tenants.Get(name); err != nil {
+			tenants.Close()
+			return nil, err
+		}
+	}
+
+	log.Printf("Storing messages in %s (%d tenants)\n", dataDir, len(names))
+
+	return tenants, nil
+}
+
+// tenantDataDir returns the directory tenant's messages are stored in, under
+// dataDir (see main).
+func tenantDataDir(dataDir string, tenant string) string {
+	if tenant == DEFAULT_TENANT {
+		return dataDir
+	}
+	return filepath.Join(dataDir, "tenants", tenant)
+}
+
+// newPalindromes creates a Palindromes, configured from the environment (see
+// main).
+func newPalindromes() *Palindromes {
+	return newAnalyzerWork(PalindromeAnalyzer{})
+}
+
+// newAnalyzerRegistry installs the palindrome analyzer (with po doing its
+// work), and every analyzer listed in ANALYZERS (see main). It returns an error
+// if one of them doesn't exist.
+func newAnalyzerRegistry(po *Palindromes) (*AnalyzerRegistry, error) {
+	analyzers := NewAnalyzerRegistry()
+	if err := analyzers.Register(PalindromeAnalyzer{}, po); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	if v, ok := os.LookupEnv("ANALYZERS"); ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range BUILTIN_ANALYZERS {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+
+	for _, name := range names {
+		create, ok := BUILTIN_ANALYZERS[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown analyzer %q in ANALYZERS", name)
+		}
+		analyzer := create()
+		if err := analyzers.Register(analyzer, newAnalyzerWork(analyzer)); err != nil {
+			return nil, err
+		}
+	}
+
+	return analyzers, nil
+}
+
+// newAnalyzerWork creates a Palindromes which runs analyzer, configured from
+// the environment (see main).
+func newAnalyzerWork(analyzer Analyzer) *Palindromes {
+	workers := runtime.NumCPU()
+	if v, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && v > 0 {
+		workers = v
+	}
+
+	queueDepth := 1000
+	if v, err := strconv.Atoi(os.Getenv("QUEUE_DEPTH")); err == nil && v > 0 {
+		queueDepth = v
+	}
+
+	return NewAnalyzerWork(analyzer, workers, queueDepth, newResultCache())
+}
+
+// newResultCache creates a ResultCache, configured from the environment (see
+// main). It returns nil if caching is turned off.
+func newResultCache() *ResultCache {
+	size := 10000
+	if v, err := strconv.Atoi(os.Getenv("CACHE_SIZE")); err == nil && v >= 0 {
+		size = v
+	}
+	if size == 0 {
+		return nil
+	}
+
+	ttl := time.Hour
+	if v, err := strconv.Atoi(os.Getenv("CACHE_TTL")); err == nil && v >= 0 {
+		ttl = time.Duration(v) * time.Second
+	}
+
+	return NewResultCache(size, ttl)
 }
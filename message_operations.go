@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// This file contains SharedState methods which change Messages and Palindromes
+// together, so that they stay in sync. Handlers should use these instead of
+// changing ss.mo and ss.po directly; that way every version of an endpoint
+// behaves the same.
+//
+// Other analyzers (see AnalyzerRegistry) follow along: they're kicked off,
+// swapped, and cancelled with the palindrome work. They don't get a say in
+// whether a message can be created or updated though; if one of their queues
+// is full, their work is kicked off again the next time the message is read
+// (see messageAnalyses).
+
+// ErrMessageNotFound is returned by SharedState operations (and
+// MessageOrchestrator.Apply) when there is no message with the given id.
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrRevisionNotFound is returned by SharedState operations when a message
+// exists, but doesn't have the given revision.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// ErrPreconditionFailed is returned by SharedState operations when an If-Match
+// ETag doesn't match the message (it was changed by someone else).
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// createMessage adds a new message (with the given settings, empty ones get
+// defaults) and kicks off its palindrome work. It returns the message, the
+// current palindrome result, and the message's listener (see
+// WorkOrchestrator.Add). If there's no room to queue the work, the message is
+// deleted again and a *QueueFullError is returned.
+func (ss *SharedState) createMessage(text string, settings PSettings) (Message, PWResult, <-chan PWResult, error) {
+	// create the message
+	msg, err := ss.mo.Add(text, settings)
+	if err != nil {
+		return Message{}, PWResult{}, nil, err
+	}
+
+	// kick off the palindrome work
+	_, result, onChange, err := ss.po.Add(msg)
+	var queueFull *QueueFullError
+	if errors.As(err, &queueFull) {
+		// there's no room to do work for the message, so don't keep it
+		if err := ss.mo.Delete(msg.id); err != nil {
+			log.Println(err)
+		}
+		return Message{}, PWResult{}, nil, err
+	} else if err != nil {
+		return Message{}, PWResult{}, nil, err
+	}
+
+	// kick off every other analyzer
+	ss.analyzers.AddWork(msg, ss.po)
+
+	return msg, result, onChange, nil
+}
+
+// messageResult returns the current palindrome result for a message, and the
+// message's listener (which may be nil).
+func (ss *SharedState) messageResult(msg Message) (PWResult, <-chan PWResult, error) {
+	workKey := PWorkKeyFromMsg(msg)
+	found, result, onChange, err := ss.po.Poll(workKey)
+	if err != nil {
+		return PWResult{}, nil, err
+	} else if !found {
+		// This can happen on Add or Update: adding new work requires a message
+		// id, which doesn't exist until the message is created, so it's
+		// possible for a message to exist with no corresponding palindrome work
+		// (for a brief moment in time).
+		//
+		// It shouldn't happen on Delete or DeleteAll: messages are deleted
+		// before their work. But it's also a possible bug. In any case, there's
+		// no harm in inserting more work (duplicate work is handled / ignored).
+
+		// Kick off more work, so next time we'll have a result. If the queue
+		// is full, we'll try again next time.
+		_, _, onChange, _ = ss.po.Add(msg)
+
+		// The message may have been updated (or deleted) since it was read, and
+		// its old work removed before we added it back. Then nothing would
+		// ever remove it, so check, and do it ourselves.
+		if current, found, err := ss.mo.Get(msg.id); err == nil && (!found || PWorkKeyFromMsg(current) != workKey) {
+			ss.po.Remove(workKey)
+		}
+
+		// Can safely return P_UNKNOWN, even though it could be annoying for the
+		// user.
+		result = PWResult{isPalindrome: P_UNKNOWN, status: PW_PENDING, settings: msg.settings}
+	}
+
+	return result, onChange, nil
+}
+
+// updateMessage replaces the text of an existing message (and any settings
+// which aren't empty, the rest are kept), kicks off palindrome work for the new
+// text, and cancels work for the old text. The palindrome result of the old
+// text is saved with its revision. It returns the updated message, the current
+// palindrome result, and the message's listener. It returns ErrMessageNotFound
+// if there's no such message, or a *QueueFullError if there's no room to queue
+// the new work (in which case the message is left unchanged).
+//
+// If ifMatch isn't empty (it's an If-Match header, see IfMatchMessage), the
+// message is only updated if it matches, otherwise ErrPreconditionFailed is
+// returned. The update is a compare-and-swap on the message's revision, so
+// nothing can change the message in between checking and updating. Without
+// ifMatch, a conflicting update just means trying again.
+func (ss *SharedState) updateMessage(id int, text string, settings PSettings, ifMatch string) (Message, PWResult, <-chan PWResult, error) {
+	for {
+		// verify that we're updating an existing message
+		oldMsg, found, err := ss.mo.Get(id)
+		if err != nil {
+			return Message{}, PWResult{}, nil, err
+		} else if !found {
+			return Message{}, PWResult{}, nil, ErrMessageNotFound
+		} else if ifMatch != "" && !IfMatchMessage(ifMatch, oldMsg) {
+			return Message{}, PWResult{}, nil, ErrPreconditionFailed
+		}
+
+		newMsg, result, onChange, err := ss.swapMessage(oldMsg, text, settings.orCurrent(oldMsg.settings))
+		if errors.Is(err, ErrRevisionMismatch) {
+			if ifMatch != "" {
+				return Message{}, PWResult{}, nil, ErrPreconditionFailed
+			}
+			// someone else updated the message first, go again on top of
+			// their update
+			continue
+		}
+
+		return newMsg, result, onChange, err
+	}
+}
+
+// swapMessage does the work for updateMessage, once oldMsg has been checked. It
+// returns ErrRevisionMismatch if oldMsg isn't the current revision anymore.
+func (ss *SharedState) swapMessage(oldMsg Message, text string, settings PSettings) (Message, PWResult, <-chan PWResult, error) {
+	id := oldMsg.id
+
+	// Kick off palindrome work for the new message before saving it, so we
+	// can bail out without changing anything if the work queue is full. The
+	// hash is calculated the same way Update will calculate it.
+	next := newMessage(id, text, settings)
+	next.tenant = oldMsg.tenant
+	newWorkKey, result, onChange, err := ss.po.Add(next)
+	if err != nil {
+		return Message{}, PWResult{}, nil, err
+	}
+
+	// update the message, unless someone else got there first
+	oldWorkKey := PWorkKeyFromMsg(oldMsg)
+	newMsg, err := ss.mo.CompareAndUpdate(id, text, settings, oldMsg.revision)
+	if err != nil {
+		// cancel the new work, unless it's the same as the old work, or the
+		// message already has this text (from someone else's update)
+		current, found, _ := ss.mo.Get(id)
+		if newWorkKey != oldWorkKey && (!found || PWorkKeyFromMsg(current) != newWorkKey) {
+			ss.po.Remove(newWorkKey)
+		}
+		return Message{}, PWResult{}, nil, err
+	}
+
+	// remember the palindrome result of the old revision, before its work is
+	// gone (the update already happened, so don't fail over this)
+	if found, oldResult, _, err := ss.po.Poll(oldWorkKey); err == nil && found && oldResult.done {
+		if err := ss.mo.SetRevisionResult(id, oldMsg.revision, oldResult.isPalindrome); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// swap out the work of every other analyzer too
+	ss.analyzers.AddWork(newMsg, ss.po)
+	if newWorkKey != oldWorkKey {
+		ss.analyzers.RemoveWork(oldWorkKey, ss.po)
+	}
+
+	// cancel palindrome work for the old message (unless the text didn't
+	// change, in which case it's the same work)
+	if newWorkKey != oldWorkKey {
+		if err := ss.po.Remove(oldWorkKey); err != nil {
+			return Message{}, PWResult{}, nil, err
+		}
+	}
+
+	return newMsg, result, onChange, nil
+}
+
+// deleteMessage removes a message and cancels its palindrome work. It returns
+// ErrMessageNotFound if there's no such message. Like updateMessage, if
+// ifMatch isn't empty the message is only deleted if it matches, otherwise
+// ErrPreconditionFailed is returned.
+func (ss *SharedState) deleteMessage(id int, ifMatch string) error {
+	for {
+		// verify that the message exists
+		msg, found, err := ss.mo.Get(id)
+		if err != nil {
+			return err
+		} else if !found {
+			return ErrMessageNotFound
+		} else if ifMatch != "" && !IfMatchMessage(ifMatch, msg) {
+			return ErrPreconditionFailed
+		}
+
+		// delete the message, unless someone else changed it first
+		err = ss.mo.CompareAndDelete(id, msg.revision)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if ifMatch != "" {
+				return ErrPreconditionFailed
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// cancel the corresponding work, of every analyzer
+		ss.analyzers.RemoveWork(PWorkKeyFromMsg(msg), ss.po)
+		return ss.po.Remove(PWorkKeyFromMsg(msg))
+	}
+}
+
+// applyBatch runs a batch of operations on the messages (see
+// MessageOrchestrator.Apply), then starts and cancels work to match, for every
+// analyzer. Unlike createMessage and updateMessage, a full work queue doesn't
+// stop an operation (a batch can easily be bigger than the queue): the message
+// is still changed, and its work is started the first time it's read, like
+// after a restart.
+func (ss *SharedState) applyBatch(ops []MessageOp, atomic bool) ([]MessageOpResult, error) {
+	results, err := ss.mo.Apply(ops, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	startWork := func(msg Message) {
+		ss.po.Add(msg)
+		ss.analyzers.AddWork(msg, ss.po)
+	}
+	stopWork := func(key PWKey) {
+		ss.analyzers.RemoveWork(key, ss.po)
+		ss.po.Remove(key)
+	}
+
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+
+		switch ops[i].op {
+		case MESSAGE_OP_CREATE:
+			startWork(r.msg)
+		case MESSAGE_OP_UPDATE:
+			// remember the palindrome result of the old revision, before its
+			// work is gone (like swapMessage)
+			oldWorkKey := PWorkKeyFromMsg(r.old)
+			if found, oldResult, _, err := ss.po.Poll(oldWorkKey); err == nil && found && oldResult.done {
+				if err := ss.mo.SetRevisionResult(r.old.id, r.old.revision, oldResult.isPalindrome); err != nil {
+					log.Println(err)
+				}
+			}
+
+			startWork(r.msg)
+			if PWorkKeyFromMsg(r.msg) != oldWorkKey {
+				stopWork(oldWorkKey)
+			}
+		case MESSAGE_OP_DELETE:
+			stopWork(PWorkKeyFromMsg(r.msg))
+		}
+	}
+
+	return results, nil
+}
+
+// deleteAllMessages removes every message (of ss's tenant) and cancels their
+// work, of every analyzer. Work shared with other tenants' messages carries on.
+func (ss *SharedState) deleteAllMessages() error {
+	deleted, err := ss.mo.DeleteAll()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range deleted {
+		ss.analyzers.RemoveWork(PWorkKeyFromMsg(msg), ss.po)
+		ss.po.Remove(PWorkKeyFromMsg(msg))
+	}
+
+	return nil
+}
+
+// messageAnalyses returns the result of every installed analyzer for a
+// message, in the order they were registered. result is the message's current
+// palindrome result (see messageResult). Like messageResult, if an analyzer has
+// no work for the message, it's kicked off.
+func (ss *SharedState) messageAnalyses(msg Message, result PWResult) ([]AnalyzerResult, error) {
+	return ss.analyzers.Results(msg, ss.po, result)
+}
+
+// messageETag returns the ETag for a message (see MessageETag), including the
+// status of every analyzer.
+func (ss *SharedState) messageETag(msg Message, result PWResult) string {
+	analyses, err := ss.messageAnalyses(msg, result)
+	if err != nil {
+		// the ETag will change once the error goes away, that's fine
+		log.Println(err)
+	}
+	return MessageETag(msg, result, analyses...)
+}
+
+// awaitResult blocks until the palindrome work for key is done, wait has
+// passed, or ctx is cancelled, whichever comes first. It returns the latest
+// known result (which may not be done). onChange is the message's listener,
+// from Add or Poll; it can be nil.
+//
+// The listener is shared by everything watching the message, so something else
+// might read an update first. To not miss it, the result is also re-polled
+// every waitPollInterval. If the listener is closed (the message was updated or
+// deleted), or the server starts shutting down, it stops waiting straight away.
+func (ss *SharedState) awaitResult(ctx context.Context, key PWKey, current PWResult, onChange <-chan PWResult, wait time.Duration) PWResult {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for !current.done {
+		select {
+		case result, ok := <-onChange:
+			if !ok {
+				return current
+			}
+			current = result
+		case <-ticker.C:
+			if found, result, _, err := ss.po.Poll(key); err == nil && found {
+				current = result
+			}
+		case <-timeout.C:
+			return current
+		case <-ctx.Done():
+			return current
+		case <-ss.shuttingDown:
+			return current
+		}
+	}
+
+	return current
+}
+
+// listedMessage is a message along with its current palindrome result, and the
+// results of every analyzer.
+type listedMessage struct {
+	msg      Message
+	result   PWResult
+	analyses []AnalyzerResult
+	// how well the message matched a search, only set by searchMessages
+	score int
+}
+
+// listBatchSize is how many messages listMessages asks for at once when it's
+// filtering, and so can't know exactly how many it needs.
+const listBatchSize = 100
+
+// listMessages returns a page of messages (along with their palindrome
+// results), as described by q. If the page is full and there may be more
+// messages after it, it also returns a cursor for the next page (see
+// EncodeListCursor), otherwise the cursor is empty.
+//
+// Filtering by palindrome result happens after messages are fetched, so it may
+// take a few batches to fill a page.
+func (ss *SharedState) listMessages(q ListQuery) ([]listedMessage, string, error) {
+	out := []listedMessage{}
+	page := q.page
+
+	for {
+		// fetch the next batch
+		batch := page
+		if q.page.Limit > 0 {
+			batch.Limit = q.page.Limit - len(out)
+			if q.isPalindrome != nil {
+				batch.Limit = max(batch.Limit, listBatchSize)
+			}
+		}
+
+		messages, err := ss.mo.List(batch)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, m := range messages {
+			result, _, err := ss.messageResult(m)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if q.isPalindrome != nil && result.isPalindrome != *q.isPalindrome {
+				continue
+			}
+
+			analyses, err := ss.messageAnalyses(m, result)
+			if err != nil {
+				return nil, "", err
+			}
+
+			out = append(out, listedMessage{msg: m, result: result, analyses: analyses})
+			if q.page.Limit > 0 && len(out) == q.page.Limit {
+				cursor, err := ss.nextListCursor(page, m.id)
+				return out, cursor, err
+			}
+		}
+
+		// we've seen every message
+		if batch.Limit == 0 || len(messages) < batch.Limit {
+			return out, "", nil
+		}
+
+		// move past this batch
+		if page.Descending {
+			page.IdLt = messages[len(messages)-1].id
+		} else {
+			page.IdGt = messages[len(messages)-1].id
+		}
+	}
+}
+
+// nextListCursor returns a cursor pointing after lastId, if there are any more
+// messages on the other side of it (within page's bounds). Otherwise it returns
+// an empty string.
+func (ss *SharedState) nextListCursor(page ListOptions, lastId int) (string, error) {
+	if page.Descending {
+		page.IdLt = lastId
+	} else {
+		page.IdGt = lastId
+	}
+	page.Limit = 1
+
+	more, err := ss.mo.List(page)
+	if err != nil {
+		return "", err
+	} else if len(more) == 0 {
+		return "", nil
+	}
+
+	return EncodeListCursor(page.Descending, lastId), nil
+}
+
+// searchMessages returns up to limit messages which match a search query
+// (along with their palindrome results), best match first. If isPalindrome is
+// not nil, only messages with that palindrome result are included.
+func (ss *SharedState) searchMessages(q SearchQuery, isPalindrome *int, limit int) ([]listedMessage, error) {
+	hits, err := ss.mo.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []listedMessage{}
+	for _, hit := range hits {
+		result, _, err := ss.messageResult(hit.msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if isPalindrome != nil && result.isPalindrome != *isPalindrome {
+			continue
+		}
+
+		analyses, err := ss.messageAnalyses(hit.msg, result)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, listedMessage{msg: hit.msg, result: result, analyses: analyses, score: hit.score})
+		if len(out) == limit {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// messageRevisions returns every revision of a message, oldest first. The
+// current revision has the message's current palindrome result. It returns
+// ErrMessageNotFound if there's no such message.
+func (ss *SharedState) messageRevisions(id int) ([]Revision, error) {
+	msg, found, err := ss.mo.Get(id)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, ErrMessageNotFound
+	}
+
+	revisions, found, err := ss.mo.Revisions(id)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		// deleted in the meantime
+		return nil, ErrMessageNotFound
+	}
+
+	// the current revision doesn't have a saved result yet
+	result, _, err := ss.messageResult(msg)
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := FindRevision(revisions, msg.revision); ok {
+		revisions[i].isPalindrome = result.isPalindrome
+	}
+
+	return revisions, nil
+}
+
+// messageRevision returns a single revision of a message, like
+// messageRevisions. It returns ErrMessageNotFound if there's no such message,
+// or ErrRevisionNotFound if the message doesn't have that revision.
+func (ss *SharedState) messageRevision(id int, rev int) (Revision, error) {
+	revisions, err := ss.messageRevisions(id)
+	if err != nil {
+		return Revision{}, err
+	}
+
+	i, ok := FindRevision(revisions, rev)
+	if !ok {
+		return Revision{}, ErrRevisionNotFound
+	}
+
+	return revisions[i], nil
+}
+
+// restoreRevision updates a message back to the text (and settings) of one of
+// its revisions. It goes through updateMessage (ifMatch included), so it kicks
+// off palindrome work and creates a new revision (history is never rewritten).
+// It returns the same things and errors as updateMessage, as well as
+// ErrRevisionNotFound if the message doesn't have that revision.
+func (ss *SharedState) restoreRevision(id int, rev int, ifMatch string) (Message, PWResult, <-chan PWResult, error) {
+	revisions, found, err := ss.mo.Revisions(id)
+	if err != nil {
+		return Message{}, PWResult{}, nil, err
+	} else if !found {
+		return Message{}, PWResult{}, nil, ErrMessageNotFound
+	}
+
+	i, ok := FindRevision(revisions, rev)
+	if !ok {
+		return Message{}, PWResult{}, nil, ErrRevisionNotFound
+	}
+
+	return ss.updateMessage(id, revisions[i].text, revisions[i].settings, ifMatch)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestMessageResultStale(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+	po := NewPalindromes(1, 10)
+	defer po.Clear()
+	mo := NewMessages()
+	ss := SharedState{mo: &mo, po: po}
+
+	// the message is updated after it's read, and its old work is gone
+	stale, _ := mo.Add("hello", PSettings{})
+	mo.Update(stale.id, "racecar", PSettings{})
+
+	ss.messageResult(stale)
+	if stats := po.WorkStats(); stats.listeners != 0 {
+		t.Fatalf(`po.WorkStats() after ss.messageResult(stale) = %+v, want no listeners`, stats)
+	}
+}
@@ -2,37 +2,90 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Messages implements MessageOrchestrator. It stores messages in-memory (is not
 // persistent). It is safe for concurrent use. The first message added will be
 // assigned an id of 1, then 2, then 3, etc. Ids are not reused.
+//
+// Messages are kept in a map, alongside a sorted slice of every id in the map,
+// so they can be listed in order (a page at a time) without sorting. The words
+// in every message are kept in a search index. Every revision of every message
+// is kept until the message is deleted.
+//
+// Every message belongs to the same tenant (see Tenants): each tenant has its
+// own Messages, and so its own ids. It can be given a quota (see SetQuota).
 type Messages struct {
-	messages sync.Map
-	nextId   atomic.Uint64
+	lock     sync.RWMutex
+	tenant   string
+	messages map[int]Message
+	// the most messages there can be, 0 means no limit
+	quota int
+	// every key of messages, in ascending order
+	ids []int
+	// key: message id, value: every revision of the message, oldest first
+	revisions map[int][]Revision
+	index     searchIndex
+	nextId    atomic.Uint64
 }
 
-// NewMessages creates a new Messages struct with no messages.
+// NewMessages creates a new Messages struct with no messages, for the default
+// tenant.
 func NewMessages() Messages {
+	return NewTenantMessages(DEFAULT_TENANT)
+}
+
+// NewTenantMessages creates a new Messages struct with no messages, for tenant.
+func NewTenantMessages(tenant string) Messages {
 	return Messages{
-		messages: sync.Map{},
-		nextId:   atomic.Uint64{},
+		lock:      sync.RWMutex{},
+		tenant:    tenant,
+		messages:  make(map[int]Message),
+		ids:       []int{},
+		revisions: make(map[int][]Revision),
+		index:     newSearchIndex(),
+		nextId:    atomic.Uint64{},
 	}
 }
 
-// Add takes in some text and returns a Message, with a unique id and the hash
-// of that text. This particular implementation will never throw an error. Once
-// a message is added, it's immediately available for retrieval / deletion.
-func (m *Messages) Add(text string) (Message, error) {
-	msg := Message{
-		id:   int(m.nextId.Add(1)),
-		hash: CalculateHash(text),
-		text: text,
+// SetQuota sets the most messages there can be (0 means no limit). Adding a
+// message past it fails with ErrQuotaExceeded. Messages which are already
+// stored are kept, even if there are more than the quota.
+func (m *Messages) SetQuota(quota int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.quota = quota
+}
+
+// checkQuota returns ErrQuotaExceeded if there's no room for another message,
+// when there are count of them. Must be called with m.lock held (for reading,
+// at least).
+func (m *Messages) checkQuota(count int) error {
+	if m.quota > 0 && count >= m.quota {
+		return fmt.Errorf("%w: tenant %q can have at most %d messages", ErrQuotaExceeded, m.tenant, m.quota)
 	}
+	return nil
+}
 
-	m.messages.Store(msg.id, msg)
+// Add takes in some text and settings and returns a Message, with a unique id
+// and the hash of that text (and settings). It returns ErrQuotaExceeded if
+// there are already as many messages as the quota allows (see SetQuota),
+// otherwise it never throws an error. Once a message is added, it's
+// immediately available for retrieval / deletion.
+func (m *Messages) Add(text string, settings PSettings) (Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.checkQuota(len(m.messages)); err != nil {
+		return Message{}, err
+	}
+	msg := m.newMessage(m.allocateId(), text, settings)
+	m.store(msg)
 
 	return msg, nil
 }
@@ -40,57 +93,426 @@ func (m *Messages) Add(text string) (Message, error) {
 // Get returns a Message by id. This particular implementation will never throw
 // an error, but it will return false if the message doesn't exist.
 func (m *Messages) Get(id int) (Message, bool, error) {
-	if msg, ok := m.messages.Load(id); !ok {
-		return Message{}, false, nil
-	} else {
-		return msg.(Message), true, nil
-	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	msg, ok := m.messages[id]
+	return msg, ok, nil
 }
 
-// Update takes in a Message id and some text. It will completely replace the 
-// corresponding Message's text and update it's hash if the Message exists. If 
-// not, it will throw and error.
-func (m *Messages) Update(id int, text string) (Message, error) {
-	msg := Message{
-		id:   id,
-		hash: CalculateHash(text),
-		text: text,
+// Update takes in a Message id, some text, and settings. It will completely
+// replace the corresponding Message's text and settings and update it's hash
+// (and updatedAt) if the Message exists. If not, it will throw
+// ErrMessageNotFound. The old text is kept as a revision, even if the new text
+// is the same.
+func (m *Messages) Update(id int, text string, settings PSettings) (Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return Message{}, ErrMessageNotFound
 	}
 
-	_, ok := m.messages.Swap(id, msg)
+	return m.update(old, text, settings), nil
+}
+
+// CompareAndUpdate is like Update, but only if the Message is still at
+// revision rev, otherwise it will throw ErrRevisionMismatch (or
+// ErrMessageNotFound, if it doesn't exist anymore). The check and the
+// update happen under the same lock, so nothing can sneak in between.
+func (m *Messages) CompareAndUpdate(id int, text string, settings PSettings, rev int) (Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, ok := m.messages[id]
 	if !ok {
-		// check if item exists, if not, then return false
-		m.messages.Delete(id)
-		return Message{}, errors.New("Nothing to update")
+		return Message{}, ErrMessageNotFound
+	} else if old.revision != rev {
+		return Message{}, ErrRevisionMismatch
 	}
 
-	return msg, nil
+	return m.update(old, text, settings), nil
+}
+
+// update replaces the text and settings of old, as the next revision, and
+// stores it. Must be called with m.lock held.
+func (m *Messages) update(old Message, text string, settings PSettings) Message {
+	msg := m.newMessage(old.id, text, settings)
+	msg.createdAt = old.createdAt
+	msg.revision = old.revision + 1
+	m.store(msg)
+
+	return msg
 }
 
 // Delete removes a Message by id. This particular implementation will never
 // throw an error. There is no way to tell if the message existed or not.
 func (m *Messages) Delete(id int) error {
-	m.messages.LoadAndDelete(id)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.remove(id)
+
+	return nil
+}
+
+// CompareAndDelete is like Delete, but only if the Message is still at revision
+// rev. If it isn't, or the message doesn't exist, it will throw
+// ErrRevisionMismatch.
+func (m *Messages) CompareAndDelete(id int, rev int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if msg, ok := m.messages[id]; !ok || msg.revision != rev {
+		return ErrRevisionMismatch
+	}
+	m.remove(id)
+
 	return nil
 }
 
-// GetAll returns all messages in the system. This particular implementation
-// will never throw an error. Due to the limitations of the sync.Map type, the
-// messages are not guaranteed to be in any particular order nor do they
-// represent a single snapshot at one point in time.
+// remove deletes a Message (and its revisions) by id, if it exists. Must be
+// called with m.lock held.
+func (m *Messages) remove(id int) {
+	msg, ok := m.messages[id]
+	if !ok {
+		return
+	}
+
+	m.index.remove(id, msg.text)
+	delete(m.messages, id)
+	delete(m.revisions, id)
+	i := BinarySearch(m.ids, func(id *int) int { return *id }, id)
+	m.ids = slices.Delete(m.ids, i, i+1)
+}
+
+// GetAll returns all messages in the system, sorted by id in ascending order.
+// This particular implementation will never throw an error.
 func (m *Messages) GetAll() ([]Message, error) {
+	return m.List(ListOptions{})
+}
+
+// Stats returns how many messages and revisions there are, and the last id
+// handed out (see MessageStats). This particular implementation will never
+// throw an error.
+func (m *Messages) Stats() (MessageStats, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	stats := MessageStats{
+		messages: len(m.messages),
+		nextId:   int(m.nextId.Load()),
+	}
+	for _, revisions := range m.revisions {
+		stats.revisions += len(revisions)
+	}
+
+	return stats, nil
+}
+
+// List returns a page of messages, as described by opts (see ListOptions). It
+// only looks at messages on the page (and does a binary search to find the
+// first one), not every message. This particular implementation will never
+// throw an error.
+func (m *Messages) List(opts ListOptions) ([]Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	out := []Message{}
-	m.messages.Range(func(key, value any) bool {
-		out = append(out, value.(Message))
-		return true
+	if opts.Descending {
+		// start just below IdLt, or at the end
+		i := len(m.ids) - 1
+		if opts.IdLt > 0 {
+			i = BinarySearch(m.ids, func(id *int) int { return *id }, opts.IdLt) - 1
+		}
+		for ; i >= 0 && m.ids[i] > opts.IdGt; i-- {
+			if opts.Limit > 0 && len(out) >= opts.Limit {
+				break
+			}
+			out = append(out, m.messages[m.ids[i]])
+		}
+	} else {
+		// start just above IdGt
+		i := BinarySearch(m.ids, func(id *int) int { return *id }, opts.IdGt+1)
+		for ; i < len(m.ids) && (opts.IdLt <= 0 || m.ids[i] < opts.IdLt); i++ {
+			if opts.Limit > 0 && len(out) >= opts.Limit {
+				break
+			}
+			out = append(out, m.messages[m.ids[i]])
+		}
+	}
+
+	return out, nil
+}
+
+// DeleteAll removes all messages from the system, and returns them (sorted by
+// id in ascending order). This particular implementation will never throw an
+// error.
+func (m *Messages) DeleteAll() ([]Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	deleted := make([]Message, 0, len(m.ids))
+	for _, id := range m.ids {
+		deleted = append(deleted, m.messages[id])
+	}
+
+	m.messages = make(map[int]Message)
+	m.ids = []int{}
+	m.revisions = make(map[int][]Revision)
+	m.index = newSearchIndex()
+
+	return deleted, nil
+}
+
+// Search returns every message which matches the query, best match first (ties
+// are broken by id, ascending). This particular implementation will never
+// throw an error.
+func (m *Messages) Search(q SearchQuery) ([]SearchHit, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	scores := m.index.search(q, func(id int) string { return m.messages[id].text })
+
+	out := make([]SearchHit, 0, len(scores))
+	for id, score := range scores {
+		out = append(out, SearchHit{msg: m.messages[id], score: score})
+	}
+	slices.SortFunc(out, func(a, b SearchHit) int {
+		if a.score != b.score {
+			return b.score - a.score
+		}
+		return a.msg.id - b.msg.id
 	})
 
 	return out, nil
 }
 
-// DeleteAll removes all messages from the system. This particular
-// implementation will never throw an error.
-func (m *Messages) DeleteAll() error {
-	m.messages.Clear()
+// Revisions returns every revision of a message, oldest first. The last one is
+// the current revision. It returns false if the message doesn't exist. This
+// particular implementation will never throw an error.
+func (m *Messages) Revisions(id int) ([]Revision, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	revisions, ok := m.revisions[id]
+	return slices.Clone(revisions), ok, nil
+}
+
+// SetRevisionResult records the palindrome result of a revision. It will throw
+// an error if the revision doesn't exist.
+func (m *Messages) SetRevisionResult(id int, rev int, isPalindrome int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	revisions := m.revisions[id]
+	i, ok := FindRevision(revisions, rev)
+	if !ok {
+		return errors.New("No such revision")
+	}
+	revisions[i].isPalindrome = isPalindrome
+
 	return nil
 }
+
+// Apply runs a batch of operations in order (see MessageOp), under a single
+// lock. An operation fails if its message doesn't exist (or was deleted by an
+// earlier operation), or isn't at the expected revision, or if a create's id
+// is already taken, or would go over the quota (counting the operations before
+// it); the rest still go ahead, unless atomic is true, in which case nothing is
+// applied. This particular implementation will never throw an error.
+func (m *Messages) Apply(ops []MessageOp, atomic bool) ([]MessageOpResult, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	results := m.plan(ops, atomic)
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+		if ops[i].op == MESSAGE_OP_DELETE {
+			m.remove(r.msg.id)
+		} else {
+			m.store(r.msg)
+		}
+	}
+
+	return results, nil
+}
+
+// plan works out what applying a batch of operations would do, without
+// changing anything (except using up ids for created messages, if they're
+// going to be stored), see Apply. Must be called with m.lock held (for
+// reading, at least).
+func (m *Messages) plan(ops []MessageOp, atomic bool) []MessageOpResult {
+	results := make([]MessageOpResult, len(ops))
+	// messages changed by earlier operations in the batch, nil if deleted
+	changed := make(map[int]*Message)
+	current := func(id int) (Message, bool) {
+		if msg, ok := changed[id]; ok {
+			if msg == nil {
+				return Message{}, false
+			}
+			return *msg, true
+		}
+		msg, ok := m.messages[id]
+		return msg, ok
+	}
+
+	// how many messages there'll be, after the operations so far
+	count := len(m.messages)
+
+	failed := false
+	for i, op := range ops {
+		old, ok := current(op.id)
+		if op.op == MESSAGE_OP_CREATE {
+			// a new id is handed out later, once we know it'll be stored
+			results[i].msg = m.newMessage(op.id, op.text, op.settings)
+			if op.id != 0 && ok {
+				results[i].err = ErrMessageExists
+			} else if err := m.checkQuota(count); err != nil {
+				results[i].err = err
+			} else {
+				count++
+				if op.id != 0 {
+					changed[op.id] = &results[i].msg
+				}
+			}
+		} else if !ok {
+			results[i].err = ErrMessageNotFound
+		} else if op.rev != 0 && old.revision != op.rev {
+			results[i].err = ErrRevisionMismatch
+		} else if op.op == MESSAGE_OP_UPDATE {
+			msg := m.newMessage(old.id, op.text, op.settings.orCurrent(old.settings))
+			msg.createdAt = old.createdAt
+			msg.revision = old.revision + 1
+			results[i] = MessageOpResult{msg: msg, old: old}
+			changed[op.id] = &msg
+		} else if op.op == MESSAGE_OP_DELETE {
+			results[i].msg = old
+			changed[op.id] = nil
+			count--
+		} else {
+			results[i].err = fmt.Errorf("unknown operation %q", op.op)
+		}
+		failed = failed || results[i].err != nil
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i].err == nil {
+				results[i] = MessageOpResult{err: ErrBatchAborted}
+			}
+		}
+		return results
+	}
+
+	// make sure explicit ids are never handed out, before handing any out
+	for i := range results {
+		if ops[i].op == MESSAGE_OP_CREATE && results[i].err == nil && ops[i].id != 0 {
+			m.bumpNextId(ops[i].id)
+		}
+	}
+	for i := range results {
+		if ops[i].op == MESSAGE_OP_CREATE && results[i].err == nil && ops[i].id == 0 {
+			results[i].msg.id = m.allocateId()
+		}
+	}
+
+	return results
+}
+
+// store saves a message, overwriting any message with the same id, and keeps
+// ids sorted and the search index up to date. If the message has a newer
+// revision than what's stored, the revision is added to the message's history
+// (storing the same revision twice is harmless). Must be called with m.lock
+// held.
+func (m *Messages) store(msg Message) {
+	if old, ok := m.messages[msg.id]; ok {
+		m.index.remove(old.id, old.text)
+	} else {
+		i := BinarySearch(m.ids, func(id *int) int { return *id }, msg.id)
+		m.ids = slices.Insert(m.ids, i, msg.id)
+	}
+	m.messages[msg.id] = msg
+	m.index.add(msg.id, msg.text)
+
+	revisions := m.revisions[msg.id]
+	if len(revisions) == 0 || revisions[len(revisions)-1].rev < msg.revision {
+		m.revisions[msg.id] = append(revisions, Revision{
+			rev:          msg.revision,
+			text:         msg.text,
+			settings:     msg.settings,
+			hash:         msg.hash,
+			createdAt:    msg.updatedAt,
+			isPalindrome: P_UNKNOWN,
+		})
+	}
+}
+
+// newMessage builds a Message from an id, some text, and settings (empty
+// settings are filled in with defaults), calculating the hash. It's the first
+// revision, and both createdAt and updatedAt are set to the current time. It
+// doesn't store anything.
+func newMessage(id int, text string, settings PSettings) Message {
+	now := time.Now().UTC()
+	settings = settings.withDefaults()
+	return Message{
+		id:        id,
+		hash:      MessageHash(text, settings),
+		text:      text,
+		settings:  settings,
+		revision:  1,
+		createdAt: now,
+		updatedAt: now,
+	}
+}
+
+// newMessage is like the newMessage function, but the message belongs to m's
+// tenant.
+func (m *Messages) newMessage(id int, text string, settings PSettings) Message {
+	msg := newMessage(id, text, settings)
+	msg.tenant = m.tenant
+	return msg
+}
+
+// allocateId reserves and returns the next message id. Ids are never handed
+// out twice, even if the caller doesn't end up storing a message with it.
+func (m *Messages) allocateId() int {
+	return int(m.nextId.Add(1))
+}
+
+// put stores a fully-formed Message as-is (overwriting any message with the
+// same id, and moving it to m's tenant) and makes sure nextId will never hand
+// out msg.id again. It's used when restoring messages from somewhere else,
+// like a log on disk.
+func (m *Messages) put(msg Message) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	msg.tenant = m.tenant
+	m.store(msg)
+	m.bumpNextId(msg.id)
+}
+
+// putRevisions replaces the revision history of a message. It's used when
+// restoring messages from somewhere else, like a snapshot on disk, and should
+// be called after the message itself is put.
+func (m *Messages) putRevisions(id int, revisions []Revision) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.revisions[id] = revisions
+}
+
+// bumpNextId makes sure the next allocated id is greater than id. It never
+// moves nextId backwards.
+func (m *Messages) bumpNextId(id int) {
+	for {
+		current := m.nextId.Load()
+		if current >= uint64(id) || m.nextId.CompareAndSwap(current, uint64(id)) {
+			return
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"slices"
 	"testing"
 )
 
@@ -8,7 +10,7 @@ func TestMessageOrchestratorAdd(t *testing.T) {
 	mo := NewMessages()
 
 	text := "hello"
-	msg, err := mo.Add(text)
+	msg, err := mo.Add(text, PSettings{})
 	if err != nil {
 		t.Fatalf(`mo.Add(%v) has err %+v, want nil`, text, err)
 	}
@@ -22,7 +24,7 @@ func TestMessageOrchestratorAddMultiple(t *testing.T) {
 	mo := NewMessages()
 
 	text := "hello"
-	msg, err := mo.Add(text)
+	msg, err := mo.Add(text, PSettings{})
 	if err != nil {
 		t.Fatalf(`mo.Add(%v) has err %+v, want nil`, text, err)
 	}
@@ -32,7 +34,7 @@ func TestMessageOrchestratorAddMultiple(t *testing.T) {
 	}
 
 	text = "goodbye"
-	msg, err = mo.Add(text)
+	msg, err = mo.Add(text, PSettings{})
 	if err != nil {
 		t.Fatalf(`mo.Add(%v) has err %+v, want nil`, text, err)
 	}
@@ -45,7 +47,7 @@ func TestMessageOrchestratorAddMultiple(t *testing.T) {
 func TestMessageOrchestratorGet(t *testing.T) {
 	mo := NewMessages()
 
-	original, _ := mo.Add("hello")
+	original, _ := mo.Add("hello", PSettings{})
 	msg, found, err := mo.Get(original.id)
 	if err != nil {
 		t.Fatalf(`mo.Get(%d) has err %+v, want nil`, original.id, err)
@@ -75,9 +77,9 @@ func TestMessageOrchestratorGetNone(t *testing.T) {
 func TestMessageOrchestratorUpdate(t *testing.T) {
 	mo := NewMessages()
 
-	original, _ := mo.Add("hello")
+	original, _ := mo.Add("hello", PSettings{})
 
-	msg, err := mo.Update(original.id, "goodbye")
+	msg, err := mo.Update(original.id, "goodbye", PSettings{})
 	if err != nil {
 		t.Fatalf(`mo.Update(%d, %v) has err %+v, want nil`, original.id, msg.text, err)
 	}
@@ -105,7 +107,7 @@ func TestMessageOrchestratorUpdateNone(t *testing.T) {
 	mo := NewMessages()
 
 	text := "huh"
-	_, err := mo.Update(1, text)
+	_, err := mo.Update(1, text, PSettings{})
 	if err == nil {
 		t.Fatalf(`mo.Update(1, %s) has no err, it should`, text)
 	}
@@ -114,7 +116,7 @@ func TestMessageOrchestratorUpdateNone(t *testing.T) {
 func TestMessageOrchestratorDelete(t *testing.T) {
 	mo := NewMessages()
 
-	msg, _ := mo.Add("hello")
+	msg, _ := mo.Add("hello", PSettings{})
 	err := mo.Delete(msg.id)
 	if err != nil {
 		t.Fatalf(`mo.Delete(%d) has err %+v, want nil`, msg.id, err)
@@ -141,8 +143,8 @@ func TestMessageOrchestratorDeleteNone(t *testing.T) {
 func TestMessageOrchestratorGetAll(t *testing.T) {
 	mo := NewMessages()
 
-	msg1, _ := mo.Add("hello")
-	msg2, _ := mo.Add("goodbye")
+	msg1, _ := mo.Add("hello", PSettings{})
+	msg2, _ := mo.Add("goodbye", PSettings{})
 	messages, err := mo.GetAll()
 	if err != nil {
 		t.Fatalf(`mo.GetAll() has err %+v, want nil`, err)
@@ -185,10 +187,293 @@ func TestMessageOrchestratorGetAllNone(t *testing.T) {
 func TestMessageOrchestrationAddDuplicateText(t *testing.T) {
 	mo := NewMessages()
 
-	msg1, _ := mo.Add("hello")
-	msg2, _ := mo.Add("hello")
+	msg1, _ := mo.Add("hello", PSettings{})
+	msg2, _ := mo.Add("hello", PSettings{})
 
 	if msg1.id == msg2.id {
 		t.Fatalf(`mo.Add("hello") = %d, want %d`, msg1.id, msg2.id)
 	}
-}
\ No newline at end of file
+}
+
+func TestMessageOrchestratorUpdateTimestamps(t *testing.T) {
+	mo := NewMessages()
+
+	original, _ := mo.Add("hello", PSettings{})
+	if original.createdAt.IsZero() || !original.createdAt.Equal(original.updatedAt) {
+		t.Fatalf(`mo.Add("hello") createdAt = %v, updatedAt = %v, want equal and non-zero`, original.createdAt, original.updatedAt)
+	}
+
+	msg, _ := mo.Update(original.id, "goodbye", PSettings{})
+	if !msg.createdAt.Equal(original.createdAt) {
+		t.Fatalf(`mo.Update(%d, "goodbye") createdAt = %v, want %v`, original.id, msg.createdAt, original.createdAt)
+	}
+	if msg.updatedAt.Before(original.updatedAt) {
+		t.Fatalf(`mo.Update(%d, "goodbye") updatedAt = %v, want after %v`, original.id, msg.updatedAt, original.updatedAt)
+	}
+}
+
+func TestMessageOrchestratorList(t *testing.T) {
+	mo := NewMessages()
+
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		mo.Add(text, PSettings{})
+	}
+	mo.Delete(3)
+
+	cases := []struct {
+		opts     ListOptions
+		expected []int
+	}{
+		{ListOptions{}, []int{1, 2, 4, 5}},
+		{ListOptions{Limit: 2}, []int{1, 2}},
+		{ListOptions{IdGt: 2}, []int{4, 5}},
+		{ListOptions{IdGt: 1, IdLt: 5}, []int{2, 4}},
+		{ListOptions{Descending: true}, []int{5, 4, 2, 1}},
+		{ListOptions{Descending: true, IdLt: 4, Limit: 1}, []int{2}},
+		{ListOptions{Descending: true, IdGt: 4}, []int{5}},
+		{ListOptions{IdGt: 5}, []int{}},
+	}
+
+	for _, c := range cases {
+		messages, err := mo.List(c.opts)
+		if err != nil {
+			t.Fatalf(`mo.List(%+v) has err %+v, want nil`, c.opts, err)
+		}
+
+		ids := []int{}
+		for _, msg := range messages {
+			ids = append(ids, msg.id)
+		}
+		if !slices.Equal(ids, c.expected) {
+			t.Fatalf(`mo.List(%+v) ids = %v, want %v`, c.opts, ids, c.expected)
+		}
+	}
+}
+
+func TestMessageOrchestratorRevisions(t *testing.T) {
+	mo := NewMessages()
+
+	msg, _ := mo.Add("hello", PSettings{})
+	mo.Update(msg.id, "racecar", PSettings{})
+	msg, _ = mo.Update(msg.id, "racecar", PSettings{})
+	if msg.revision != 3 {
+		t.Fatalf(`mo.Update() msg.revision = %d, want 3`, msg.revision)
+	}
+
+	if err := mo.SetRevisionResult(msg.id, 1, P_FALSE); err != nil {
+		t.Fatalf(`mo.SetRevisionResult(%d, 1) has err %+v, want nil`, msg.id, err)
+	}
+	if err := mo.SetRevisionResult(msg.id, 4, P_FALSE); err == nil {
+		t.Fatalf(`mo.SetRevisionResult(%d, 4) has nil err, want error`, msg.id)
+	}
+
+	revisions, found, _ := mo.Revisions(msg.id)
+	if !found {
+		t.Fatalf(`mo.Revisions(%d) not found`, msg.id)
+	}
+
+	texts := []string{}
+	for i, r := range revisions {
+		if r.rev != i+1 {
+			t.Fatalf(`mo.Revisions(%d)[%d].rev = %d, want %d`, msg.id, i, r.rev, i+1)
+		}
+		texts = append(texts, r.text)
+	}
+	if !slices.Equal(texts, []string{"hello", "racecar", "racecar"}) {
+		t.Fatalf(`mo.Revisions(%d) texts = %v, want [hello racecar racecar]`, msg.id, texts)
+	}
+	if revisions[0].isPalindrome != P_FALSE {
+		t.Fatalf(`mo.Revisions(%d)[0].isPalindrome = %d, want P_FALSE`, msg.id, revisions[0].isPalindrome)
+	}
+
+	mo.Delete(msg.id)
+	if _, found, _ := mo.Revisions(msg.id); found {
+		t.Fatalf(`mo.Revisions(%d) found after delete, want not found`, msg.id)
+	}
+}
+
+func TestMessageOrchestratorCompareAndSwap(t *testing.T) {
+	mo := NewMessages()
+
+	msg, _ := mo.Add("hello", PSettings{})
+	if _, err := mo.CompareAndUpdate(msg.id, "racecar", PSettings{}, 2); err != ErrRevisionMismatch {
+		t.Fatalf(`mo.CompareAndUpdate(%d, 2) has err %+v, want ErrRevisionMismatch`, msg.id, err)
+	}
+
+	msg, err := mo.CompareAndUpdate(msg.id, "racecar", PSettings{}, 1)
+	if err != nil {
+		t.Fatalf(`mo.CompareAndUpdate(%d, 1) has err %+v, want nil`, msg.id, err)
+	}
+	if msg.text != "racecar" || msg.revision != 2 {
+		t.Fatalf(`mo.CompareAndUpdate(%d, 1) = %+v, want racecar at revision 2`, msg.id, msg)
+	}
+
+	if err := mo.CompareAndDelete(msg.id, 1); err != ErrRevisionMismatch {
+		t.Fatalf(`mo.CompareAndDelete(%d, 1) has err %+v, want ErrRevisionMismatch`, msg.id, err)
+	}
+	if err := mo.CompareAndDelete(msg.id, 2); err != nil {
+		t.Fatalf(`mo.CompareAndDelete(%d, 2) has err %+v, want nil`, msg.id, err)
+	}
+	if _, found, _ := mo.Get(msg.id); found {
+		t.Fatalf(`mo.Get(%d) found after delete, want not found`, msg.id)
+	}
+
+	// a delete which wins the race is a missing message, not a mismatch
+	if _, err := mo.CompareAndUpdate(msg.id, "level", PSettings{}, 2); err != ErrMessageNotFound {
+		t.Fatalf(`mo.CompareAndUpdate(%d, 2) after delete has err %+v, want ErrMessageNotFound`, msg.id, err)
+	}
+}
+
+func TestMessageOrchestratorSettings(t *testing.T) {
+	mo := NewMessages()
+
+	msg1, _ := mo.Add("hello", PSettings{})
+	msg2, _ := mo.Add("hello", PSettings{profile: PROFILE_STRICT})
+	if msg1.settings.profile != DEFAULT_PROFILE {
+		t.Fatalf(`mo.Add("hello") profile = %s, want %s`, msg1.settings.profile, DEFAULT_PROFILE)
+	}
+	if msg1.hash == msg2.hash {
+		t.Fatalf(`mo.Add("hello") with different profiles have the same hash, want different`)
+	}
+
+	msg2, _ = mo.Update(msg2.id, "hello", PSettings{profile: PROFILE_ASCII})
+	if msg1.hash != msg2.hash {
+		t.Fatalf(`mo.Update(%d) hash = %s, want %s`, msg2.id, msg2.hash, msg1.hash)
+	}
+
+	msg3, _ := mo.Add("hello", PSettings{mode: MODE_WORD})
+	if msg1.settings.mode != DEFAULT_MODE {
+		t.Fatalf(`mo.Add("hello") mode = %s, want %s`, msg1.settings.mode, DEFAULT_MODE)
+	}
+	if msg3.settings.mode != MODE_WORD {
+		t.Fatalf(`mo.Add("hello", word) mode = %s, want %s`, msg3.settings.mode, MODE_WORD)
+	}
+	if msg1.hash == msg3.hash {
+		t.Fatalf(`mo.Add("hello") with different modes have the same hash, want different`)
+	}
+}
+
+func TestMessageOrchestratorStats(t *testing.T) {
+	mo := NewMessages()
+
+	first, _ := mo.Add("one", PSettings{})
+	second, _ := mo.Add("two", PSettings{})
+	mo.Update(first.id, "uno", PSettings{})
+	mo.Delete(second.id)
+
+	stats, err := mo.Stats()
+	if err != nil {
+		t.Fatalf(`mo.Stats() has err %+v, want nil`, err)
+	}
+	expected := MessageStats{messages: 1, revisions: 2, nextId: 2}
+	if stats != expected {
+		t.Fatalf(`mo.Stats() = %+v, want %+v`, stats, expected)
+	}
+}
+
+func TestMessageOrchestratorApply(t *testing.T) {
+	mo := NewMessages()
+	existing, _ := mo.Add("hello", PSettings{profile: PROFILE_UNICODE_LOOSE})
+
+	ops := []MessageOp{
+		{op: MESSAGE_OP_CREATE, text: "racecar"},
+		{op: MESSAGE_OP_UPDATE, id: existing.id, text: "level", rev: 1},
+		{op: MESSAGE_OP_UPDATE, id: existing.id, text: "stale", rev: 1},
+		{op: MESSAGE_OP_DELETE, id: 99},
+	}
+
+	// atomic, so the failures stop everything
+	results, err := mo.Apply(ops, true)
+	if err != nil {
+		t.Fatalf(`mo.Apply(atomic) has err %+v, want nil`, err)
+	}
+	expected := []error{ErrBatchAborted, ErrBatchAborted, ErrRevisionMismatch, ErrMessageNotFound}
+	for i, r := range results {
+		if r.err != expected[i] {
+			t.Fatalf(`mo.Apply(atomic) results[%d].err = %v, want %v`, i, r.err, expected[i])
+		}
+	}
+	if stats, _ := mo.Stats(); stats.messages != 1 || stats.nextId != 1 {
+		t.Fatalf(`mo.Stats() after mo.Apply(atomic) = %+v, want nothing changed`, stats)
+	}
+
+	// not atomic, so the rest go ahead
+	results, _ = mo.Apply(ops, false)
+	if results[0].err != nil || results[0].msg.id != 2 {
+		t.Fatalf(`mo.Apply() results[0] = %+v, want message 2 created`, results[0])
+	}
+	if results[1].err != nil || results[1].msg.revision != 2 || results[1].old.text != "hello" {
+		t.Fatalf(`mo.Apply() results[1] = %+v, want revision 2, replacing hello`, results[1])
+	}
+	if results[2].err != ErrRevisionMismatch || results[3].err != ErrMessageNotFound {
+		t.Fatalf(`mo.Apply() results = %+v, want the last two to fail`, results)
+	}
+
+	msg, _, _ := mo.Get(existing.id)
+	if msg.text != "level" || msg.settings.profile != PROFILE_UNICODE_LOOSE {
+		t.Fatalf(`mo.Get(%d) = %+v, want level with its profile kept`, existing.id, msg)
+	}
+	if _, found, _ := mo.Get(2); !found {
+		t.Fatalf(`mo.Get(2) not found`)
+	}
+}
+
+func TestMessageOrchestratorApplyExplicitIds(t *testing.T) {
+	mo := NewMessages()
+	existing, _ := mo.Add("hello", PSettings{})
+
+	ops := []MessageOp{
+		{op: MESSAGE_OP_CREATE, text: "racecar"},
+		{op: MESSAGE_OP_CREATE, id: 10, text: "level"},
+		{op: MESSAGE_OP_CREATE, id: existing.id, text: "taken"},
+		{op: MESSAGE_OP_CREATE, id: 10, text: "taken by the batch"},
+	}
+
+	results, err := mo.Apply(ops, false)
+	if err != nil {
+		t.Fatalf(`mo.Apply() has err %+v, want nil`, err)
+	}
+	if results[1].err != nil || results[1].msg.id != 10 {
+		t.Fatalf(`mo.Apply() results[1] = %+v, want message 10 created`, results[1])
+	}
+	// ids without an explicit one come after the largest explicit one
+	if results[0].err != nil || results[0].msg.id != 11 {
+		t.Fatalf(`mo.Apply() results[0] = %+v, want message 11 created`, results[0])
+	}
+	if results[2].err != ErrMessageExists || results[3].err != ErrMessageExists {
+		t.Fatalf(`mo.Apply() results = %+v, want the last two to fail with ErrMessageExists`, results)
+	}
+
+	if msg, _ := mo.Add("next", PSettings{}); msg.id != 12 {
+		t.Fatalf(`mo.Add() after mo.Apply() id = %d, want 12`, msg.id)
+	}
+}
+
+func TestMessageOrchestratorQuota(t *testing.T) {
+	mo := NewMessages()
+	mo.SetQuota(2)
+	first, _ := mo.Add("one", PSettings{})
+	mo.Add("two", PSettings{})
+
+	if _, err := mo.Add("three", PSettings{}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf(`mo.Add("three") has err %+v, want ErrQuotaExceeded`, err)
+	}
+
+	// deletes earlier in a batch make room for creates later in it
+	ops := []MessageOp{
+		{op: MESSAGE_OP_CREATE, text: "too many"},
+		{op: MESSAGE_OP_DELETE, id: first.id},
+		{op: MESSAGE_OP_CREATE, text: "room now"},
+		{op: MESSAGE_OP_CREATE, id: 10, text: "too many again"},
+	}
+	results, _ := mo.Apply(ops, false)
+	if !errors.Is(results[0].err, ErrQuotaExceeded) || !errors.Is(results[3].err, ErrQuotaExceeded) {
+		t.Fatalf(`mo.Apply() results = %+v, want the first and last to fail with ErrQuotaExceeded`, results)
+	}
+	if results[1].err != nil || results[2].err != nil || results[2].msg.id != 3 {
+		t.Fatalf(`mo.Apply() results = %+v, want message 3 created in place of %d`, results, first.id)
+	}
+	if stats, _ := mo.Stats(); stats.messages != 2 {
+		t.Fatalf(`mo.Stats() after mo.Apply() = %+v, want 2 messages`, stats)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// This file contains everything needed for GET /metrics, which is written in
+// the Prometheus text format (see
+// https://prometheus.io/docs/instrumenting/exposition_formats/). It's simple
+// enough that I'd rather write it by hand than pull in the Prometheus client
+// library.
+
+// REQUEST_DURATION_BUCKETS are the upper bounds (in seconds) of the request
+// latency histogram buckets. They're the same as Prometheus' defaults.
+var REQUEST_DURATION_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// WORK_DURATION_BUCKETS are the upper bounds (in seconds) of the doWork
+// duration histogram buckets. Work is usually very quick, unless S_DELAY is
+// set.
+var WORK_DURATION_BUCKETS = []float64{0.0001, 0.001, 0.01, 0.1, 1, 5, 10, 30, 60}
+
+// histogram counts observations (like request latencies) in buckets, the way
+// Prometheus expects. It's not safe for concurrent use: whatever owns it needs
+// to lock around it.
+type histogram struct {
+	// upper bounds of each bucket, ascending. There's an implicit +Inf bucket
+	// at the end.
+	bounds []float64
+	// counts[i] is the number of observations in bucket i, but not any
+	// before it (unlike Prometheus, see write)
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates an empty histogram with the given bucket bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// observe adds an observation to the histogram.
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// clone returns a copy of the histogram, which doesn't share anything with it.
+func (h *histogram) clone() histogram {
+	out := *h
+	out.counts = slices.Clone(h.counts)
+	return out
+}
+
+// write writes the histogram's samples (but not its HELP or TYPE, see
+// writeMetricHeader) as metric name, with the given labels (see formatLabels).
+// Buckets are cumulative.
+func (h *histogram) write(w io.Writer, name string, labels ...string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(slices.Concat(labels, []string{"le", formatFloat(bound)})...), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(slices.Concat(labels, []string{"le", "+Inf"})...), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels...), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels...), h.count)
+}
+
+// Metrics keeps track of every request the server handles: how many there
+// were, and how long they took, by method, route, and response status. It's
+// safe for concurrent use.
+type Metrics struct {
+	lock sync.Mutex
+	// the count of each histogram is the number of requests
+	requests map[requestLabels]*histogram
+}
+
+// requestLabels identifies a group of requests in Metrics. Route is the path
+// template (like /messages/{id}), not the actual path, so there's a limited
+// number of them.
+type requestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+// NewMetrics creates a Metrics struct with no requests.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[requestLabels]*histogram),
+	}
+}
+
+// observeRequest records a request which took duration.
+func (m *Metrics) observeRequest(labels requestLabels, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	h, ok := m.requests[labels]
+	if !ok {
+		h = newHistogram(REQUEST_DURATION_BUCKETS)
+		m.requests[labels] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// write writes the request counts and latencies, sorted by route, method, then
+// status.
+func (m *Metrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]requestLabels, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b requestLabels) int {
+		if c := strings.Compare(a.route, b.route); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.method, b.method); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+
+	writeMetricHeader(w, "palindrome_http_requests_total", "counter", "Number of HTTP requests handled, by method, route, and status.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "palindrome_http_requests_total%s %d\n", formatLabels(k.labels()...), m.requests[k].count)
+	}
+
+	writeMetricHeader(w, "palindrome_http_request_duration_seconds", "histogram", "How long HTTP requests took to handle, by method, route, and status.")
+	for _, k := range keys {
+		m.requests[k].write(w, "palindrome_http_request_duration_seconds", k.labels()...)
+	}
+}
+
+// labels returns the labels as name, value pairs (see formatLabels).
+func (l requestLabels) labels() []string {
+	return []string{"method", l.method, "route", l.route, "status", strconv.Itoa(l.status)}
+}
+
+// CountRequests is middleware which records every request in ss.metrics. It
+// has to be used on a mux.Router, so the route is known.
+func (ss *SharedState) CountRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		ss.metrics.observeRequest(requestLabels{method: r.Method, route: route, status: sr.statusOrOK()}, time.Since(start))
+	})
+}
+
+// statusRecorder is an http.ResponseWriter which remembers the status code of
+// the response. It can still be flushed (for event streams).
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController get at the original ResponseWriter.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// statusOrOK returns the status of the response, which is 200 if the handler
+// never set one.
+func (sr *statusRecorder) statusOrOK() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// writeWorkStats writes the WorkStats of every analyzer, labelled by analyzer
+// name.
+func writeWorkStats(w io.Writer, stats []namedWorkStats) {
+	statuses := []int{PW_PENDING, PW_RUNNING, PW_DONE, PW_CANCELLED, PW_FAILED}
+
+	writeMetricHeader(w, "palindrome_work", "gauge", "Number of pieces of work (one per unique hash), by analyzer and status.")
+	for _, s := range stats {
+		for _, status := range statuses {
+			fmt.Fprintf(w, "palindrome_work%s %d\n", formatLabels("analyzer", s.name, "status", PWStatusToString(status)), s.stats.work[status])
+		}
+	}
+
+	simple := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(WorkStats) int
+	}{
+		{"palindrome_work_listeners", "Number of messages listening for work results, by analyzer.", "gauge", func(ws WorkStats) int { return ws.listeners }},
+		{"palindrome_work_queued", "Number of pieces of work waiting for a worker, by analyzer.", "gauge", func(ws WorkStats) int { return ws.queued }},
+		{"palindrome_work_running", "Number of pieces of work being worked on, by analyzer.", "gauge", func(ws WorkStats) int { return ws.running }},
+		{"palindrome_work_dedupe_hits_total", "Number of times a message shared work with another message with the same hash, by analyzer.", "counter", func(ws WorkStats) int { return ws.dedupeHits }},
+		{"palindrome_work_cancellations_total", "Number of times work was cancelled before it finished, by analyzer.", "counter", func(ws WorkStats) int { return ws.cancellations }},
+	}
+	for _, m := range simple {
+		writeMetricHeader(w, m.name, m.kind, m.help)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s%s %d\n", m.name, formatLabels("analyzer", s.name), m.value(s.stats))
+		}
+	}
+
+	writeMetricHeader(w, "palindrome_work_duration_seconds", "histogram", "How long doWork took, by analyzer.")
+	for _, s := range stats {
+		s.stats.durations.write(w, "palindrome_work_duration_seconds", "analyzer", s.name)
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric.
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels turns name, value pairs into Prometheus labels, like
+// {method="GET",status="200"}. Values are escaped. It returns an empty string
+// if there are no labels.
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat formats a float the shortest way that still parses back exactly.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
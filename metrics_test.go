@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.1)
+	h.observe(0.5)
+	h.observe(3)
+
+	var sb strings.Builder
+	h.write(&sb, "x", "a", "b")
+	expected := `x_bucket{a="b",le="0.1"} 2
+x_bucket{a="b",le="1"} 3
+x_bucket{a="b",le="+Inf"} 4
+x_sum{a="b"} 3.65
+x_count{a="b"} 4
+`
+	if sb.String() != expected {
+		t.Fatalf(`h.write() = %q, want %q`, sb.String(), expected)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if result := formatLabels(); result != "" {
+		t.Fatalf(`formatLabels() = %q, want ""`, result)
+	}
+
+	result := formatLabels("route", `/a"b\c`+"\n")
+	if expected := `{route="/a\"b\\c\n"}`; result != expected {
+		t.Fatalf(`formatLabels() = %q, want %q`, result, expected)
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	ss := SharedState{metrics: NewMetrics()}
+
+	r := mux.NewRouter()
+	r.Use(ss.CountRequests)
+	r.Methods("GET").Path("/things/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "404" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	for _, url := range []string{"/things/1", "/things/2", "/things/404"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	var sb strings.Builder
+	ss.metrics.write(&sb)
+	for _, expected := range []string{
+		`palindrome_http_requests_total{method="GET",route="/things/{id}",status="200"} 2`,
+		`palindrome_http_requests_total{method="GET",route="/things/{id}",status="404"} 1`,
+		`palindrome_http_request_duration_seconds_count{method="GET",route="/things/{id}",status="200"} 2`,
+	} {
+		if !strings.Contains(sb.String(), expected+"\n") {
+			t.Fatalf(`ss.metrics.write() = %s, want it to contain %s`, sb.String(), expected)
+		}
+	}
+}
@@ -1,21 +1,96 @@
 package main
 
+import "time"
+
 // All incoming and outgoing payloads are JSON. This file contains all the types
 // that are converted directly to/from JSON by any handler.
 
 // ---- Request Types ----
 
-// CreateMessageRequestData is used when creating a new message. It has a single
-// "text" field.
+// CreateMessageRequestData is used when creating a new message. It has a
+// "text" field, an optional "profile" field (a normalization profile, like
+// "unicode-loose", see PROFILES), and an optional "mode" field (what to compare,
+// like "word", see MODES).
 type CreateMessageRequestData struct {
-	Text string `json:"text"`
+	Text    string `json:"text"`
+	Profile string `json:"profile,omitempty"`
+	Mode    string `json:"mode,omitempty"`
 }
 
 // UpdateMessageRequestData is used when updating an existing message. It has
-// a single "text" field, exactly the same as CreateMessageRequestData, but it's
-// a separate type for clarity and future-proofing.
+// a "text" field and optional "profile" and "mode" fields, exactly the same as
+// CreateMessageRequestData, but it's a separate type for clarity and
+// future-proofing. If there's no "profile" or "mode", the message keeps its
+// current one.
 type UpdateMessageRequestData struct {
-	Text string `json:"text"`
+	Text    string `json:"text"`
+	Profile string `json:"profile,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+// BatchRequestData is used to run a batch of operations on messages. It has a
+// single field, "operations", which is an array of BatchOperationRequestData,
+// run in order.
+type BatchRequestData struct {
+	Operations []BatchOperationRequestData `json:"operations"`
+}
+
+// BatchOperationRequestData is a single operation in a batch. It has an "op"
+// field ("create", "update", or "delete"), an "id" field (for updates and
+// deletes; optional for creates, which otherwise get the next id), "text",
+// "profile", and "mode" fields (for creates and updates, like
+// CreateMessageRequestData and UpdateMessageRequestData), and an optional "rev"
+// field (for updates and deletes: only go ahead if the message is at this
+// revision, like If-Match).
+type BatchOperationRequestData struct {
+	Op      string `json:"op"`
+	ID      int    `json:"id,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Rev     int    `json:"rev,omitempty"`
+}
+
+// ---- Export Types ----
+// These are used by /messages/export and /messages/import.
+
+// ExportMessageData is a single message in an export (or import, see
+// export.go for the formats). It has nine fields: "id", "text", "profile",
+// "mode", "revision", "is_palindrome" (can be null), "status" (of the
+// palindrome work, see PWStatusToString), "created_at", and "updated_at". Only
+// "text", "profile", "mode", and (maybe) "id" are imported, everything else is
+// ignored.
+type ExportMessageData struct {
+	ID           int       `json:"id,omitempty"`
+	Text         string    `json:"text"`
+	Profile      string    `json:"profile,omitempty"`
+	Mode         string    `json:"mode,omitempty"`
+	Revision     int       `json:"revision,omitempty"`
+	IsPalindrome *bool     `json:"is_palindrome"`
+	Status       string    `json:"status,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ImportResponseData is returned after importing messages. It has three
+// fields: "imported" (how many messages were created), "failed" (how many
+// weren't), and "errors" (an array of ImportErrorResponseItem, for the first
+// few that failed).
+type ImportResponseData struct {
+	Imported int                       `json:"imported"`
+	Failed   int                       `json:"failed"`
+	Errors   []ImportErrorResponseItem `json:"errors"`
+}
+
+// ImportErrorResponseItem says why a message wasn't imported. It has four
+// fields: "record" (where the message was in the import, starting at 1, not
+// counting a CSV header), "id" (the id it wanted to keep, if any), "code" (see
+// ErrorCode), and "error".
+type ImportErrorResponseItem struct {
+	Record int       `json:"record"`
+	ID     int       `json:"id,omitempty"`
+	Code   ErrorCode `json:"code"`
+	Error  string    `json:"error"`
 }
 
 // ---- Response Types ----
@@ -26,8 +101,18 @@ type CreateMessageResponseData struct {
 	ID int `json:"id"`
 }
 
+// CreateMessageWaitResponseData is returned after a new message is created
+// with the "wait" query parameter. It has three fields: "id", "text", and
+// "is_palindrome" (which is still null if the wait ran out).
+type CreateMessageWaitResponseData struct {
+	ID           int    `json:"id"`
+	Text         string `json:"text"`
+	IsPalindrome *bool  `json:"is_palindrome"`
+}
+
 // GetMessageResponseData is returned when a message is successfully retrieved.
-// It has two fields: "text" and "is_palindrome".
+// It has four fields: "text", "is_palindrome", "analysis", and "analyses" (see
+// AnalyzerResultResponseData).
 type GetMessageResponseData struct {
 	Text         string `json:"text"`
 	// IsPalindrome can be null, which means the text is empty, or the server
@@ -35,13 +120,56 @@ type GetMessageResponseData struct {
 	// trinary logic. In actual production code, I would use an explicit status
 	// field instead, this boolean pointer is just for fun.
 	IsPalindrome *bool  `json:"is_palindrome"` 
+	// Analysis is null until the calculation is done.
+	Analysis *AnalysisResponseData `json:"analysis"`
+	// Analyses has the result of every installed analyzer, by name.
+	Analyses map[string]AnalyzerResultResponseData `json:"analyses"`
+}
+
+// AnalysisResponseData describes the palindromes inside a message's text (see
+// PAnalysis). It has three fields: "longest_palindrome" (null if there's
+// nothing to compare, see LongestPalindromeResponseData),
+// "maximal_palindromes", the number of palindromic substrings which can't be
+// extended by a character on both sides, and "near_palindrome" (null if there's
+// nothing to compare or the text is too long, see
+// NearPalindromeResponseData).
+type AnalysisResponseData struct {
+	LongestPalindrome  *LongestPalindromeResponseData `json:"longest_palindrome"`
+	MaximalPalindromes int                            `json:"maximal_palindromes"`
+	NearPalindrome     *NearPalindromeResponseData    `json:"near_palindrome"`
+}
+
+// LongestPalindromeResponseData is the longest palindromic substring of a
+// message's text. It has four fields: "text" (cut from the original text),
+// "start" and "end" (offsets of the substring in the original text, counted in
+// Unicode code points, end exclusive), and "length" (how many characters, words,
+// or lines long the palindrome is after normalization, depending on the mode).
+type LongestPalindromeResponseData struct {
+	Text   string `json:"text"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Length int    `json:"length"`
+}
+
+// NearPalindromeResponseData says how close a message's text is to being a
+// palindrome (see PNearness). It has four fields: "insertions" (the fewest
+// characters, words, or lines which need to be inserted to make it a
+// palindrome), "substitutions" (the fewest which need to be replaced instead),
+// "repaired" (one palindrome made with the fewest insertions, as normalized
+// text), and "palindromicity" (from 0 to 1, where 1 is a palindrome).
+type NearPalindromeResponseData struct {
+	Insertions     int     `json:"insertions"`
+	Substitutions  int     `json:"substitutions"`
+	Repaired       string  `json:"repaired"`
+	Palindromicity float64 `json:"palindromicity"`
 }
 
 // GetAllMessagesResponseData is returned from a request to get all messages. It
-// has a single field, "messages", which is an array of
-// GetAllMessagesResponseItem.
+// has a field "messages", which is an array of GetAllMessagesResponseItem, and
+// a field "next_cursor", which is only included if there's another page.
 type GetAllMessagesResponseData struct {
-	Messages []GetAllMessagesResponseItem `json:"messages"`
+	Messages   []GetAllMessagesResponseItem `json:"messages"`
+	NextCursor string                       `json:"next_cursor,omitempty"`
 }
 
 // GetAllMessagesResponseItem is used in tandem with GetAllMessagesResponseData.
@@ -52,3 +180,417 @@ type GetAllMessagesResponseItem struct {
 	Text         string `json:"text"`
 	IsPalindrome *bool  `json:"is_palindrome"` // trinary, nil if unknown
 }
+
+// SearchMessagesResponseData is returned from a message search. It has a single
+// field, "messages", which is an array of SearchMessagesResponseItem, best
+// match first.
+type SearchMessagesResponseData struct {
+	Messages []SearchMessagesResponseItem `json:"messages"`
+}
+
+// SearchMessagesResponseItem is used in tandem with SearchMessagesResponseData.
+// It's the same as GetAllMessagesResponseItem, plus a "score" field (how many
+// times the search matched the message).
+type SearchMessagesResponseItem struct {
+	ID           int    `json:"id"`
+	Text         string `json:"text"`
+	IsPalindrome *bool  `json:"is_palindrome"`
+	Score        int    `json:"score"`
+}
+
+// BatchResponseData is returned after running a batch of operations. It has
+// two fields: "atomic" (whether it was all or nothing) and "results" (an array
+// of BatchResultResponseItem, one per operation, in the same order).
+type BatchResponseData struct {
+	Atomic  bool                      `json:"atomic"`
+	Results []BatchResultResponseItem `json:"results"`
+}
+
+// BatchResultResponseItem is the outcome of a single operation in a batch. It
+// has six fields: "op", "status" (the status code the operation would've had
+// on its own: 201, 200, or 204 if it worked; 404, 409, or 412 if it didn't; or
+// 424 if it wasn't applied because another operation in an atomic batch
+// failed), "id" and "rev" (of the message, if it worked), and "code" (see
+// ErrorCode) and "error" (if it didn't).
+type BatchResultResponseItem struct {
+	Op     string    `json:"op"`
+	Status int       `json:"status"`
+	ID     int       `json:"id,omitempty"`
+	Rev    int       `json:"rev,omitempty"`
+	Code   ErrorCode `json:"code,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// ---- Analyzer Types ----
+// These are used by GET /analyzers, and for the "analyses" field of messages.
+
+// GetAnalyzersResponseData is returned from a request to list the installed
+// analyzers. It has a single field, "analyzers", which is an array of
+// AnalyzerResponseItem, in the order they run.
+type GetAnalyzersResponseData struct {
+	Analyzers []AnalyzerResponseItem `json:"analyzers"`
+}
+
+// AnalyzerResponseItem describes an installed analyzer. It has two fields:
+// "name" (its key under "analyses") and "description".
+type AnalyzerResponseItem struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// AnalyzerResultResponseData is the result of one analyzer, for one message.
+// It has two fields: "status" (like in MessageResponseDataV2) and "result"
+// (null unless status is "done", otherwise it depends on the analyzer, like
+// PalindromeAnalyzerResponseData).
+type AnalyzerResultResponseData struct {
+	Status string `json:"status"`
+	Result any    `json:"result"`
+}
+
+// PalindromeAnalyzerResponseData is the result of the "palindrome" analyzer.
+// It has four fields: "is_palindrome", "profile", "mode", and "analysis", which
+// are the same as in MessageResponseDataV2.
+type PalindromeAnalyzerResponseData struct {
+	IsPalindrome *bool                 `json:"is_palindrome"`
+	Profile      string                `json:"profile"`
+	Mode         string                `json:"mode"`
+	Analysis     *AnalysisResponseData `json:"analysis"`
+}
+
+// AnagramResponseData is the result of the "anagram" analyzer. It has a single
+// field, "signature": the normalized characters (or words, or lines) of the
+// text, sorted. Messages with the same settings and signature are anagrams.
+type AnagramResponseData struct {
+	Signature string `json:"signature"`
+}
+
+// StatsResponseData is the result of the "stats" analyzer. It counts
+// "characters" (Unicode code points), "graphemes" (user-perceived
+// characters), "letters", "digits", "spaces", "punctuation", "words", and
+// "lines" in the original text.
+type StatsResponseData struct {
+	Characters  int `json:"characters"`
+	Graphemes   int `json:"graphemes"`
+	Letters     int `json:"letters"`
+	Digits      int `json:"digits"`
+	Spaces      int `json:"spaces"`
+	Punctuation int `json:"punctuation"`
+	Words       int `json:"words"`
+	Lines       int `json:"lines"`
+}
+
+// ---- Admin Types ----
+// These are used by the /admin endpoints.
+
+// GetCacheResponseData is returned from a request to inspect the result
+// caches. It has a single field, "caches", which is an array of
+// CacheResponseItem, one per analyzer with caching turned on.
+type GetCacheResponseData struct {
+	Caches []CacheResponseItem `json:"caches"`
+}
+
+// CacheResponseItem describes the result cache of one analyzer (see
+// CacheStats). It has eight fields: "analyzer" (its name), "size" (how many
+// results are cached), "max_size", "ttl_seconds" (how long results are kept,
+// 0 for forever), "hits", "misses", "evictions", and "entries" (an array of
+// CachedResultResponseItem, most recently used first, maybe cut short).
+type CacheResponseItem struct {
+	Analyzer   string                     `json:"analyzer"`
+	Size       int                        `json:"size"`
+	MaxSize    int                        `json:"max_size"`
+	TTLSeconds int                        `json:"ttl_seconds"`
+	Hits       int                        `json:"hits"`
+	Misses     int                        `json:"misses"`
+	Evictions  int                        `json:"evictions"`
+	Entries    []CachedResultResponseItem `json:"entries"`
+}
+
+// CachedResultResponseItem is a single cached result. It has four fields:
+// "hash" (the message hash it's for, see MessageHash), "status", "stored_at",
+// and "expires_at" (null if it never expires).
+type CachedResultResponseItem struct {
+	Hash      string     `json:"hash"`
+	Status    string     `json:"status"`
+	StoredAt  time.Time  `json:"stored_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// PurgeCacheResponseData is returned after purging the result caches. It has
+// a single field, "purged": how many results were removed, by analyzer name.
+type PurgeCacheResponseData struct {
+	Purged map[string]int `json:"purged"`
+}
+
+// GetAPIKeysResponseData is returned from a request to list the API keys. It
+// has a single field, "keys", which is an array of APIKeyResponseItem, in the
+// same order as the config file.
+type GetAPIKeysResponseData struct {
+	Keys []APIKeyResponseItem `json:"keys"`
+}
+
+// APIKeyResponseItem describes one API key, but never the key itself (or its
+// hash). It has four fields: "id", "scopes", "tenant", and "rotated_at" (null
+// if it's never been rotated).
+type APIKeyResponseItem struct {
+	ID        string     `json:"id"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant"`
+	RotatedAt *time.Time `json:"rotated_at"`
+}
+
+// RotateAPIKeyResponseData is returned after rotating an API key. It's the
+// same as APIKeyResponseItem, plus "key": the new key. This is the only time
+// it's ever sent, it can't be looked up again.
+type RotateAPIKeyResponseData struct {
+	APIKeyResponseItem
+	Key string `json:"key"`
+}
+
+// ---- Health Types ----
+// These are used by /healthz, /readyz, and /debug/state.
+
+// HealthResponseData is returned from a liveness check. It has a single field,
+// "status", which is always "ok" (if the process weren't alive, it couldn't
+// respond).
+type HealthResponseData struct {
+	Status string `json:"status"`
+}
+
+// ReadyResponseData is returned from a readiness check. It has two fields:
+// "ready" (true if every check passed) and "checks" (by name: "store",
+// "workers", and "shutdown"; the value is "ok", or why the check failed).
+type ReadyResponseData struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// DebugStateResponseData is a dump of the server's internal state, for
+// debugging. It has two fields: "messages" (a DebugMessagesResponseData) and
+// "analyzers" (an array of DebugAnalyzerResponseData, in the order they were
+// installed).
+type DebugStateResponseData struct {
+	Tenants   []DebugMessagesResponseData `json:"tenants"`
+	Analyzers []DebugAnalyzerResponseData `json:"analyzers"`
+}
+
+// DebugMessagesResponseData describes the message store of one tenant (see
+// MessageStats). It has four fields: "tenant", "count", "revisions", and
+// "next_id" (the id most recently handed out; the next message gets next_id +
+// 1).
+type DebugMessagesResponseData struct {
+	Tenant    string `json:"tenant"`
+	Count     int    `json:"count"`
+	Revisions int    `json:"revisions"`
+	NextID    int    `json:"next_id"`
+}
+
+// DebugAnalyzerResponseData describes the work of one analyzer. It has seven
+// fields: "analyzer" (its name), "workers", "running" (how many workers are
+// busy), "queue_depth", "queued" (how much work is waiting), "closing" (true
+// once it's shutting down), and "work" (an array of DebugWorkResponseItem,
+// sorted by hash).
+type DebugAnalyzerResponseData struct {
+	Analyzer   string                  `json:"analyzer"`
+	Workers    int                     `json:"workers"`
+	Running    int                     `json:"running"`
+	QueueDepth int                     `json:"queue_depth"`
+	Queued     int                     `json:"queued"`
+	Closing    bool                    `json:"closing"`
+	Work       []DebugWorkResponseItem `json:"work"`
+}
+
+// DebugWorkResponseItem describes a single piece of work (see WorkState). It
+// has eight fields: "hash", "status", "done", "is_palindrome" (can be null, and
+// is always null for analyzers other than palindrome), "queue_position",
+// "listeners" (the messages relying on the work, see
+// DebugListenerResponseItem), "created_at", and "age_seconds".
+type DebugWorkResponseItem struct {
+	Hash          string                      `json:"hash"`
+	Status        string                      `json:"status"`
+	Done          bool                        `json:"done"`
+	IsPalindrome  *bool                       `json:"is_palindrome"`
+	QueuePosition int                         `json:"queue_position"`
+	Listeners     []DebugListenerResponseItem `json:"listeners"`
+	CreatedAt     time.Time                   `json:"created_at"`
+	AgeSeconds    float64                     `json:"age_seconds"`
+}
+
+// DebugListenerResponseItem is a message listening to a piece of work. It has
+// two fields: "tenant" and "id". Listeners are sorted by tenant, then id.
+type DebugListenerResponseItem struct {
+	Tenant string `json:"tenant"`
+	ID     int    `json:"id"`
+}
+
+// ---- Error Types ----
+// These are used for every error response, see problems.go.
+
+// ProblemResponseData is the body of every error response (see RFC 7807). It
+// has six fields: "type" (a path describing this kind of error, see
+// GetProblemType), "title" (a short summary of the kind of error), "status"
+// (the status code), "detail" (what went wrong this time, can be empty),
+// "instance" (the path and query of the request), and "code" (see ErrorCode).
+// Some errors have more fields (see BatchProblemResponseData,
+// ImportProblemResponseData, ReadyProblemResponseData, and
+// ValidationProblemResponseData).
+type ProblemResponseData struct {
+	Type     string    `json:"type"`
+	Title    string    `json:"title"`
+	Status   int       `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+	Instance string    `json:"instance"`
+	Code     ErrorCode `json:"code"`
+}
+
+// ValidationProblemResponseData is returned when a payload has invalid fields.
+// It has the fields of ProblemResponseData, and "errors": an array of
+// FieldErrorResponseItem, one for each problem.
+type ValidationProblemResponseData struct {
+	ProblemResponseData
+	Errors []FieldErrorResponseItem `json:"errors"`
+}
+
+// FieldErrorResponseItem says what's wrong with one field of a payload. It has
+// three fields: "field" (like "text", or "operations[2].text" in a batch),
+// "code" ("required", "unknown", "wrong_type", "invalid_utf8", "too_long", or
+// "invalid"), and "detail" (human-readable).
+type FieldErrorResponseItem struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// BatchProblemResponseData is returned when an atomic batch fails. It has the
+// fields of ProblemResponseData and BatchResponseData.
+type BatchProblemResponseData struct {
+	ProblemResponseData
+	BatchResponseData
+}
+
+// ImportProblemResponseData is returned when an import can't be read to the
+// end. It has the fields of ProblemResponseData and ImportResponseData.
+type ImportProblemResponseData struct {
+	ProblemResponseData
+	ImportResponseData
+}
+
+// ReadyProblemResponseData is returned when a readiness check fails. It has
+// the fields of ProblemResponseData and ReadyResponseData.
+type ReadyProblemResponseData struct {
+	ProblemResponseData
+	ReadyResponseData
+}
+
+// GetProblemTypesResponseData has a single field, "problems", which is an
+// array of every kind of error.
+type GetProblemTypesResponseData struct {
+	Problems []ProblemTypeResponseData `json:"problems"`
+}
+
+// ProblemTypeResponseData describes a kind of error (see ERROR_CATALOGUE). It
+// has five fields: "type", "code", "status", and "title" (the same as in
+// ProblemResponseData), and "description".
+type ProblemTypeResponseData struct {
+	Type        string    `json:"type"`
+	Code        ErrorCode `json:"code"`
+	Status      int       `json:"status"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+}
+
+// ---- Event Types ----
+
+// MessageEventData is the data of a "result" event, sent by
+// GET /messages/{id}/events whenever the message or its palindrome result
+// changes. It has five fields: "id", "text", "is_palindrome" (trinary, like in
+// GetMessageResponseData), "done" (false while still calculating), and
+// "queue_position" (0 unless the calculation is waiting in a queue).
+type MessageEventData struct {
+	ID            int    `json:"id"`
+	Text          string `json:"text"`
+	IsPalindrome  *bool  `json:"is_palindrome"`
+	Done          bool   `json:"done"`
+	QueuePosition int    `json:"queue_position"`
+}
+
+// MessageDeletedEventData is the data of a "deleted" event, which is the last
+// event sent by GET /messages/{id}/events. It has a single "id" field.
+type MessageDeletedEventData struct {
+	ID int `json:"id"`
+}
+
+// ---- v2 Types ----
+
+// The v2 API (under /v2) uses the same request types as v1, but every response
+// that includes a message uses the same MessageResponseDataV2 type.
+
+// MessageResponseDataV2 represents a single message in the v2 API. It always
+// has the same ten fields: "id", "text", "status" (one of "pending",
+// "running", "done", "cancelled", or "failed"), "is_palindrome" (null unless
+// status is "done", and still null if there's nothing to compare), "profile"
+// (the normalization profile used to get "is_palindrome"), "mode" (whether
+// characters, words, or lines were compared), "analysis" (null unless status
+// is "done", see AnalysisResponseData), "analyses" (the result of every
+// installed analyzer, by name, see AnalyzerResultResponseData), "created_at",
+// and "updated_at". "status" is the status of the palindrome analyzer.
+type MessageResponseDataV2 struct {
+	ID           int                                   `json:"id"`
+	Text         string                                `json:"text"`
+	Status       string                                `json:"status"`
+	IsPalindrome *bool                                 `json:"is_palindrome"`
+	Profile      string                                `json:"profile"`
+	Mode         string                                `json:"mode"`
+	Analysis     *AnalysisResponseData                 `json:"analysis"`
+	Analyses     map[string]AnalyzerResultResponseData `json:"analyses"`
+	CreatedAt    time.Time                             `json:"created_at"`
+	UpdatedAt    time.Time                             `json:"updated_at"`
+}
+
+// GetAllMessagesResponseDataV2 is returned from a request to get all messages
+// in the v2 API. It has a field "messages", which is an array of
+// MessageResponseDataV2, and a field "next_cursor", which is only included if
+// there's another page.
+type GetAllMessagesResponseDataV2 struct {
+	Messages   []MessageResponseDataV2 `json:"messages"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// SearchMessagesResponseDataV2 is returned from a message search in the v2 API.
+// It has a single field, "messages", which is an array of
+// SearchMessagesResponseItemV2, best match first.
+type SearchMessagesResponseDataV2 struct {
+	Messages []SearchMessagesResponseItemV2 `json:"messages"`
+}
+
+// SearchMessagesResponseItemV2 is used in tandem with
+// SearchMessagesResponseDataV2. It has every field of MessageResponseDataV2,
+// plus a "score" field (how many times the search matched the message).
+type SearchMessagesResponseItemV2 struct {
+	MessageResponseDataV2
+	Score int `json:"score"`
+}
+
+// ---- Revision Types ----
+// These are used by the revision endpoints, in both v1 and v2.
+
+// RevisionResponseData represents a single revision of a message. It has six
+// fields: "rev" (1 for the original text, then +1 for every update), "text",
+// "is_palindrome" (the result as of when the revision was replaced, or the
+// current result for the current revision; can be null), "profile" and "mode"
+// (the settings of the revision), and "created_at" (when the message was
+// changed to this text).
+type RevisionResponseData struct {
+	Rev          int       `json:"rev"`
+	Text         string    `json:"text"`
+	IsPalindrome *bool     `json:"is_palindrome"`
+	Profile      string    `json:"profile"`
+	Mode         string    `json:"mode"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// GetRevisionsResponseData is returned from a request to get every revision of
+// a message. It has a single field, "revisions", which is an array of
+// RevisionResponseData, oldest first.
+type GetRevisionsResponseData struct {
+	Revisions []RevisionResponseData `json:"revisions"`
+}
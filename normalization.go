@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Normalization profiles decide how text is cleaned up before checking if it's
+// a palindrome:
+//
+//   - PROFILE_STRICT compares the text exactly as it is (after composing it,
+//     NFC), one grapheme cluster at a time. Case, spaces, and punctuation all
+//     count.
+//   - PROFILE_ASCII is the original behaviour: lowercase the text, remove
+//     everything except ASCII letters, digits, underscores, and newlines, then
+//     compare bytes. Non-ASCII letters are removed entirely.
+//   - PROFILE_UNICODE_LOOSE decomposes the text (NFKD), strips diacritics, case
+//     folds, and removes everything except letters and numbers (in any
+//     script), then compares grapheme clusters. "Ésope reste ici et se repose"
+//     is a palindrome.
+const (
+	PROFILE_STRICT        = "strict"
+	PROFILE_ASCII         = "ascii"
+	PROFILE_UNICODE_LOOSE = "unicode-loose"
+)
+
+// DEFAULT_PROFILE is used when a message doesn't ask for a profile. It's
+// PROFILE_ASCII, so results don't change for existing clients.
+const DEFAULT_PROFILE = PROFILE_ASCII
+
+// PROFILES lists every normalization profile, in the order they're documented.
+var PROFILES = []string{PROFILE_STRICT, PROFILE_ASCII, PROFILE_UNICODE_LOOSE}
+
+// Modes decide what the text is a sequence of, when checking if it reads the
+// same forwards and backwards:
+//
+//   - MODE_CHAR compares characters, "racecar".
+//   - MODE_WORD compares words, "fall leaves after leaves fall". Words are
+//     separated by whitespace, and each word is normalized on its own
+//     according to the profile. Words which normalize to nothing (like a lone
+//     "-") are skipped, except with PROFILE_STRICT.
+//   - MODE_LINE compares lines, like a poem with mirrored stanzas. Each line is
+//     normalized on its own according to the profile. Lines which normalize to
+//     nothing (like blank lines between stanzas) are skipped, except with
+//     PROFILE_STRICT.
+const (
+	MODE_CHAR = "char"
+	MODE_WORD = "word"
+	MODE_LINE = "line"
+)
+
+// DEFAULT_MODE is used when a message doesn't ask for a mode.
+const DEFAULT_MODE = MODE_CHAR
+
+// MODES lists every mode, in the order they're documented.
+var MODES = []string{MODE_CHAR, MODE_WORD, MODE_LINE}
+
+// IsValidProfile returns true if profile is one of PROFILES.
+func IsValidProfile(profile string) bool {
+	for _, p := range PROFILES {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidMode returns true if mode is one of MODES.
+func IsValidMode(mode string) bool {
+	for _, m := range MODES {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaults fills in any empty settings with their defaults.
+func (s PSettings) withDefaults() PSettings {
+	if s.profile == "" {
+		s.profile = DEFAULT_PROFILE
+	}
+	if s.mode == "" {
+		s.mode = DEFAULT_MODE
+	}
+	return s
+}
+
+// orCurrent fills in any empty settings from current, like when a message is
+// updated without asking for new settings.
+func (s PSettings) orCurrent(current PSettings) PSettings {
+	if s.profile == "" {
+		s.profile = current.profile
+	}
+	if s.mode == "" {
+		s.mode = current.mode
+	}
+	return s
+}
+
+// ParseSettings builds PSettings from the fields of a request payload. Empty
+// fields are left empty. It returns an error if profile isn't one of PROFILES,
+// or if mode isn't one of MODES.
+func ParseSettings(profile string, mode string) (PSettings, error) {
+	if profile != "" && !IsValidProfile(profile) {
+		return PSettings{}, fmt.Errorf("unknown profile %q, must be one of %s", profile, strings.Join(PROFILES, ", "))
+	}
+	if mode != "" && !IsValidMode(mode) {
+		return PSettings{}, fmt.Errorf("unknown mode %q, must be one of %s", mode, strings.Join(MODES, ", "))
+	}
+
+	return PSettings{profile: profile, mode: mode}, nil
+}
+
+// TextIsPalindrome returns P_UNKNOWN if there's nothing to compare, P_TRUE if
+// the text is a palindrome, and P_FALSE if it is not, according to settings
+// (see PSettings). Unknown or empty settings are treated as the defaults.
+func TextIsPalindrome(text string, settings PSettings) int {
+	settings = settings.withDefaults()
+	if settings.mode == MODE_CHAR && settings.profile == PROFILE_ASCII {
+		return StringIsPalindrome(text)
+	}
+
+	return unitsArePalindrome(normalizeUnits(text, settings))
+}
+
+// normalizedUnit is one unit (a character, word, or line, depending on the
+// mode) of normalized text (key), along with where it came from in the
+// original text: start and end are rune offsets, end exclusive. Units are
+// compared by key.
+type normalizedUnit struct {
+	key   string
+	start int
+	end   int
+}
+
+// normalizeUnits normalizes text according to settings, keeping track of where
+// each unit came from. With MODE_WORD and MODE_LINE, the text is split into
+// words or lines and each one is a single unit (see normalizeSegment).
+// Otherwise it works one character at a time (see normalizeChars).
+func normalizeUnits(text string, settings PSettings) []normalizedUnit {
+	switch settings.mode {
+	case MODE_WORD:
+		return normalizeSegments(splitWords(text), settings.profile)
+	case MODE_LINE:
+		return normalizeSegments(splitLines(text), settings.profile)
+	default:
+		return normalizeChars(text, settings.profile)
+	}
+}
+
+// normalizeChars normalizes text according to a profile, one character at a
+// time. Text is split into grapheme clusters first, and each cluster is
+// normalized on its own: with PROFILE_STRICT it's composed (NFC), with
+// PROFILE_UNICODE_LOOSE it may disappear (like punctuation) or become several
+// characters (like "ß" to "ss"). With PROFILE_ASCII (or an unknown profile) it
+// works one rune at a time, lowercasing and keeping only what
+// StringIsPalindrome keeps.
+func normalizeChars(text string, profile string) []normalizedUnit {
+	units := []normalizedUnit{}
+	offset := 0
+
+	switch profile {
+	case PROFILE_STRICT:
+		for _, cluster := range Graphemes(text) {
+			n := utf8.RuneCountInString(cluster)
+			units = append(units, normalizedUnit{key: norm.NFC.String(cluster), start: offset, end: offset + n})
+			offset += n
+		}
+	case PROFILE_UNICODE_LOOSE:
+		for _, cluster := range Graphemes(text) {
+			n := utf8.RuneCountInString(cluster)
+			for _, key := range Graphemes(looseNormalize(cluster)) {
+				units = append(units, normalizedUnit{key: key, start: offset, end: offset + n})
+			}
+			offset += n
+		}
+	default:
+		for _, r := range text {
+			for _, b := range []byte(asciiNormalize(string(r))) {
+				units = append(units, normalizedUnit{key: string(b), start: offset, end: offset + 1})
+			}
+			offset++
+		}
+	}
+
+	return units
+}
+
+// segment is a piece of text (like a word or a line), and where it is in the
+// original text, in rune offsets, end exclusive.
+type segment struct {
+	text  string
+	start int
+	end   int
+}
+
+// splitWords splits text into words, separated by any amount of whitespace.
+func splitWords(text string) []segment {
+	out := []segment{}
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+		out = append(out, segment{text: string(runes[start:i]), start: start, end: i})
+	}
+
+	return out
+}
+
+// splitLines splits text into lines, on "\n". A "\r" at the end of a line
+// (like from "\r\n") isn't part of the line.
+func splitLines(text string) []segment {
+	out := []segment{}
+	offset := 0
+
+	for _, line := range strings.Split(text, "\n") {
+		n := utf8.RuneCountInString(line)
+		trimmed := strings.TrimSuffix(line, "\r")
+		out = append(out, segment{text: trimmed, start: offset, end: offset + utf8.RuneCountInString(trimmed)})
+		offset += n + 1
+	}
+
+	return out
+}
+
+// normalizeSegments turns each segment into a single unit, normalized
+// according to a profile (see normalizeSegment). Segments which normalize to
+// nothing are skipped, except with PROFILE_STRICT, where everything counts.
+func normalizeSegments(segments []segment, profile string) []normalizedUnit {
+	units := []normalizedUnit{}
+
+	for _, seg := range segments {
+		key := normalizeSegment(seg.text, profile)
+		if key == "" && profile != PROFILE_STRICT {
+			continue
+		}
+		units = append(units, normalizedUnit{key: key, start: seg.start, end: seg.end})
+	}
+
+	return units
+}
+
+// normalizeSegment normalizes a word or line the same way normalizeChars
+// normalizes characters, but all at once: composed (NFC) with PROFILE_STRICT,
+// see looseNormalize for PROFILE_UNICODE_LOOSE, and see asciiNormalize for
+// PROFILE_ASCII (or an unknown profile).
+func normalizeSegment(text string, profile string) string {
+	switch profile {
+	case PROFILE_STRICT:
+		return norm.NFC.String(text)
+	case PROFILE_UNICODE_LOOSE:
+		return looseNormalize(text)
+	default:
+		return asciiNormalize(text)
+	}
+}
+
+// asciiNormalize does the clean up for PROFILE_ASCII: lowercase the text, then
+// remove everything except ASCII letters, digits, underscores, and newlines.
+func asciiNormalize(text string) string {
+	var sb strings.Builder
+	for _, b := range []byte(strings.ToLower(text)) {
+		if b == '_' || b == '\n' || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// looseNormalize does the clean up for PROFILE_UNICODE_LOOSE. Text is
+// recomposed (NFC) at the end, so scripts which decompose into several letters
+// (like Hangul) are compared as whole characters again.
+func looseNormalize(text string) string {
+	text = norm.NFKD.String(text)
+
+	var sb strings.Builder
+	for _, r := range foldCase(text) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			sb.WriteRune(r)
+		}
+		// everything else, including the combining marks (diacritics) left
+		// over from decomposing, is dropped
+	}
+
+	return norm.NFC.String(sb.String())
+}
+
+// foldCase applies Unicode case folding to text. A cases.Caser is not safe for
+// concurrent use, so each call gets its own.
+func foldCase(text string) string {
+	return cases.Fold().String(text)
+}
+
+// unitsArePalindrome checks if normalized text reads the same forwards and
+// backwards. It returns P_UNKNOWN if there's nothing to compare.
+func unitsArePalindrome(units []normalizedUnit) int {
+	if len(units) == 0 {
+		return P_UNKNOWN
+	}
+
+	for i := 0; i < len(units)/2; i++ {
+		if units[i].key != units[len(units)-i-1].key {
+			return P_FALSE
+		}
+	}
+
+	return P_TRUE
+}
+
+// Graphemes splits text into (roughly) user-perceived characters: a rune along
+// with any combining marks, variation selectors, and emoji modifiers after it,
+// emoji joined with a zero width joiner, pairs of regional indicators (flags),
+// and "\r\n". It's a simplification of extended grapheme clusters (Unicode
+// Standard Annex #29), but it's enough to reverse text without breaking up
+// characters.
+func Graphemes(text string) []string {
+	runes := []rune(text)
+	out := []string{}
+
+	for i := 0; i < len(runes); {
+		start := i
+		i++
+
+		switch {
+		case runes[start] == '\r' && i < len(runes) && runes[i] == '\n':
+			i++
+		case isRegionalIndicator(runes[start]) && i < len(runes) && isRegionalIndicator(runes[i]):
+			i++
+		}
+
+		for i < len(runes) {
+			if unicode.Is(unicode.M, runes[i]) || isEmojiModifier(runes[i]) {
+				i++
+			} else if runes[i] == zeroWidthJoiner {
+				// the joiner, and whatever it joins on to
+				i = min(i+2, len(runes))
+			} else {
+				break
+			}
+		}
+
+		out = append(out, string(runes[start:i]))
+	}
+
+	return out
+}
+
+const zeroWidthJoiner = '\u200d'
+
+// isRegionalIndicator returns true for the letters used in pairs to make flags.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// isEmojiModifier returns true for the skin tone modifiers.
+func isEmojiModifier(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTextIsPalindrome(t *testing.T) {
+	cases := []struct {
+		text     string
+		profile  string
+		expected int
+	}{
+		{"Racecar", PROFILE_ASCII, P_TRUE},
+		{"Racecar", PROFILE_STRICT, P_FALSE},
+		{"racecar", PROFILE_STRICT, P_TRUE},
+		{"ab ba", PROFILE_STRICT, P_TRUE},
+		{"ab, ba", PROFILE_STRICT, P_FALSE},
+		{"Ésope reste ici et se repose", PROFILE_UNICODE_LOOSE, P_TRUE},
+		{"Ésope reste ici et se repose", PROFILE_STRICT, P_FALSE},
+		{"А роза упала на лапу Азора", PROFILE_UNICODE_LOOSE, P_TRUE},
+		{"上海自来水来自海上", PROFILE_UNICODE_LOOSE, P_TRUE},
+		{"上海自来水来自海上", PROFILE_STRICT, P_TRUE},
+		{"ＲＡＣＥ ｃａｒ", PROFILE_UNICODE_LOOSE, P_TRUE},
+		{"e\u0301te\u0301", PROFILE_STRICT, P_TRUE},
+		{"e\u0301te", PROFILE_STRICT, P_FALSE},
+		{"\u00e9e\u0301", PROFILE_STRICT, P_TRUE},
+		{"e\u0301te", PROFILE_UNICODE_LOOSE, P_TRUE},
+		{"!!!", PROFILE_UNICODE_LOOSE, P_UNKNOWN},
+		{"", PROFILE_STRICT, P_UNKNOWN},
+		{"hello", PROFILE_UNICODE_LOOSE, P_FALSE},
+	}
+
+	for _, c := range cases {
+		if result := TextIsPalindrome(c.text, PSettings{profile: c.profile}); result != c.expected {
+			t.Fatalf(`TextIsPalindrome(%q, %s) = %d, want %d`, c.text, c.profile, result, c.expected)
+		}
+	}
+}
+
+func TestGraphemes(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"e\u0301a", []string{"e\u0301", "a"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+		{"🇨🇦🇫🇷", []string{"🇨🇦", "🇫🇷"}},
+		{"👍🏽!", []string{"👍🏽", "!"}},
+		{"👩‍💻x", []string{"👩‍💻", "x"}},
+	}
+
+	for _, c := range cases {
+		if result := Graphemes(c.text); !slices.Equal(result, c.expected) {
+			t.Fatalf(`Graphemes(%q) = %q, want %q`, c.text, result, c.expected)
+		}
+	}
+}
+
+func TestTextIsPalindromeModes(t *testing.T) {
+	cases := []struct {
+		text     string
+		settings PSettings
+		expected int
+	}{
+		{"fall leaves after leaves fall", PSettings{mode: MODE_WORD}, P_TRUE},
+		{"fall leaves after leaves fall", PSettings{mode: MODE_CHAR}, P_FALSE},
+		{"Fall, leaves after leaves fall.", PSettings{mode: MODE_WORD}, P_TRUE},
+		{"Fall, leaves after leaves fall.", PSettings{profile: PROFILE_STRICT, mode: MODE_WORD}, P_FALSE},
+		{"you  can cage a swallow, can't you? - but you can't swallow a cage, can you", PSettings{mode: MODE_WORD}, P_TRUE},
+		{"Élan vital élan", PSettings{profile: PROFILE_UNICODE_LOOSE, mode: MODE_WORD}, P_TRUE},
+		{"racecar", PSettings{mode: MODE_WORD}, P_TRUE},
+		{"ab ba", PSettings{mode: MODE_WORD}, P_FALSE},
+		{"one\ntwo\n\nthree\n\ntwo\nOne!\n", PSettings{mode: MODE_LINE}, P_TRUE},
+		{"one\r\ntwo\r\none", PSettings{profile: PROFILE_STRICT, mode: MODE_LINE}, P_TRUE},
+		{"one\ntwo\none\n", PSettings{profile: PROFILE_STRICT, mode: MODE_LINE}, P_FALSE},
+		{"one\ntwo\nthree", PSettings{mode: MODE_LINE}, P_FALSE},
+		{" \n\n", PSettings{mode: MODE_LINE}, P_UNKNOWN},
+		{"", PSettings{mode: MODE_WORD}, P_UNKNOWN},
+	}
+
+	for _, c := range cases {
+		if result := TextIsPalindrome(c.text, c.settings); result != c.expected {
+			t.Fatalf(`TextIsPalindrome(%q, %+v) = %d, want %d`, c.text, c.settings, result, c.expected)
+		}
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	for _, profile := range append([]string{""}, PROFILES...) {
+		for _, mode := range append([]string{""}, MODES...) {
+			settings, err := ParseSettings(profile, mode)
+			if err != nil {
+				t.Fatalf(`ParseSettings(%q, %q) has err %+v, want nil`, profile, mode, err)
+			}
+			if settings.profile != profile || settings.mode != mode {
+				t.Fatalf(`ParseSettings(%q, %q) = %+v, want profile %q and mode %q`, profile, mode, settings, profile, mode)
+			}
+		}
+	}
+
+	if _, err := ParseSettings("nope", ""); err == nil {
+		t.Fatalf(`ParseSettings("nope", "") has nil err, want error`)
+	}
+	if _, err := ParseSettings("", "nope"); err == nil {
+		t.Fatalf(`ParseSettings("", "nope") has nil err, want error`)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +17,35 @@ const (
 	P_FALSE   = 2
 )
 
+// PW_PENDING means palindrome work is waiting for a worker, PW_RUNNING that a
+// worker is calculating it, and PW_DONE that the result is known. PW_CANCELLED
+// means work was stopped before it finished (without being removed), and
+// PW_FAILED that something went wrong while calculating.
+const (
+	PW_PENDING   = 0
+	PW_RUNNING   = 1
+	PW_DONE      = 2
+	PW_CANCELLED = 3
+	PW_FAILED    = 4
+)
+
+// PWStatusToString converts a PW_ status into the string used in JSON
+// payloads: "pending", "running", "done", "cancelled", or "failed".
+func PWStatusToString(status int) string {
+	switch status {
+	case PW_RUNNING:
+		return "running"
+	case PW_DONE:
+		return "done"
+	case PW_CANCELLED:
+		return "cancelled"
+	case PW_FAILED:
+		return "failed"
+	default:
+		return "pending"
+	}
+}
+
 // PStatusToBoolPointer converts P_UNKNOWN to nil, P_TRUE to true, and P_FALSE
 // to false.
 func PStatusToBoolPointer(status int) *bool {
@@ -37,6 +67,7 @@ func PStatusToBoolPointer(status int) *bool {
 // StringIsPalindrome returns P_UNKNOWN if the string is empty, P_TRUE if it is
 // a palindrome, and P_FALSE if it is not. It's case-insensitive and only
 // considers alphanumeric characters (whitespace and punctuation are ignored).
+// This is PROFILE_ASCII, see TextIsPalindrome for the other profiles.
 func StringIsPalindrome(s string) int {
 	if len(s) == 0 {
 		return P_UNKNOWN
@@ -59,34 +90,232 @@ func StringIsPalindrome(s string) int {
 	return P_TRUE
 }
 
-// doWork is a Palindromes method that calculates if a message is a palindrome.
+// AnalyzeText finds the longest palindromic substring of some text, and counts
+// its maximal palindromic substrings, after normalizing it according to
+// settings (see normalizeUnits). With MODE_WORD or MODE_LINE, substrings are
+// made of whole words or lines. If several substrings are the longest, the
+// first one wins. It takes linear time (see manacher).
+func AnalyzeText(text string, settings PSettings) PAnalysis {
+	units := normalizeUnits(text, settings.withDefaults())
+	if len(units) == 0 {
+		return PAnalysis{}
+	}
+
+	// compare small integers instead of strings
+	ids := make([]int, len(units))
+	seen := make(map[string]int)
+	for i, u := range units {
+		id, ok := seen[u.key]
+		if !ok {
+			id = len(seen)
+			seen[u.key] = id
+		}
+		ids[i] = id
+	}
+
+	odd, even := manacher(ids)
+
+	// every position is the center of exactly one maximal odd-length
+	// palindrome (at least the character itself), and maybe of one maximal
+	// even-length palindrome
+	out := PAnalysis{maximalCount: len(ids)}
+	first, last := 0, 0
+	for i := range ids {
+		if length := 2*odd[i] - 1; length > out.longestLength {
+			out.longestLength = length
+			first, last = i-odd[i]+1, i+odd[i]-1
+		}
+		if even[i] > 0 {
+			out.maximalCount++
+			if length := 2 * even[i]; length > out.longestLength {
+				out.longestLength = length
+				first, last = i-even[i], i+even[i]-1
+			}
+		}
+	}
+	out.longestStart = units[first].start
+	out.longestEnd = units[last].end
+
+	return out
+}
+
+// manacher is Manacher's algorithm: for every position i in s, it finds the
+// longest palindrome centered there in linear time. odd[i] is the radius of the
+// longest odd-length palindrome centered on s[i] (it's 2*odd[i]-1 long), and
+// even[i] is the radius of the longest even-length palindrome centered just
+// before s[i] (it's 2*even[i] long).
+func manacher(s []int) (odd []int, even []int) {
+	n := len(s)
+	odd = make([]int, n)
+	even = make([]int, n)
+
+	// [l, r) is the right-most palindrome found so far
+	for i, l, r := 0, 0, 0; i < n; i++ {
+		k := 1
+		if i < r {
+			k = min(odd[l+r-1-i], r-i)
+		}
+		for i-k >= 0 && i+k < n && s[i-k] == s[i+k] {
+			k++
+		}
+		odd[i] = k
+		if i+k > r {
+			l, r = i-k+1, i+k
+		}
+	}
+
+	for i, l, r := 0, 0, 0; i < n; i++ {
+		k := 0
+		if i < r {
+			k = min(even[l+r-i], r-i)
+		}
+		for i-k-1 >= 0 && i+k < n && s[i-k-1] == s[i+k] {
+			k++
+		}
+		even[i] = k
+		if i+k > r {
+			l, r = i-k, i+k
+		}
+	}
+
+	return odd, even
+}
+
+// NEAR_MAX_UNITS is the longest text (in normalized units, see normalizeUnits)
+// that AnalyzeNearness will look at. It takes quadratic time and memory, so
+// anything longer is skipped.
+const NEAR_MAX_UNITS = 2000
+
+// AnalyzeNearness works out how close some text is to being a palindrome (see
+// PNearness), after normalizing it according to settings. It takes quadratic
+// time: the fewest insertions are found by finding the longest palindromic
+// subsequence, with dynamic programming. It checks cancel as it goes, and
+// returns false if it should stop early.
+func AnalyzeNearness(text string, settings PSettings, cancel <-chan bool) (PNearness, bool) {
+	settings = settings.withDefaults()
+	units := normalizeUnits(text, settings)
+	n := len(units)
+	if n == 0 || n > NEAR_MAX_UNITS {
+		return PNearness{}, true
+	}
+
+	out := PNearness{computed: true}
+	for i := 0; i < n/2; i++ {
+		if units[i].key != units[n-1-i].key {
+			out.substitutions++
+		}
+	}
+
+	// lps[i][j] is the length of the longest palindromic subsequence of
+	// units[i] to units[j] (inclusive)
+	lps := make([][]uint16, n)
+	for i := n - 1; i >= 0; i-- {
+		select {
+		case <-cancel:
+			return PNearness{}, false
+		default:
+		}
+
+		lps[i] = make([]uint16, n)
+		lps[i][i] = 1
+		for j := i + 1; j < n; j++ {
+			if units[i].key == units[j].key {
+				lps[i][j] = lps[i+1][j-1] + 2
+			} else {
+				lps[i][j] = max(lps[i+1][j], lps[i][j-1])
+			}
+		}
+	}
+
+	out.insertions = n - int(lps[0][n-1])
+	out.score = float64(lps[0][n-1]) / float64(n)
+
+	// walk back through lps, keeping every unit and mirroring the ones which
+	// aren't part of the palindromic subsequence
+	left := []string{}
+	right := []string{}
+	middle := []string{}
+	for i, j := 0, n-1; i <= j; {
+		switch {
+		case i == j:
+			middle = append(middle, units[i].key)
+			i++
+		case units[i].key == units[j].key:
+			left = append(left, units[i].key)
+			right = append(right, units[j].key)
+			i++
+			j--
+		case lps[i+1][j] >= lps[i][j-1]:
+			left = append(left, units[i].key)
+			right = append(right, units[i].key)
+			i++
+		default:
+			left = append(left, units[j].key)
+			right = append(right, units[j].key)
+			j--
+		}
+	}
+	slices.Reverse(right)
+	out.repaired = strings.Join(slices.Concat(left, middle, right), modeSeparator(settings.mode))
+
+	return out, true
+}
+
+// modeSeparator is what goes between units when they're joined back together:
+// nothing for characters, a space for words, and a newline for lines.
+func modeSeparator(mode string) string {
+	switch mode {
+	case MODE_WORD:
+		return " "
+	case MODE_LINE:
+		return "\n"
+	default:
+		return ""
+	}
+}
+
+// ArtificialDelay returns how long doWork should pretend to take: S_DELAY
+// seconds, or 0 if S_DELAY is not set (or isn't a positive integer).
+func ArtificialDelay() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("S_DELAY")); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+
+	return 0
+}
+
+// doWork is a Palindromes method that calculates if a message is a palindrome,
+// using the message's normalization profile, and analyzes the palindromes
+// inside it (and how close it is to being one). Or rather, it runs whichever
+// Analyzer the Palindromes has, which is PalindromeAnalyzer by default.
 // Once completed, it saves the result and updates all listeners. It's safe to
-// to run concurrently.
+// to run concurrently, and is called by Palindromes workers.
 //
 // doWork can be artificially slowed down, and will take as long as S_DELAY
 // seconds (default 0) to complete. It's also cancellable, and checks 4 times
-// during S_DELAY to see if it should stop early. If stopped early, it leaves
-// Palindromes as-is and does not send any updates to listeners.
+// during S_DELAY (and while the analyzer is working, see Analyzer.Analyze) to
+// see if it should stop early. If stopped early, it leaves Palindromes as-is
+// and does not send any updates to listeners.
 func (p *Palindromes) doWork(msg Message) {
-	isPalindrome := StringIsPalindrome(msg.text)
+	p.lock.RLock()
+	work, ok := p.work[msg.hash]
+	p.lock.RUnlock()
+	if !ok {
+		return
+	}
 
-	newResult := PWResult{
-		isPalindrome: isPalindrome,
-		done:         true,
+	newResult, ok := p.analyzer.Analyze(msg, work.cancel)
+	if !ok {
+		return
 	}
 
 	// pretend this is really slow
-	var delay float64 = 0
-	delay_str := os.Getenv("S_DELAY")
-	if v, err := strconv.Atoi(delay_str); err == nil && v > 0 {
-		delay = float64(v)
-	}
+	delay := ArtificialDelay()
 
 	if delay > 0 {
 		// check if we should stop work early, four times during the artificial delay
-		ms_delay := delay / 4 * 1000
 		for i := 0; i < 4; i++ {
-			time.Sleep(time.Duration(ms_delay) * time.Millisecond)
+			time.Sleep(delay / 4)
 
 			p.lock.Lock()
 			work, ok := p.work[msg.hash]
@@ -106,17 +335,5 @@ func (p *Palindromes) doWork(msg Message) {
 	}
 
 	// update work
-	p.lock.Lock()
-	if work, ok := p.work[msg.hash]; ok {
-		work.result = newResult
-		p.work[msg.hash] = work
-		for _, listener := range work.listeners {
-			// write asynchronously
-			select {
-			case listener <- newResult:
-			default:
-			}
-		}
-	}
-	p.lock.Unlock()
+	p.setResult(msg.hash, newResult)
 }
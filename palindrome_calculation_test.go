@@ -63,3 +63,123 @@ func TestPalindromeStatusToBoolPointerCaseFalse(t *testing.T) {
 		t.Fatalf(`*PStatusToBoolPointer(P_FALSE) = %t, want %t`, *result, false)
 	}
 }
+
+func TestPWStatusToString(t *testing.T) {
+	cases := map[int]string{
+		PW_PENDING:   "pending",
+		PW_RUNNING:   "running",
+		PW_DONE:      "done",
+		PW_CANCELLED: "cancelled",
+		PW_FAILED:    "failed",
+	}
+
+	for status, expected := range cases {
+		if result := PWStatusToString(status); result != expected {
+			t.Fatalf(`PWStatusToString(%d) = %s, want %s`, status, result, expected)
+		}
+	}
+}
+
+func TestAnalyzeText(t *testing.T) {
+	cases := []struct {
+		text     string
+		profile  string
+		expected PAnalysis
+	}{
+		{"", PROFILE_ASCII, PAnalysis{}},
+		{"!!!", PROFILE_ASCII, PAnalysis{}},
+		{"abacaba", PROFILE_ASCII, PAnalysis{longestStart: 0, longestEnd: 7, longestLength: 7, maximalCount: 7}},
+		{"aaa", PROFILE_STRICT, PAnalysis{longestStart: 0, longestEnd: 3, longestLength: 3, maximalCount: 5}},
+		{"xy abba!", PROFILE_ASCII, PAnalysis{longestStart: 3, longestEnd: 7, longestLength: 4, maximalCount: 7}},
+		// offsets are in the original text, even though "É" and "!" are dropped
+		{"¡Éte té!", PROFILE_UNICODE_LOOSE, PAnalysis{longestStart: 1, longestEnd: 7, longestLength: 5, maximalCount: 5}},
+	}
+
+	for _, c := range cases {
+		if result := AnalyzeText(c.text, PSettings{profile: c.profile}); result != c.expected {
+			t.Fatalf(`AnalyzeText(%q, %s) = %+v, want %+v`, c.text, c.profile, result, c.expected)
+		}
+	}
+
+	// whole words, offsets still in runes
+	words := "so fall leaves after leaves fall"
+	expected := PAnalysis{longestStart: 3, longestEnd: 32, longestLength: 5, maximalCount: 6}
+	if result := AnalyzeText(words, PSettings{mode: MODE_WORD}); result != expected {
+		t.Fatalf(`AnalyzeText(%q, word) = %+v, want %+v`, words, result, expected)
+	}
+}
+
+func TestAnalyzeNearness(t *testing.T) {
+	cases := []struct {
+		text     string
+		settings PSettings
+		expected PNearness
+	}{
+		{"", PSettings{}, PNearness{}},
+		{"Racecar", PSettings{}, PNearness{computed: true, repaired: "racecar", score: 1}},
+		{"ab", PSettings{}, PNearness{computed: true, insertions: 1, substitutions: 1, repaired: "aba", score: 0.5}},
+		{"abcd", PSettings{}, PNearness{computed: true, insertions: 3, substitutions: 2, repaired: "abcdcba", score: 0.25}},
+		{"google", PSettings{}, PNearness{computed: true, insertions: 2, substitutions: 3, repaired: "elgoogle", score: 4.0 / 6}},
+		{"fall leaves after fall", PSettings{mode: MODE_WORD}, PNearness{computed: true, insertions: 1, substitutions: 1, repaired: "fall leaves after leaves fall", score: 0.75}},
+	}
+
+	for _, c := range cases {
+		result, ok := AnalyzeNearness(c.text, c.settings, nil)
+		if !ok || result != c.expected {
+			t.Fatalf(`AnalyzeNearness(%q, %+v) = %+v, %t, want %+v, true`, c.text, c.settings, result, ok, c.expected)
+		}
+	}
+}
+
+func TestAnalyzeNearnessRepaired(t *testing.T) {
+	texts := []string{"abcba", "abca", "aabbcc", "palindrome", "xyzzyxq", "mississippi"}
+	for _, text := range texts {
+		result, _ := AnalyzeNearness(text, PSettings{}, nil)
+		if len(result.repaired) != len(text)+result.insertions {
+			t.Fatalf(`AnalyzeNearness(%q) repaired = %q, want %d characters long`, text, result.repaired, len(text)+result.insertions)
+		}
+		if StringIsPalindrome(result.repaired) != P_TRUE {
+			t.Fatalf(`AnalyzeNearness(%q) repaired = %q, want a palindrome`, text, result.repaired)
+		}
+	}
+}
+
+func TestAnalyzeNearnessCancel(t *testing.T) {
+	cancel := make(chan bool, 1)
+	cancel <- true
+	if _, ok := AnalyzeNearness("hello", PSettings{}, cancel); ok {
+		t.Fatalf(`AnalyzeNearness() after cancel = true, want false`)
+	}
+}
+
+func TestManacher(t *testing.T) {
+	// compare against expanding around every center, for every string of 0s
+	// and 1s up to 10 long
+	for n := 1; n <= 10; n++ {
+		for bits := 0; bits < 1<<n; bits++ {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = (bits >> i) & 1
+			}
+
+			odd, even := manacher(s)
+			for i := range s {
+				k := 1
+				for i-k >= 0 && i+k < n && s[i-k] == s[i+k] {
+					k++
+				}
+				if odd[i] != k {
+					t.Fatalf(`manacher(%v) odd[%d] = %d, want %d`, s, i, odd[i], k)
+				}
+
+				k = 0
+				for i-k-1 >= 0 && i+k < n && s[i-k-1] == s[i+k] {
+					k++
+				}
+				if even[i] != k {
+					t.Fatalf(`manacher(%v) even[%d] = %d, want %d`, s, i, even[i], k)
+				}
+			}
+		}
+	}
+}
@@ -1,30 +1,96 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Palindromes implements WorkOrchestrator. The "work" it does is determining if
-// a string is a palindrome. It stores everything in-memory (is not persistent).
-// It's safe for concurrent use.
+// a string is a palindrome (or running some other Analyzer, see
+// NewAnalyzerWork). It stores everything in-memory (is not persistent). It's
+// safe for concurrent use.
 // 
-// If two messages have the same text, they will have the same hash, and share
-// the same PalindromeWork. They will each have their own listener (a channel
-// which receives a message everytime result changes). If all messages with the
-// same hash are removed, the corresponding PalindromeWork is removed. Old work
-// is not cached.
+// If two messages have the same text and settings (profile and mode), they will
+// have the same hash (see MessageHash), and share the same PalindromeWork. They
+// will each have their own listener (a channel which receives a message
+// everytime result changes). If all messages with the same hash are removed,
+// the corresponding PalindromeWork is removed. If there's a ResultCache,
+// finished results are kept in it, and Add checks it before queueing up new
+// work: old work is cached.
+//
+// Work is done by a fixed number of worker goroutines, which take messages from
+// a bounded FIFO queue. If the queue is full, Add refuses new work with a
+// QueueFullError instead of letting it pile up. The workers stop after
+// Shutdown.
 type Palindromes struct {
 	lock sync.RWMutex
 	work map[string]PalindromeWork
+	// messages waiting for a worker, oldest first. There's at most one entry
+	// per hash.
+	queue      []Message
+	queueDepth int
+	workers    int
+	// does the actual work, see doWork
+	analyzer Analyzer
+	// finished results, can be nil
+	cache *ResultCache
+	// signalled whenever a message is added to queue
+	queued *sync.Cond
+	// how many workers are in the middle of doing work
+	running int
+	// set by Shutdown, workers stop once the queue is empty
+	closing bool
+	// for metrics, see WorkStats
+	dedupeHits    int
+	cancellations int
+	durations     *histogram
+}
+
+// QueueFullError is returned by Palindromes.Add when there's no room in the
+// queue for new work. RetryAfter is a rough guess of how long it will take for
+// room to free up.
+type QueueFullError struct {
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("work queue is full, retry after %s", e.RetryAfter)
+}
+
+// NewPalindromes creates a new Palindromes struct with no work, and starts
+// `workers` worker goroutines. At most `queueDepth` pieces of work can be
+// waiting for a worker at any one time. Both must be at least 1.
+func NewPalindromes(workers int, queueDepth int) *Palindromes {
+	return NewAnalyzerWork(PalindromeAnalyzer{}, workers, queueDepth, nil)
 }
 
-// NewPalindromes creates a new Palindromes struct with no work.
-func NewPalindromes() Palindromes {
-	return Palindromes{
-		lock: sync.RWMutex{},
-		work: make(map[string]PalindromeWork),
+// NewAnalyzerWork is like NewPalindromes, but the work is done by any
+// Analyzer instead of PalindromeAnalyzer, and finished results are kept in
+// cache (unless it's nil).
+func NewAnalyzerWork(analyzer Analyzer, workers int, queueDepth int, cache *ResultCache) *Palindromes {
+	p := &Palindromes{
+		lock:       sync.RWMutex{},
+		work:       make(map[string]PalindromeWork),
+		queue:      []Message{},
+		queueDepth: max(queueDepth, 1),
+		workers:    max(workers, 1),
+		analyzer:   analyzer,
+		cache:      cache,
+		durations:  newHistogram(WORK_DURATION_BUCKETS),
 	}
+	p.queued = sync.NewCond(&p.lock)
+
+	for i := 0; i < p.workers; i++ {
+		go p.worker()
+	}
+
+	return p
 }
 
 // PalindromeWork holds all the information necessary to determine if a string
@@ -34,25 +100,27 @@ func NewPalindromes() Palindromes {
 type PalindromeWork struct {
 	hash      string
 	result    PWResult
-	// key: message id, value: a channel, receives updates when result changes
-	listeners map[int]chan PWResult
+	// key: message (of any tenant), value: a channel, receives updates when
+	// result changes
+	listeners map[MessageRef]chan PWResult
 	// Used to abort work early
 	cancel    chan bool
+	// when the work was added
+	created   time.Time
 }
 
-// Add takes in a Message, kicks off work on calculating if it's a palindrome 
+// Add takes in a Message, queues up work on calculating if it's a palindrome
 // (if work hasn't already started / been completed), and returns a
 // PalindromeWorkKey (which can be used to delete work or poll progress), the
-// current state of work (may be complete or in progress), a channel which will
-// receive updates when the state of work changes, and an error. In practice,
-// this method will never error. The onChange channel is unique per message id.
-// This method is safe for concurrent use. If there is work to do, it calls
-// doWork in new a goroutine.
+// current state of work (may be complete, in progress, or queued), a channel
+// which will receive updates when the state of work changes, and an error. The
+// only possible error is a *QueueFullError, if there's new work to do but the
+// queue is full; in that case nothing is added. The onChange channel is unique
+// per message (tenant and id), but work is shared by every message with the
+// same hash, whichever tenant it's in. This method is safe for concurrent use.
 func (p *Palindromes) Add(msg Message) (key PWKey, current PWResult, onChange <-chan PWResult, err error) {
-	key = PWKey{
-		hash:      msg.hash,
-		messageId: msg.id,
-	}
+	key = PWorkKeyFromMsg(msg)
+	ref := msg.ref()
 
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -60,29 +128,55 @@ func (p *Palindromes) Add(msg Message) (key PWKey, current PWResult, onChange <-
 
 	if ok {
 		onChange := make(chan PWResult, 1)
-		if listener, ok := work.listeners[msg.id]; ok {
+		if listener, ok := work.listeners[ref]; ok {
 			onChange = listener
 		} else {
-			work.listeners[msg.id] = onChange
+			// another message has the same hash, so the work is shared
+			work.listeners[ref] = onChange
+			p.dedupeHits++
+		}
+
+		return key, p.withQueuePosition(work.result, msg.hash), onChange, nil
+	}
+
+	// maybe this work was done before
+	if p.cache != nil {
+		if cached, ok := p.cache.Get(msg.hash); ok {
+			work = PalindromeWork{
+				hash:      msg.hash,
+				listeners: map[MessageRef]chan PWResult{ref: make(chan PWResult, 1)},
+				result:    cached,
+				cancel:    make(chan bool, 1),
+				created:   time.Now(),
+			}
+			p.work[msg.hash] = work
+
+			return key, work.result, work.listeners[ref], nil
 		}
+	}
 
-		return key, work.result, onChange, nil
+	if len(p.queue) >= p.queueDepth {
+		return key, PWResult{}, nil, &QueueFullError{RetryAfter: p.estimateWait()}
 	}
 
 	work = PalindromeWork{
 		hash:     msg.hash,
-		listeners: map[int]chan PWResult{msg.id: make(chan PWResult, 1)},
+		listeners: map[MessageRef]chan PWResult{ref: make(chan PWResult, 1)},
 		result: PWResult{
 			isPalindrome: P_UNKNOWN,
+			status:       PW_PENDING,
 			done:         false,
+			settings:     msg.settings,
 		},
 		cancel: make(chan bool, 1),
+		created: time.Now(),
 	}
 	p.work[msg.hash] = work
 
-	go p.doWork(msg)
+	p.queue = append(p.queue, msg)
+	p.queued.Signal()
 
-	return key, work.result, work.listeners[0], nil
+	return key, p.withQueuePosition(work.result, msg.hash), work.listeners[ref], nil
 }
 
 // Remove is used to cancel or delete work. If work is in progress and no other
@@ -95,16 +189,20 @@ func (p *Palindromes) Remove(key PWKey) error {
 	defer p.lock.Unlock()
 
 	if work, ok := p.work[key.hash]; ok {
-		listener, ok := work.listeners[key.messageId]
+		listener, ok := work.listeners[key.ref()]
 		if !ok {
 			return errors.New("Not found")
 		}
 
 		close(listener)
-		delete(work.listeners, key.messageId)
+		delete(work.listeners, key.ref())
 
 		if len(work.listeners) == 0 {
 			delete(p.work, key.hash)
+			p.dequeue(key.hash)
+			if !work.result.done {
+				p.cancellations++
+			}
 			// write asynchronously
 			select {
 			case work.cancel <- true:
@@ -122,22 +220,184 @@ func (p *Palindromes) Remove(key PWKey) error {
 // method is safe for concurrent use.
 //
 // If work corresponding to the key's hash is found, but there is no listener
-// for the key's messageId, then found is true but onChange is nil. No listener
+// for the key's message, then found is true but onChange is nil. No listener
 // is added.
 func (p *Palindromes) Poll(key PWKey) (found bool, current PWResult, onChange <-chan PWResult, err error) {
 	p.lock.RLock()
+	defer p.lock.RUnlock()
 	work, ok := p.work[key.hash]
-	p.lock.RUnlock()
 
 	if !ok {
 		return false, PWResult{}, nil, nil
 	}
 
-	if onChange, ok = work.listeners[key.messageId]; !ok {
-		return true, work.result, nil, nil
+	current = p.withQueuePosition(work.result, key.hash)
+	if onChange, ok = work.listeners[key.ref()]; !ok {
+		return true, current, nil, nil
 	} else {
-		return true, work.result, onChange, nil
+		return true, current, onChange, nil
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks if the workers are done,
+// while it's draining.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the workers. If drain is true, it first waits for the queue to
+// empty and running work to finish, or for ctx to be done, whichever comes
+// first. Any work left unfinished is then cancelled: its cancel channel is
+// signalled, its result becomes PW_CANCELLED (and done), and its listeners are
+// updated. Results and listeners are kept, so messages can still be polled.
+// Work added after Shutdown will never be done. It returns ctx's error if ctx
+// was done before draining finished. This method is safe for concurrent use.
+func (p *Palindromes) Shutdown(ctx context.Context, drain bool) error {
+	p.lock.Lock()
+	p.closing = true
+	// wake up idle workers, so they can stop
+	p.queued.Broadcast()
+	p.lock.Unlock()
+
+	var err error
+	if drain {
+		ticker := time.NewTicker(shutdownPollInterval)
+		defer ticker.Stop()
+
+		for !p.idle() && err == nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.queue = []Message{}
+	for hash, work := range p.work {
+		if work.result.done {
+			continue
+		}
+
+		// write asynchronously
+		select {
+		case work.cancel <- true:
+		default:
+		}
+
+		p.cancellations++
+		work.result.status = PW_CANCELLED
+		work.result.done = true
+		work.result.queuePosition = 0
+		p.work[hash] = work
+		notifyListeners(work)
+	}
+
+	return err
+}
+
+// WorkStats is a snapshot of what a Palindromes is doing, for metrics. Work is
+// the number of PalindromeWork entries by result status (PW_PENDING, etc.),
+// listeners is the number of listeners across all of them, queued and running
+// are how many are waiting for a worker or being worked on (out of queueDepth
+// and workers), and closing is true after Shutdown. DedupeHits counts
+// how many times Add found work it could share with another message (with the
+// same hash), cancellations how many times unfinished work was cancelled, and
+// durations how long each call to doWork took, in seconds.
+type WorkStats struct {
+	work          map[int]int
+	listeners     int
+	queued        int
+	queueDepth    int
+	running       int
+	workers       int
+	closing       bool
+	dedupeHits    int
+	cancellations int
+	durations     histogram
+}
+
+// WorkStatsReporter is implemented by WorkOrchestrators which keep track of
+// WorkStats (like Palindromes).
+type WorkStatsReporter interface {
+	WorkStats() WorkStats
+}
+
+// WorkStats returns a snapshot of what the Palindromes is doing (see
+// WorkStats). It implements WorkStatsReporter. This method is safe for
+// concurrent use.
+func (p *Palindromes) WorkStats() WorkStats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	stats := WorkStats{
+		work:          make(map[int]int),
+		queued:        len(p.queue),
+		queueDepth:    p.queueDepth,
+		running:       p.running,
+		workers:       p.workers,
+		closing:       p.closing,
+		dedupeHits:    p.dedupeHits,
+		cancellations: p.cancellations,
+		durations:     p.durations.clone(),
+	}
+	for _, work := range p.work {
+		stats.work[work.result.status]++
+		stats.listeners += len(work.listeners)
+	}
+
+	return stats
+}
+
+// WorkState describes a single PalindromeWork, for debugging: its hash,
+// current result, the messages listening to it (sorted by tenant, then id), and
+// when it was added.
+type WorkState struct {
+	hash      string
+	result    PWResult
+	listeners []MessageRef
+	created   time.Time
+}
+
+// WorkStateReporter is implemented by WorkOrchestrators which can describe
+// each piece of their work (like Palindromes).
+type WorkStateReporter interface {
+	WorkStates() []WorkState
+}
+
+// WorkStates describes every PalindromeWork, sorted by hash. It implements
+// WorkStateReporter. This method is safe for concurrent use.
+func (p *Palindromes) WorkStates() []WorkState {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	out := make([]WorkState, 0, len(p.work))
+	for hash, work := range p.work {
+		state := WorkState{
+			hash:      hash,
+			result:    p.withQueuePosition(work.result, hash),
+			listeners: make([]MessageRef, 0, len(work.listeners)),
+			created:   work.created,
+		}
+		for ref := range work.listeners {
+			state.listeners = append(state.listeners, ref)
+		}
+		slices.SortFunc(state.listeners, CompareMessageRefs)
+		out = append(out, state)
 	}
+	slices.SortFunc(out, func(a, b WorkState) int {
+		return strings.Compare(a.hash, b.hash)
+	})
+
+	return out
+}
+
+// idle returns true if there's no work queued or running.
+func (p *Palindromes) idle() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.queue) == 0 && p.running == 0
 }
 
 // Clear is used to immediately cancel and remove all work and listeners. This
@@ -150,6 +410,9 @@ func (p *Palindromes) Clear() error {
 		for _, listener := range work.listeners {
 			close(listener)
 		}
+		if !work.result.done {
+			p.cancellations++
+		}
 
 		// write asynchronously
 		select {
@@ -160,6 +423,139 @@ func (p *Palindromes) Clear() error {
 	}
 
 	p.work = make(map[string]PalindromeWork)
+	p.queue = []Message{}
 
 	return nil
 }
+
+// worker runs until Shutdown, taking messages off the front of the queue
+// (blocking until there is one) and calling doWork on them, one at a time.
+func (p *Palindromes) worker() {
+	for {
+		p.lock.Lock()
+		for len(p.queue) == 0 && !p.closing {
+			p.queued.Wait()
+		}
+		if len(p.queue) == 0 {
+			// shutting down, and there's nothing left to do
+			p.lock.Unlock()
+			return
+		}
+		msg := p.queue[0]
+		p.queue = p.queue[1:]
+		if work, ok := p.work[msg.hash]; ok {
+			work.result.status = PW_RUNNING
+			p.work[msg.hash] = work
+			notifyListeners(work)
+		}
+		p.running++
+		p.lock.Unlock()
+
+		start := time.Now()
+		p.runWork(msg)
+
+		p.lock.Lock()
+		p.running--
+		p.durations.observe(time.Since(start).Seconds())
+		p.lock.Unlock()
+	}
+}
+
+// runWork calls doWork, and if it panics, marks the work as failed instead of
+// taking down the whole server.
+func (p *Palindromes) runWork(msg Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("palindrome work for hash %s failed: %v\n", msg.hash, r)
+			p.setResult(msg.hash, PWResult{
+				isPalindrome: P_UNKNOWN,
+				status:       PW_FAILED,
+				done:         true,
+				settings:     msg.settings,
+			})
+		}
+	}()
+
+	p.doWork(msg)
+}
+
+// setResult saves the result of some work (if the work still exists, and
+// hasn't been cancelled) and updates all of its listeners.
+func (p *Palindromes) setResult(hash string, result PWResult) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if work, ok := p.work[hash]; ok {
+		if work.result.status == PW_CANCELLED {
+			// cancelled by Shutdown, the work didn't notice in time
+			return
+		}
+		work.result = result
+		p.work[hash] = work
+		notifyListeners(work)
+
+		if p.cache != nil && result.status == PW_DONE {
+			p.cache.Put(hash, result)
+		}
+	}
+}
+
+// ResultCache returns the cache of finished results, which is nil if there
+// isn't one. It implements ResultCacher.
+func (p *Palindromes) ResultCache() *ResultCache {
+	return p.cache
+}
+
+// notifyListeners sends work.result to every listener, without blocking. If a
+// listener already has an unread result waiting in its buffer, that result is
+// stale, so it's replaced: listeners always get the latest result. Must be
+// called with p.lock held.
+func notifyListeners(work PalindromeWork) {
+	for _, listener := range work.listeners {
+		// drop a stale result, if there is one
+		select {
+		case <-listener:
+		default:
+		}
+
+		// write asynchronously
+		select {
+		case listener <- work.result:
+		default:
+		}
+	}
+}
+
+// dequeue removes a hash from the queue, if it's there. Must be called with
+// p.lock held.
+func (p *Palindromes) dequeue(hash string) {
+	for i, msg := range p.queue {
+		if msg.hash == hash {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// withQueuePosition sets result.queuePosition to the 1-based position of hash
+// in the queue, or 0 if it's not queued (it's being worked on or it's done).
+// Must be called with p.lock held (for reading, at least).
+func (p *Palindromes) withQueuePosition(result PWResult, hash string) PWResult {
+	result.queuePosition = 0
+	for i, msg := range p.queue {
+		if msg.hash == hash {
+			result.queuePosition = i + 1
+			break
+		}
+	}
+
+	return result
+}
+
+// estimateWait guesses how long it will take for the queue to have room, based
+// on the artificial delay and the number of workers. It's never less than one
+// second. Must be called with p.lock held (for reading, at least).
+func (p *Palindromes) estimateWait() time.Duration {
+	wait := ArtificialDelay() * time.Duration(len(p.queue)) / time.Duration(p.workers)
+	return max(wait, time.Second)
+}
@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
 
 func newFakeMessage() Message {
 	return Message{
@@ -11,7 +17,7 @@ func newFakeMessage() Message {
 }
 
 func TestPalindromeOrchestratorAdd(t *testing.T) {
-	po := NewPalindromes()
+	po := NewPalindromes(1, 10)
 
 	msg := newFakeMessage()
 
@@ -28,7 +34,7 @@ func TestPalindromeOrchestratorAdd(t *testing.T) {
 }
 
 func TestPalindromeOrchestratorRemove(t *testing.T) {
-	po := NewPalindromes()
+	po := NewPalindromes(1, 10)
 
 	msg := newFakeMessage()
 
@@ -49,7 +55,7 @@ func TestPalindromeOrchestratorRemove(t *testing.T) {
 }
 
 func TestPalindromeOrchestratorPoll(t *testing.T) {
-	po := NewPalindromes()
+	po := NewPalindromes(1, 10)
 
 	msg := newFakeMessage()
 
@@ -65,7 +71,7 @@ func TestPalindromeOrchestratorPoll(t *testing.T) {
 }
 
 func TestPalindromeOrchestratorClear(t *testing.T) {
-	po := NewPalindromes()
+	po := NewPalindromes(1, 10)
 
 	msg := newFakeMessage()
 
@@ -84,3 +90,231 @@ func TestPalindromeOrchestratorClear(t *testing.T) {
 		t.Fatalf(`po.Poll(%+v) found, want not found`, key)
 	}
 }
+
+func TestPalindromeOrchestratorQueue(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+	po := NewPalindromes(1, 1)
+	defer po.Clear()
+
+	first := Message{id: 1, hash: CalculateHash("one"), text: "one"}
+	second := Message{id: 2, hash: CalculateHash("two"), text: "two"}
+	third := Message{id: 3, hash: CalculateHash("three"), text: "three"}
+
+	// wait for the only worker to pick up the first message
+	key, _, _, _ := po.Add(first)
+	for i := 0; ; i++ {
+		_, result, _, _ := po.Poll(key)
+		if result.queuePosition == 0 {
+			break
+		} else if i > 100 {
+			t.Fatalf(`po.Poll(%+v) queuePosition = %d, want 0`, key, result.queuePosition)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, result, _, err := po.Add(second)
+	if err != nil {
+		t.Fatalf(`po.Add(%+v) has err %+v, want nil`, second, err)
+	}
+	if result.queuePosition != 1 {
+		t.Fatalf(`po.Add(%+v) queuePosition = %d, want 1`, second, result.queuePosition)
+	}
+
+	_, _, _, err = po.Add(third)
+	var queueFull *QueueFullError
+	if !errors.As(err, &queueFull) {
+		t.Fatalf(`po.Add(%+v) has err %+v, want *QueueFullError`, third, err)
+	}
+
+	// duplicate work doesn't need room in the queue
+	duplicate := Message{id: 4, hash: second.hash, text: second.text}
+	_, _, _, err = po.Add(duplicate)
+	if err != nil {
+		t.Fatalf(`po.Add(%+v) has err %+v, want nil`, duplicate, err)
+	}
+}
+
+func TestPalindromeOrchestratorOnChange(t *testing.T) {
+	po := NewPalindromes(1, 10)
+
+	msg := newFakeMessage()
+
+	_, _, onChange, _ := po.Add(msg)
+	if onChange == nil {
+		t.Fatalf(`po.Add(%+v) onChange = nil, want non-nil`, msg)
+	}
+
+	// the first update could be that the work is running
+	result := PWResult{}
+	for !result.done {
+		select {
+		case result = <-onChange:
+		case <-time.After(time.Second):
+			t.Fatalf(`<-onChange timed out`)
+		}
+	}
+	if result.status != PW_DONE || result.isPalindrome != P_FALSE {
+		t.Fatalf(`<-onChange = %+v, want PW_DONE and P_FALSE`, result)
+	}
+
+	key := PWorkKeyFromMsg(msg)
+	po.Remove(key)
+	if _, ok := <-onChange; ok {
+		t.Fatalf(`onChange still open after po.Remove(%+v)`, key)
+	}
+}
+
+func TestPalindromeOrchestratorCache(t *testing.T) {
+	cache := NewResultCache(10, 0)
+	po := NewAnalyzerWork(PalindromeAnalyzer{}, 1, 10, cache)
+
+	msg := newFakeMessage()
+
+	_, _, onChange, _ := po.Add(msg)
+	for result := (PWResult{}); !result.done; {
+		select {
+		case result = <-onChange:
+		case <-time.After(time.Second):
+			t.Fatalf(`<-onChange timed out`)
+		}
+	}
+
+	// the result outlives the work
+	po.Remove(PWorkKeyFromMsg(msg))
+	if stats := cache.Stats(); stats.entries != 1 {
+		t.Fatalf(`cache.Stats().entries = %d, want 1`, stats.entries)
+	}
+
+	again := Message{id: 2, hash: msg.hash, text: msg.text}
+	_, result, _, err := po.Add(again)
+	if err != nil {
+		t.Fatalf(`po.Add(%+v) has err %+v, want nil`, again, err)
+	}
+	if result.status != PW_DONE || result.isPalindrome != P_FALSE {
+		t.Fatalf(`po.Add(%+v) = %+v, want cached PW_DONE and P_FALSE`, again, result)
+	}
+	if stats := cache.Stats(); stats.hits != 1 || stats.misses != 1 {
+		t.Fatalf(`cache.Stats() = %+v, want 1 hit and 1 miss`, stats)
+	}
+}
+
+func TestPalindromeOrchestratorShutdownDrain(t *testing.T) {
+	po := NewPalindromes(1, 10)
+
+	msg := newFakeMessage()
+	key, _, _, _ := po.Add(msg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := po.Shutdown(ctx, true); err != nil {
+		t.Fatalf(`po.Shutdown(drain) has err %+v, want nil`, err)
+	}
+
+	_, result, _, _ := po.Poll(key)
+	if result.status != PW_DONE || !result.done {
+		t.Fatalf(`po.Poll(%+v) = %+v, want PW_DONE`, key, result)
+	}
+}
+
+func TestPalindromeOrchestratorShutdownCancel(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+
+	for _, drain := range []bool{false, true} {
+		po := NewPalindromes(1, 10)
+
+		msg := newFakeMessage()
+		key, _, onChange, _ := po.Add(msg)
+
+		// draining runs out of time, so the work is cancelled either way
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := po.Shutdown(ctx, drain)
+		cancel()
+		if drain && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf(`po.Shutdown(drain) has err %+v, want context.DeadlineExceeded`, err)
+		} else if !drain && err != nil {
+			t.Fatalf(`po.Shutdown(cancel) has err %+v, want nil`, err)
+		}
+
+		_, result, _, _ := po.Poll(key)
+		if result.status != PW_CANCELLED || !result.done {
+			t.Fatalf(`po.Poll(%+v) after po.Shutdown(%t) = %+v, want PW_CANCELLED`, key, drain, result)
+		}
+		if result := <-onChange; result.status != PW_CANCELLED {
+			t.Fatalf(`<-onChange after po.Shutdown(%t) = %+v, want PW_CANCELLED`, drain, result)
+		}
+	}
+}
+
+func TestPalindromeOrchestratorWorkStats(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+	po := NewPalindromes(1, 10)
+	defer po.Clear()
+
+	first := Message{id: 1, hash: CalculateHash("one"), text: "one"}
+	same := Message{id: 2, hash: first.hash, text: first.text}
+	po.Add(first)
+	po.Add(same)
+	po.Add(same) // not a new listener, so not a dedupe hit
+
+	stats := po.WorkStats()
+	if stats.dedupeHits != 1 || stats.listeners != 2 {
+		t.Fatalf(`po.WorkStats() = %+v, want 1 dedupe hit and 2 listeners`, stats)
+	}
+
+	po.Remove(PWorkKeyFromMsg(first))
+	po.Remove(PWorkKeyFromMsg(same))
+
+	stats = po.WorkStats()
+	if stats.cancellations != 1 || stats.listeners != 0 || len(stats.work) != 0 {
+		t.Fatalf(`po.WorkStats() = %+v, want 1 cancellation and no work`, stats)
+	}
+}
+
+func TestPalindromeOrchestratorWorkStates(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+	po := NewPalindromes(1, 10)
+	defer po.Clear()
+
+	one := Message{id: 3, hash: CalculateHash("one"), text: "one"}
+	same := Message{id: 1, hash: one.hash, text: one.text}
+	two := Message{id: 2, hash: CalculateHash("two"), text: "two"}
+	po.Add(one)
+	po.Add(same)
+	po.Add(two)
+
+	states := po.WorkStates()
+	if len(states) != 2 || states[0].hash > states[1].hash {
+		t.Fatalf(`po.WorkStates() = %+v, want 2 states sorted by hash`, states)
+	}
+	for _, state := range states {
+		if state.created.IsZero() {
+			t.Fatalf(`po.WorkStates() state %+v has no created time`, state)
+		}
+		if state.hash == one.hash && !slices.Equal(state.listeners, []MessageRef{{"", 1}, {"", 3}}) {
+			t.Fatalf(`po.WorkStates() listeners of %s = %v, want [1 3]`, state.hash, state.listeners)
+		}
+	}
+}
+
+func TestPalindromeOrchestratorAcrossTenants(t *testing.T) {
+	t.Setenv("S_DELAY", "1")
+	po := NewPalindromes(1, 10)
+	defer po.Clear()
+
+	// same id and text, different tenants: one piece of work, two listeners
+	a := Message{tenant: "team-a", id: 1, hash: CalculateHash("abba"), text: "abba"}
+	b := Message{tenant: "team-b", id: 1, hash: a.hash, text: a.text}
+	po.Add(a)
+	po.Add(b)
+
+	stats := po.WorkStats()
+	if stats.dedupeHits != 1 || stats.listeners != 2 {
+		t.Fatalf(`po.WorkStats() = %+v, want 1 dedupe hit and 2 listeners`, stats)
+	}
+
+	// removing one tenant's message leaves the other listening
+	po.Remove(PWorkKeyFromMsg(a))
+	if found, _, _, _ := po.Poll(PWorkKeyFromMsg(b)); !found {
+		t.Fatalf(`po.Poll(%+v) not found after removing %+v`, PWorkKeyFromMsg(b), PWorkKeyFromMsg(a))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+)
+
+// This file contains the error catalogue: every kind of error a handler can
+// respond with. Errors are sent as "problem details" (see RFC 7807), with a
+// Content-Type of application/problem+json, so clients can tell them apart
+// without parsing the human-readable parts.
+
+// PROBLEM_CONTENT_TYPE is the Content-Type of every error response.
+const PROBLEM_CONTENT_TYPE = "application/problem+json"
+
+// ErrorCode is a machine-readable code for one kind of error, like
+// "message_not_found". It's the "code" field of error responses (see
+// ProblemResponseData), and the last part of their "type". Every ErrorCode is
+// in ERROR_CATALOGUE. Codes never change once they're released, but new ones
+// can be added, so clients should handle ones they don't know about (by
+// looking at the status).
+type ErrorCode string
+
+const (
+	// the request body isn't valid JSON, or doesn't have the right shape
+	E_INVALID_JSON ErrorCode = "invalid_json"
+	// the "id" in the path isn't an integer
+	E_INVALID_ID ErrorCode = "invalid_id"
+	// the "rev" in the path isn't an integer
+	E_INVALID_REVISION ErrorCode = "invalid_revision"
+	// a field of a message payload is invalid (like missing text), the
+	// errors say which
+	E_INVALID_MESSAGE ErrorCode = "invalid_message"
+	// the request body is bigger than MAX_BODY_BYTES (or MAX_BATCH_BYTES, or
+	// MAX_IMPORT_BYTES)
+	E_BODY_TOO_LARGE ErrorCode = "body_too_large"
+	// the tenant in the X-Tenant-ID header isn't a valid name
+	E_INVALID_TENANT ErrorCode = "invalid_tenant"
+	// a query parameter is invalid
+	E_INVALID_QUERY ErrorCode = "invalid_query"
+	// an operation in a batch is invalid, so nothing was applied
+	E_INVALID_BATCH ErrorCode = "invalid_batch"
+	// an import body couldn't be read, part way through
+	E_INVALID_IMPORT ErrorCode = "invalid_import"
+	// a record in an import is invalid, so it was skipped
+	E_INVALID_RECORD     ErrorCode = "invalid_record"
+	E_MESSAGE_NOT_FOUND  ErrorCode = "message_not_found"
+	E_REVISION_NOT_FOUND ErrorCode = "revision_not_found"
+	E_ANALYZER_NOT_FOUND ErrorCode = "analyzer_not_found"
+	// no route matches the path
+	E_ROUTE_NOT_FOUND ErrorCode = "route_not_found"
+	// a route matches the path, but not the method
+	E_METHOD_NOT_ALLOWED ErrorCode = "method_not_allowed"
+	// the request has no API key, or it doesn't exist
+	E_UNAUTHORIZED ErrorCode = "unauthorized"
+	// the API key doesn't have the scope the route needs, or belongs to a
+	// different tenant
+	E_FORBIDDEN ErrorCode = "forbidden"
+	// there's no API key with that id
+	E_KEY_NOT_FOUND ErrorCode = "key_not_found"
+	// a message with that id already exists
+	E_MESSAGE_EXISTS ErrorCode = "message_exists"
+	// an atomic batch wasn't applied, because an operation in it failed
+	E_BATCH_FAILED ErrorCode = "batch_failed"
+	// an operation wasn't applied, because another one in its atomic batch
+	// failed
+	E_BATCH_ABORTED ErrorCode = "batch_aborted"
+	// the message doesn't match the If-Match header, or the operation's "rev"
+	E_PRECONDITION_FAILED ErrorCode = "precondition_failed"
+	// the tenant already has as many messages as it's allowed
+	E_QUOTA_EXCEEDED ErrorCode = "quota_exceeded"
+	// the client has made too many requests, try again after the Retry-After
+	// header
+	E_RATE_LIMITED ErrorCode = "rate_limited"
+	// there's no room to queue work, try again after the Retry-After header
+	E_QUEUE_FULL ErrorCode = "queue_full"
+	// a readiness check failed
+	E_NOT_READY ErrorCode = "not_ready"
+	// something went wrong on our end. The details are logged, not sent.
+	E_INTERNAL ErrorCode = "internal"
+)
+
+// ProblemType describes one kind of error in the catalogue: the status it's
+// sent with, a short title (which is the same every time, unlike the detail),
+// and a longer description, for documentation.
+type ProblemType struct {
+	Status      int
+	Title       string
+	Description string
+}
+
+// ERROR_CATALOGUE is every kind of error, by code. GET /problems/{code} serves
+// it, so the "type" of every error response can be looked up.
+var ERROR_CATALOGUE = map[ErrorCode]ProblemType{
+	E_INVALID_JSON:        {http.StatusBadRequest, "Invalid JSON", "The request body isn't valid JSON, or doesn't have the fields it should."},
+	E_INVALID_ID:          {http.StatusBadRequest, "Invalid id", "The message id in the path isn't an integer."},
+	E_INVALID_REVISION:    {http.StatusBadRequest, "Invalid revision", "The revision number in the path isn't an integer."},
+	E_INVALID_MESSAGE:     {http.StatusBadRequest, "Invalid message", "The message payload has invalid fields (like missing text, or an unknown profile). The errors say what's wrong with each one."},
+	E_BODY_TOO_LARGE:      {http.StatusRequestEntityTooLarge, "Body too large", "The request body is bigger than the server allows."},
+	E_INVALID_TENANT:      {http.StatusBadRequest, "Invalid tenant", "The tenant (in the X-Tenant-ID header) isn't a valid name: it has to be 1 to 64 lowercase letters, digits, dashes, or underscores."},
+	E_INVALID_QUERY:       {http.StatusBadRequest, "Invalid query parameter", "A query parameter is invalid, the detail says which one."},
+	E_INVALID_BATCH:       {http.StatusBadRequest, "Invalid batch", "Operations in the batch are invalid, so none of them were applied. The errors say what's wrong with each one."},
+	E_INVALID_IMPORT:      {http.StatusBadRequest, "Invalid import", "The import couldn't be read past a certain record. The records before it were still imported."},
+	E_INVALID_RECORD:      {http.StatusBadRequest, "Invalid record", "A record in an import is invalid, so it was skipped."},
+	E_MESSAGE_NOT_FOUND:   {http.StatusNotFound, "Message not found", "There's no message with that id. It may have been deleted."},
+	E_REVISION_NOT_FOUND:  {http.StatusNotFound, "Revision not found", "The message doesn't have a revision with that number."},
+	E_ANALYZER_NOT_FOUND:  {http.StatusNotFound, "Analyzer not found", "There's no analyzer installed with that name (see GET /analyzers)."},
+	E_ROUTE_NOT_FOUND:     {http.StatusNotFound, "Route not found", "No route matches the path."},
+	E_METHOD_NOT_ALLOWED:  {http.StatusMethodNotAllowed, "Method not allowed", "The path exists, but not with that method."},
+	E_UNAUTHORIZED:        {http.StatusUnauthorized, "Unauthorized", "The request needs an API key (in the Authorization header, as a Bearer token, or the X-API-Key header), and it has none, or it isn't valid."},
+	E_FORBIDDEN:           {http.StatusForbidden, "Forbidden", "The API key doesn't have the scope this route needs, or belongs to a different tenant than the X-Tenant-ID header. The detail says which."},
+	E_KEY_NOT_FOUND:       {http.StatusNotFound, "API key not found", "There's no API key with that id."},
+	E_MESSAGE_EXISTS:      {http.StatusConflict, "Message already exists", "A message with that id already exists, so it can't be created."},
+	E_BATCH_FAILED:        {http.StatusConflict, "Batch failed", "An operation in an atomic batch failed, so none of them were applied. The results say which one."},
+	E_BATCH_ABORTED:       {http.StatusFailedDependency, "Operation aborted", "The operation wasn't applied, because another operation in its atomic batch failed."},
+	E_PRECONDITION_FAILED: {http.StatusPreconditionFailed, "Precondition failed", "The message has changed: it doesn't match the If-Match header (or the operation's rev)."},
+	E_QUOTA_EXCEEDED:      {http.StatusForbidden, "Quota exceeded", "The tenant already has as many messages as it's allowed, so no more can be created until some are deleted."},
+	E_RATE_LIMITED:        {http.StatusTooManyRequests, "Too many requests", "The client (an API key, or an IP address) has made too many requests of this kind. Try again after the Retry-After header, the RateLimit headers say how many are left."},
+	E_QUEUE_FULL:          {http.StatusServiceUnavailable, "Work queue full", "There's no room to queue palindrome work, so nothing was changed. Try again after the Retry-After header."},
+	E_NOT_READY:           {http.StatusServiceUnavailable, "Not ready", "The server can't take requests right now. The checks say why."},
+	E_INTERNAL:            {http.StatusInternalServerError, "Internal error", "Something went wrong on the server. It's been logged."},
+}
+
+// ProblemTypeURI returns the "type" of errors with code, which is a path (on
+// this server) describing them. Codes are used as-is, they're URL safe.
+func ProblemTypeURI(code ErrorCode) string {
+	return "/problems/" + string(code)
+}
+
+// NewProblem creates the response to a request which failed with code. detail
+// explains this particular failure, and can be empty.
+func NewProblem(r *http.Request, code ErrorCode, detail string) ProblemResponseData {
+	pt := ERROR_CATALOGUE[code]
+	return ProblemResponseData{
+		Type:     ProblemTypeURI(code),
+		Title:    pt.Title,
+		Status:   pt.Status,
+		Detail:   detail,
+		Instance: r.URL.RequestURI(),
+		Code:     code,
+	}
+}
+
+// WriteProblem responds to a request which failed with code (see NewProblem).
+// Any other headers (like Retry-After) must be set before calling it.
+func WriteProblem(w http.ResponseWriter, r *http.Request, code ErrorCode, detail string) {
+	problem := NewProblem(r, code, detail)
+	w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// ErrorCodeOf returns the ErrorCode matching one of the errors returned by the
+// message store or SharedState (like ErrMessageNotFound), or E_INTERNAL if
+// there isn't one.
+func ErrorCodeOf(err error) ErrorCode {
+	var queueFull *QueueFullError
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		return E_MESSAGE_NOT_FOUND
+	case errors.Is(err, ErrRevisionNotFound):
+		return E_REVISION_NOT_FOUND
+	case errors.Is(err, ErrPreconditionFailed), errors.Is(err, ErrRevisionMismatch):
+		return E_PRECONDITION_FAILED
+	case errors.Is(err, ErrMessageExists):
+		return E_MESSAGE_EXISTS
+	case errors.Is(err, ErrBatchAborted):
+		return E_BATCH_ABORTED
+	case errors.Is(err, ErrQuotaExceeded):
+		return E_QUOTA_EXCEEDED
+	case errors.As(err, &queueFull):
+		return E_QUEUE_FULL
+	default:
+		return E_INTERNAL
+	}
+}
+
+// ErrorCodes returns every code in the catalogue, sorted.
+func ErrorCodes() []ErrorCode {
+	out := make([]ErrorCode, 0, len(ERROR_CATALOGUE))
+	for code := range ERROR_CATALOGUE {
+		out = append(out, code)
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCatalogue(t *testing.T) {
+	for _, code := range ErrorCodes() {
+		pt := ERROR_CATALOGUE[code]
+		if pt.Status < 400 || pt.Title == "" || pt.Description == "" {
+			t.Fatalf(`ERROR_CATALOGUE[%s] = %+v, want an error status, title, and description`, code, pt)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	r := httptest.NewRequest("GET", "/messages/7?wait=1s", nil)
+	w := httptest.NewRecorder()
+	WriteProblem(w, r, E_MESSAGE_NOT_FOUND, "there's no message 7")
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf(`WriteProblem() status = %d, want 404`, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != PROBLEM_CONTENT_TYPE {
+		t.Fatalf(`WriteProblem() Content-Type = %s, want %s`, ct, PROBLEM_CONTENT_TYPE)
+	}
+
+	var problem ProblemResponseData
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf(`WriteProblem() body has err %+v, want nil`, err)
+	}
+	expected := ProblemResponseData{
+		Type:     "/problems/message_not_found",
+		Title:    "Message not found",
+		Status:   http.StatusNotFound,
+		Detail:   "there's no message 7",
+		Instance: "/messages/7?wait=1s",
+		Code:     E_MESSAGE_NOT_FOUND,
+	}
+	if problem != expected {
+		t.Fatalf(`WriteProblem() body = %+v, want %+v`, problem, expected)
+	}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{ErrMessageNotFound, E_MESSAGE_NOT_FOUND},
+		{fmt.Errorf("wrapped: %w", ErrRevisionNotFound), E_REVISION_NOT_FOUND},
+		{ErrRevisionMismatch, E_PRECONDITION_FAILED},
+		{ErrMessageExists, E_MESSAGE_EXISTS},
+		{&QueueFullError{}, E_QUEUE_FULL},
+		{fmt.Errorf("disk on fire"), E_INTERNAL},
+	}
+
+	for _, test := range tests {
+		if code := ErrorCodeOf(test.err); code != test.code {
+			t.Fatalf(`ErrorCodeOf(%v) = %s, want %s`, test.err, code, test.code)
+		}
+	}
+}
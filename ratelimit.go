@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// This file contains rate limiting, which is off unless a limit is set (see
+// main): every client (an API key, or an IP address if the request has no key)
+// gets a token bucket for each kind of request, which refills at a steady
+// rate. A request takes a token, and if there are none left it's refused with
+// 429. Reads, writes, and writes which start palindrome work have separate
+// buckets, so a client flooding POST /messages can still read its results.
+// Batches and imports can start a lot of work in one request, so they take a
+// work token for every message they create or update, but they're never
+// refused just for being big (see AllowWork and WaitForWork).
+//
+// Every limited response has the RateLimit headers from the IETF draft (see
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/), so
+// well-behaved clients can slow down before they're refused.
+
+// The kinds of request which are limited separately (see ROUTE_RATE_CLASSES).
+const (
+	// reading messages (and everything else that's a GET)
+	RATE_READ = "read"
+	// changing messages without starting work, like deleting them (and
+	// everything else that isn't a GET)
+	RATE_WRITE = "write"
+	// creating, updating, or restoring messages, which starts palindrome work
+	// (one token per message, for batches and imports)
+	RATE_WORK = "work"
+	// used in ROUTE_RATE_CLASSES for routes which aren't limited at all
+	RATE_NONE = ""
+)
+
+// RATE_CLASSES is every kind of limited request.
+var RATE_CLASSES = []string{RATE_READ, RATE_WRITE, RATE_WORK}
+
+// RATE_WINDOW is how long it takes for an empty bucket to fill up again. Limits
+// are a number of requests per RATE_WINDOW.
+const RATE_WINDOW = time.Minute
+
+// ROUTE_RATE_CLASSES is the kind of request each route is, keyed by method and
+// path template, like ROUTE_SCOPES (v2 routes use the same entry as v1, see
+// RouteRateClass). Routes which aren't in here are RATE_READ if they're a GET,
+// otherwise RATE_WRITE. Health checks and metrics aren't limited, so a busy
+// client can't make the server look unhealthy. Batches and imports are writes,
+// and take their work tokens themselves, once they know how many messages
+// they have (see AllowWork and WaitForWork).
+var ROUTE_RATE_CLASSES = map[string]string{
+	"GET /healthz":          RATE_NONE,
+	"GET /readyz":           RATE_NONE,
+	"GET /metrics":          RATE_NONE,
+	"POST /messages":        RATE_WORK,
+	"POST /messages:batch":  RATE_WRITE,
+	"POST /messages/import": RATE_WRITE,
+	"PUT /messages/{id}":    RATE_WORK,
+	"POST /messages/{id}/revisions/{rev}/restore": RATE_WORK,
+}
+
+// RATE_SWEEP_INTERVAL is how often buckets which have filled up again are
+// forgotten, so clients which have gone away don't use up memory forever.
+const RATE_SWEEP_INTERVAL = time.Minute
+
+// RouteRateClass returns the kind of request a route is (see
+// ROUTE_RATE_CLASSES).
+func RouteRateClass(method string, route string) string {
+	route = strings.TrimPrefix(route, "/v2")
+	if class, ok := ROUTE_RATE_CLASSES[method+" "+route]; ok {
+		return class
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return RATE_READ
+	}
+	return RATE_WRITE
+}
+
+// ClientOf returns who made a request, for rate limiting: "key:" and the id of
+// its API key, if it has one (see APIKeyFromContext), otherwise "ip:" and the
+// address it came from. X-Forwarded-For is ignored, as anyone can set it.
+func ClientOf(r *http.Request) string {
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return "key:" + key.id
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// tokenBucket holds up to limit tokens, and gains limit tokens every
+// RATE_WINDOW. It starts full.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens gained since the bucket was last updated.
+func (b *tokenBucket) refill(now time.Time, limit int) {
+	rate := float64(limit) / RATE_WINDOW.Seconds()
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+// RateDecision is whether a request is allowed (see RateLimiter.Allow), and
+// what goes in its RateLimit headers: the limit, how many requests are left,
+// and how long until the bucket is full again. retryAfter is how long until
+// the next request would be allowed (zero if it's allowed now).
+type RateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// bucketKey identifies the bucket of one client, for one kind of request.
+type bucketKey struct {
+	client string
+	class  string
+}
+
+// RateLimiter keeps a token bucket per client and kind of request (see
+// tokenBucket). Buckets are created the first time a client makes that kind of
+// request. It is safe for concurrent use.
+type RateLimiter struct {
+	lock sync.Mutex
+	// requests per RATE_WINDOW, by kind. Missing or 0 means no limit.
+	limits  map[string]int
+	buckets map[bucketKey]*tokenBucket
+	// requests refused, by kind
+	rejected  map[string]uint64
+	lastSweep time.Time
+	// the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter with the given limits (requests per
+// RATE_WINDOW, by kind, see RATE_CLASSES).
+func NewRateLimiter(limits map[string]int) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		buckets:   make(map[bucketKey]*tokenBucket),
+		rejected:  make(map[string]uint64),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes tokens from client's bucket for class, if it has that many. If
+// tokens is more than the limit, it takes a full bucket instead, so a big
+// request can always go through eventually. If class isn't limited, the
+// request is allowed and limit is 0. Refused requests are counted (see
+// Rejected).
+func (rl *RateLimiter) Allow(client string, class string, tokens int) RateDecision {
+	return rl.allow(client, class, tokens, true)
+}
+
+// allow is Allow, but refusals are only counted if count is true (see
+// WaitForWork, which isn't refused, just made to wait).
+func (rl *RateLimiter) allow(client string, class string, tokens int, count bool) RateDecision {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	limit := rl.limits[class]
+	if limit <= 0 {
+		return RateDecision{allowed: true}
+	}
+
+	now := rl.now()
+	rl.sweep(now)
+
+	key := bucketKey{client, class}
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit), updated: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.refill(now, limit)
+
+	tokens = min(tokens, limit)
+	rate := float64(limit) / RATE_WINDOW.Seconds()
+	decision := RateDecision{limit: limit}
+	if bucket.tokens >= float64(tokens) {
+		bucket.tokens -= float64(tokens)
+		decision.allowed = true
+	} else {
+		if count {
+			rl.rejected[class]++
+		}
+		decision.retryAfter = time.Duration((float64(tokens) - bucket.tokens) / rate * float64(time.Second))
+	}
+	decision.remaining = int(bucket.tokens)
+	decision.reset = time.Duration((float64(limit) - bucket.tokens) / rate * float64(time.Second))
+
+	return decision
+}
+
+// sweep forgets every bucket which would be full by now, at most once every
+// RATE_SWEEP_INTERVAL. A full bucket is the same as no bucket. Must be called
+// with rl.lock held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < RATE_SWEEP_INTERVAL {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, bucket := range rl.buckets {
+		limit := rl.limits[key.class]
+		bucket.refill(now, limit)
+		if bucket.tokens >= float64(limit) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Rejected returns how many requests of each kind have been refused.
+func (rl *RateLimiter) Rejected() map[string]uint64 {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	out := make(map[string]uint64, len(rl.rejected))
+	for class, count := range rl.rejected {
+		out[class] = count
+	}
+	return out
+}
+
+// RateLimit is middleware which limits how many requests each client can make
+// (see ClientOf, RouteRateClass, and RateLimiter). Limited responses have
+// RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, and RateLimit-Policy
+// headers, and refused requests get 429 with a Retry-After header. If
+// ss.limiter is nil, every request is allowed. It has to come after
+// Authenticate, so requests with an API key are limited by key.
+func (ss *SharedState) RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ss.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// find which bucket to take from
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		class := RouteRateClass(r.Method, route)
+		if class == RATE_NONE {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := ClientOf(r)
+		decision := ss.limiter.Allow(client, class, 1)
+		if decision.limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// tell the client where it stands
+		SetRateLimitHeaders(w, decision)
+		if !decision.allowed {
+			SetRetryAfter(w, decision.retryAfter)
+			WriteProblem(w, r, E_RATE_LIMITED, fmt.Sprintf("%s can make %d %s requests a minute", client, decision.limit, class))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowWork takes n RATE_WORK tokens (at most a full bucket, see
+// RateLimiter.Allow) from the bucket of the client which made r (see
+// ClientOf), for a request which starts work for n messages, like a batch. It
+// sets the RateLimit headers (for the work bucket, which matters more than the
+// request's own). If the client doesn't have that many tokens, it sets
+// Retry-After too, and returns false and why, for the caller's 429 (see
+// E_RATE_LIMITED). If ss.limiter is nil, or n is 0, it always returns true.
+func (ss *SharedState) AllowWork(w http.ResponseWriter, r *http.Request, n int) (bool, string) {
+	if ss.limiter == nil || n == 0 {
+		return true, ""
+	}
+
+	client := ClientOf(r)
+	decision := ss.limiter.Allow(client, RATE_WORK, n)
+	if decision.limit == 0 {
+		return true, ""
+	}
+
+	SetRateLimitHeaders(w, decision)
+	if !decision.allowed {
+		SetRetryAfter(w, decision.retryAfter)
+		return false, fmt.Sprintf("%s can start work for %d messages a minute", client, decision.limit)
+	}
+	return true, ""
+}
+
+// WaitForWork is like AllowWork, but instead of refusing, it waits until the
+// client has all n tokens, taking up to a full bucket at a time. It's for
+// requests which start work as they go, like an import, so they're paced to
+// the client's limit rather than refused. It returns the error of r's context
+// if the request is cancelled while it's waiting.
+func (ss *SharedState) WaitForWork(w http.ResponseWriter, r *http.Request, n int) error {
+	if ss.limiter == nil {
+		return nil
+	}
+
+	client := ClientOf(r)
+	for n > 0 {
+		decision := ss.limiter.allow(client, RATE_WORK, n, false)
+		if decision.limit == 0 {
+			return nil
+		}
+
+		SetRateLimitHeaders(w, decision)
+		if decision.allowed {
+			n -= min(n, decision.limit)
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-time.After(decision.retryAfter):
+		}
+	}
+	return nil
+}
+
+// SetRateLimitHeaders sets the RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset, and RateLimit-Policy headers of a response (see RateLimit).
+func SetRateLimitHeaders(w http.ResponseWriter, decision RateDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.limit, int(RATE_WINDOW.Seconds())))
+}
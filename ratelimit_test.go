@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRateLimiter returns a RateLimiter whose clock only moves when the
+// returned function is called.
+func newTestRateLimiter(limits map[string]int) (*RateLimiter, func(time.Duration)) {
+	rl := NewRateLimiter(limits)
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	return rl, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRouteRateClass(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string
+		class  string
+	}{
+		{"GET", "/healthz", RATE_NONE},
+		{"GET", "/messages/{id}", RATE_READ},
+		{"POST", "/messages", RATE_WORK},
+		{"POST", "/messages:batch", RATE_WRITE},
+		{"PUT", "/v2/messages/{id}", RATE_WORK},
+		{"DELETE", "/messages/{id}", RATE_WRITE},
+		{"POST", "/something/new", RATE_WRITE},
+	}
+	for _, test := range tests {
+		if class := RouteRateClass(test.method, test.route); class != test.class {
+			t.Fatalf(`RouteRateClass(%s, %s) = %q, want %q`, test.method, test.route, class, test.class)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl, advance := newTestRateLimiter(map[string]int{RATE_READ: 60, RATE_WORK: 2})
+
+	// the bucket starts full
+	for i := 0; i < 2; i++ {
+		if d := rl.Allow("ip:a", RATE_WORK, 1); !d.allowed || d.remaining != 1-i {
+			t.Fatalf(`rl.Allow("ip:a", work) #%d = %+v, want allowed with %d remaining`, i, d, 1-i)
+		}
+	}
+	d := rl.Allow("ip:a", RATE_WORK, 1)
+	if d.allowed || d.retryAfter != 30*time.Second {
+		t.Fatalf(`rl.Allow("ip:a", work) when empty = %+v, want refused for 30s`, d)
+	}
+
+	// other clients, and other kinds of request, have their own buckets
+	if d := rl.Allow("ip:b", RATE_WORK, 1); !d.allowed {
+		t.Fatalf(`rl.Allow("ip:b", work) = %+v, want allowed`, d)
+	}
+	if d := rl.Allow("ip:a", RATE_READ, 1); !d.allowed || d.remaining != 59 {
+		t.Fatalf(`rl.Allow("ip:a", read) = %+v, want allowed with 59 remaining`, d)
+	}
+
+	// unlimited kinds are always allowed
+	if d := rl.Allow("ip:a", RATE_WRITE, 1); !d.allowed || d.limit != 0 {
+		t.Fatalf(`rl.Allow("ip:a", write) = %+v, want allowed without a limit`, d)
+	}
+
+	// tokens come back over time
+	advance(30 * time.Second)
+	if d := rl.Allow("ip:a", RATE_WORK, 1); !d.allowed {
+		t.Fatalf(`rl.Allow("ip:a", work) after 30s = %+v, want allowed`, d)
+	}
+	if rejected := rl.Rejected(); rejected[RATE_WORK] != 1 {
+		t.Fatalf(`rl.Rejected() = %+v, want 1 work request`, rejected)
+	}
+
+	// a request can take several tokens at once, up to a full bucket
+	if d := rl.Allow("ip:d", RATE_READ, 50); !d.allowed || d.remaining != 10 {
+		t.Fatalf(`rl.Allow("ip:d", read, 50) = %+v, want allowed with 10 remaining`, d)
+	}
+	if d := rl.Allow("ip:d", RATE_READ, 20); d.allowed || d.retryAfter != 10*time.Second {
+		t.Fatalf(`rl.Allow("ip:d", read, 20) with 10 left = %+v, want refused for 10s`, d)
+	}
+	if d := rl.Allow("ip:e", RATE_READ, 100); !d.allowed || d.remaining != 0 {
+		t.Fatalf(`rl.Allow("ip:e", read, 100) = %+v, want allowed with the bucket emptied`, d)
+	}
+
+	// and buckets which are full again are forgotten
+	advance(RATE_WINDOW + RATE_SWEEP_INTERVAL)
+	rl.Allow("ip:c", RATE_READ, 1)
+	if len(rl.buckets) != 1 {
+		t.Fatalf(`rl.buckets after a sweep = %+v, want only ip:c's`, rl.buckets)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl, _ := newTestRateLimiter(map[string]int{RATE_READ: 1})
+	ss := SharedState{limiter: rl}
+
+	r := mux.NewRouter()
+	r.Use(ss.RateLimit)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.Methods("GET").Path("/healthz").HandlerFunc(ok)
+	r.Methods("GET").Path("/messages").HandlerFunc(ok)
+
+	tests := []struct {
+		url       string
+		status    int
+		remaining string
+	}{
+		{"/messages", http.StatusOK, "0"},
+		{"/messages", http.StatusTooManyRequests, "0"},
+		{"/healthz", http.StatusOK, ""},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+
+		if w.Code != test.status || w.Header().Get("RateLimit-Remaining") != test.remaining {
+			t.Fatalf(`#%d GET %s status = %d, RateLimit-Remaining = %q, want %d, %q`, i, test.url, w.Code, w.Header().Get("RateLimit-Remaining"), test.status, test.remaining)
+		}
+		if w.Code == http.StatusTooManyRequests && (w.Header().Get("Retry-After") != "60" || !strings.Contains(w.Body.String(), `"code":"rate_limited"`)) {
+			t.Fatalf(`#%d GET %s has Retry-After %q and body %s, want 60 and %s`, i, test.url, w.Header().Get("Retry-After"), w.Body, E_RATE_LIMITED)
+		}
+	}
+}
+
+// newTestBatchState returns a SharedState which can run batches, with rl as its
+// limiter.
+func newTestBatchState(t *testing.T, rl *RateLimiter) *SharedState {
+	po := NewPalindromes(1, 100)
+	t.Cleanup(func() { po.Clear() })
+	ar := NewAnalyzerRegistry()
+	if err := ar.Register(PalindromeAnalyzer{}, po); err != nil {
+		t.Fatalf(`ar.Register(palindrome) has err %+v, want nil`, err)
+	}
+	mo := NewMessages()
+	return &SharedState{mo: &mo, po: po, analyzers: ar, limiter: rl, limits: DEFAULT_VALIDATION_LIMITS}
+}
+
+// batchOfCreates returns the body of a batch which creates n messages.
+func batchOfCreates(n int) string {
+	ops := make([]string, n)
+	for i := range ops {
+		ops[i] = `{"op": "create", "text": "racecar"}`
+	}
+	return `{"operations": [` + strings.Join(ops, ", ") + `]}`
+}
+
+func TestBatchMessagesRateLimited(t *testing.T) {
+	// by default nothing is limited, so a big batch goes through
+	for _, class := range RATE_CLASSES {
+		t.Setenv("RATE_LIMIT_"+strings.ToUpper(class), "")
+	}
+	ss := newTestBatchState(t, newRateLimiter())
+	w := httptest.NewRecorder()
+	ss.BatchMessages(w, httptest.NewRequest("POST", "/messages:batch", strings.NewReader(batchOfCreates(200))))
+	if all, _ := ss.mo.GetAll(); w.Code != http.StatusOK || len(all) != 200 {
+		t.Fatalf(`BatchMessages(200 creates) by default = %d with %d messages, want 200 with 200`, w.Code, len(all))
+	}
+
+	// a batch bigger than the limit takes the whole bucket, so it goes through
+	// once, and the next batch has to wait
+	rl, _ := newTestRateLimiter(map[string]int{RATE_WORK: 2})
+	ss = newTestBatchState(t, rl)
+	tests := []struct {
+		status     int
+		retryAfter string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusTooManyRequests, "60"},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		ss.BatchMessages(w, httptest.NewRequest("POST", "/messages:batch", strings.NewReader(batchOfCreates(3))))
+		if w.Code != test.status || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Fatalf(`#%d BatchMessages(3 creates) = %d with RateLimit-Limit %q and Retry-After %q, want %d, "2", %q`, i, w.Code, w.Header().Get("RateLimit-Limit"), w.Header().Get("Retry-After"), test.status, test.retryAfter)
+		}
+	}
+}
+
+func TestWaitForWork(t *testing.T) {
+	// 10 tokens a second, all used up
+	rl := NewRateLimiter(map[string]int{RATE_WORK: 600})
+	rl.Allow("ip:192.0.2.1", RATE_WORK, 600)
+	ss := SharedState{limiter: rl}
+
+	r := httptest.NewRequest("POST", "/messages/import", nil)
+	start := time.Now()
+	if err := ss.WaitForWork(httptest.NewRecorder(), r, 3); err != nil {
+		t.Fatalf(`ss.WaitForWork(3) has err %+v, want nil`, err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Fatalf(`ss.WaitForWork(3) waited %s, want about 300ms`, waited)
+	}
+	if rejected := rl.Rejected(); rejected[RATE_WORK] != 0 {
+		t.Fatalf(`rl.Rejected() after waiting = %+v, want nothing refused`, rejected)
+	}
+
+	// it gives up if the request does
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	if err := ss.WaitForWork(httptest.NewRecorder(), r.WithContext(ctx), 600); !errors.Is(err, context.Canceled) {
+		t.Fatalf(`ss.WaitForWork(600) after cancelling has err %+v, want %+v`, err, context.Canceled)
+	}
+}
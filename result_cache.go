@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ResultCache keeps the results of finished work around after the work itself
+// is removed (when the last message with that hash is deleted or updated), so
+// posting the same text again doesn't mean doing the same work again. It's
+// keyed by message hash, which covers the text as well as its settings (see
+// MessageHash), so results for different profiles or modes never mix.
+//
+// It's a least-recently-used cache: it holds at most maxEntries results, and
+// when it's full the one which was used longest ago is evicted. Results also
+// expire ttl after they were stored (if ttl is more than 0). It's safe for
+// concurrent use.
+type ResultCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	// key: hash, value: an element of order, holding a *cacheEntry
+	entries map[string]*list.Element
+	// most recently used first
+	order     *list.List
+	hits      int
+	misses    int
+	evictions int
+	// so tests can pretend time passes
+	now func() time.Time
+}
+
+// cacheEntry is a single result in a ResultCache.
+type cacheEntry struct {
+	hash     string
+	result   PWResult
+	storedAt time.Time
+}
+
+// CacheStats is a summary of a ResultCache: how many results it holds (and can
+// hold), how long they last (0 means forever), and how many times a result was
+// found (hits), not found (misses), and evicted to make room.
+type CacheStats struct {
+	entries    int
+	maxEntries int
+	ttl        time.Duration
+	hits       int
+	misses     int
+	evictions  int
+}
+
+// CachedResult describes one result in a ResultCache, for inspection. Expires
+// is the zero time if the result never expires.
+type CachedResult struct {
+	hash     string
+	result   PWResult
+	storedAt time.Time
+	expires  time.Time
+}
+
+// ResultCacher is implemented by WorkOrchestrators which have a ResultCache
+// (like Palindromes). The cache may be nil, which means caching is off.
+type ResultCacher interface {
+	ResultCache() *ResultCache
+}
+
+// NewResultCache creates an empty ResultCache, which holds at most maxEntries
+// results (at least 1), each for ttl (forever if ttl is 0 or less).
+func NewResultCache(maxEntries int, ttl time.Duration) *ResultCache {
+	return &ResultCache{
+		maxEntries: max(maxEntries, 1),
+		ttl:        max(ttl, 0),
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Get returns the result stored for a hash, and whether it was found (and
+// hasn't expired). Finding it counts as a hit and makes it the most recently
+// used result, otherwise it counts as a miss.
+func (c *ResultCache) Get(hash string) (PWResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[hash]
+	if ok && c.expired(el.Value.(*cacheEntry)) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return PWResult{}, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).result, true
+}
+
+// Put stores the result for a hash, replacing any result already there. If
+// the cache is full, the least recently used result is evicted.
+func (c *ResultCache) Put(hash string, result PWResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// a cached result is never waiting in a queue
+	result.queuePosition = 0
+
+	if el, ok := c.entries[hash]; ok {
+		el.Value = &cacheEntry{hash: hash, result: result, storedAt: c.now()}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+
+	c.entries[hash] = c.order.PushFront(&cacheEntry{hash: hash, result: result, storedAt: c.now()})
+}
+
+// Remove removes the result for a hash, and returns whether there was one.
+func (c *ResultCache) Remove(hash string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[hash]
+	if ok {
+		c.remove(el)
+	}
+	return ok
+}
+
+// Purge removes every result, and returns how many there were. The hit, miss,
+// and eviction counters are kept.
+func (c *ResultCache) Purge() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := c.order.Len()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return n
+}
+
+// Stats returns a summary of the cache (see CacheStats). Expired results which
+// haven't been looked at since they expired still count as entries.
+func (c *ResultCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		entries:    c.order.Len(),
+		maxEntries: c.maxEntries,
+		ttl:        c.ttl,
+		hits:       c.hits,
+		misses:     c.misses,
+		evictions:  c.evictions,
+	}
+}
+
+// Entries returns up to limit results in the cache (all of them if limit is 0
+// or less), most recently used first. Expired results are left out.
+func (c *ResultCache) Entries(limit int) []CachedResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	out := []CachedResult{}
+	for el := c.order.Front(); el != nil && (limit <= 0 || len(out) < limit); el = el.Next() {
+		entry := el.Value.(*cacheEntry)
+		if c.expired(entry) {
+			continue
+		}
+
+		cr := CachedResult{hash: entry.hash, result: entry.result, storedAt: entry.storedAt}
+		if c.ttl > 0 {
+			cr.expires = entry.storedAt.Add(c.ttl)
+		}
+		out = append(out, cr)
+	}
+
+	return out
+}
+
+// expired returns true if an entry is older than the ttl. Must be called with
+// c.lock held.
+func (c *ResultCache) expired(entry *cacheEntry) bool {
+	return c.ttl > 0 && c.now().Sub(entry.storedAt) >= c.ttl
+}
+
+// remove removes an element from the cache. Must be called with c.lock held.
+func (c *ResultCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).hash)
+	c.order.Remove(el)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultCacheLRU(t *testing.T) {
+	cache := NewResultCache(2, 0)
+
+	cache.Put("a", PWResult{status: PW_DONE, isPalindrome: P_TRUE})
+	cache.Put("b", PWResult{status: PW_DONE, isPalindrome: P_FALSE})
+
+	// use "a", so "b" is the least recently used
+	if result, ok := cache.Get("a"); !ok || result.isPalindrome != P_TRUE {
+		t.Fatalf(`cache.Get("a") = %+v, %t, want P_TRUE, true`, result, ok)
+	}
+
+	cache.Put("c", PWResult{status: PW_DONE})
+	if _, ok := cache.Get("b"); ok {
+		t.Fatalf(`cache.Get("b") found, want evicted`)
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatalf(`cache.Get("a") not found, want found`)
+	}
+
+	stats := cache.Stats()
+	if stats.entries != 2 || stats.hits != 2 || stats.misses != 1 || stats.evictions != 1 {
+		t.Fatalf(`cache.Stats() = %+v, want 2 entries, 2 hits, 1 miss, 1 eviction`, stats)
+	}
+
+	entries := cache.Entries(0)
+	if len(entries) != 2 || entries[0].hash != "a" || entries[1].hash != "c" {
+		t.Fatalf(`cache.Entries(0) = %+v, want a, c`, entries)
+	}
+
+	if n := cache.Purge(); n != 2 {
+		t.Fatalf(`cache.Purge() = %d, want 2`, n)
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf(`cache.Get("a") found after purge, want not found`)
+	}
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewResultCache(10, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Put("a", PWResult{status: PW_DONE})
+	entries := cache.Entries(0)
+	if len(entries) != 1 || !entries[0].expires.Equal(now.Add(time.Minute)) {
+		t.Fatalf(`cache.Entries(0) = %+v, want one which expires in a minute`, entries)
+	}
+
+	now = now.Add(59 * time.Second)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatalf(`cache.Get("a") not found before ttl, want found`)
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf(`cache.Get("a") found after ttl, want expired`)
+	}
+	if stats := cache.Stats(); stats.entries != 0 {
+		t.Fatalf(`cache.Stats().entries = %d, want 0`, stats.entries)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// SearchQuery is a parsed full-text search query. A message matches if it
+// matches every term, prefix, and phrase (they're AND-ed together).
+type SearchQuery struct {
+	// whole words, like `racecar`
+	terms []string
+	// the start of a word, like `race*`
+	prefixes []string
+	// words in a row, like `"a man a plan"`
+	phrases [][]string
+}
+
+// SearchHit is a message which matched a search query. Score is the number of
+// times the query matched the message (higher is better).
+type SearchHit struct {
+	msg   Message
+	score int
+}
+
+// ParseSearchQuery parses a search query string. Words are matched exactly
+// (case-insensitive), words ending in '*' match any word starting with the
+// rest, and words in double quotes have to appear next to each other, in
+// order. Punctuation is ignored, just like when indexing. It returns an error
+// if there's nothing to search for, or if a quote isn't closed.
+func ParseSearchQuery(q string) (SearchQuery, error) {
+	out := SearchQuery{}
+
+	parts := strings.Split(q, `"`)
+	if len(parts)%2 == 0 {
+		return SearchQuery{}, errors.New("unterminated quote in search query")
+	}
+
+	for i, part := range parts {
+		// odd parts were inside quotes
+		if i%2 == 1 {
+			phrase := Tokenize(part)
+			if len(phrase) == 1 {
+				out.terms = append(out.terms, phrase[0])
+			} else if len(phrase) > 1 {
+				out.phrases = append(out.phrases, phrase)
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			isPrefix := strings.HasSuffix(field, "*")
+			tokens := Tokenize(field)
+			for j, token := range tokens {
+				// only the last token of something like "can't*" is a prefix
+				if isPrefix && j == len(tokens)-1 {
+					out.prefixes = append(out.prefixes, token)
+				} else {
+					out.terms = append(out.terms, token)
+				}
+			}
+		}
+	}
+
+	if len(out.terms) == 0 && len(out.prefixes) == 0 && len(out.phrases) == 0 {
+		return SearchQuery{}, errors.New("empty search query")
+	}
+
+	return out, nil
+}
+
+// Tokenize splits text into lowercase words, made up of letters and numbers.
+// Everything else separates words.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchIndex is an inverted index: for every word, it knows which messages
+// contain it, and how many times. It is not safe for concurrent use; Messages
+// guards it with its own lock.
+type searchIndex struct {
+	// key: word, value: (key: message id, value: number of times the word
+	// appears in the message)
+	postings map[string]map[int]int
+	// every key of postings, in ascending order, for prefix searches
+	words []string
+}
+
+// newSearchIndex creates an empty searchIndex.
+func newSearchIndex() searchIndex {
+	return searchIndex{
+		postings: make(map[string]map[int]int),
+		words:    []string{},
+	}
+}
+
+// add indexes the words in some text, for a message id.
+func (si *searchIndex) add(id int, text string) {
+	for _, word := range Tokenize(text) {
+		ids, ok := si.postings[word]
+		if !ok {
+			ids = make(map[int]int)
+			si.postings[word] = ids
+			i, _ := slices.BinarySearch(si.words, word)
+			si.words = slices.Insert(si.words, i, word)
+		}
+		ids[id]++
+	}
+}
+
+// remove un-indexes the words in some text, for a message id. The text must be
+// the same as what was passed to add.
+func (si *searchIndex) remove(id int, text string) {
+	for _, word := range Tokenize(text) {
+		ids, ok := si.postings[word]
+		if !ok {
+			continue
+		}
+
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(si.postings, word)
+			if i, found := slices.BinarySearch(si.words, word); found {
+				si.words = slices.Delete(si.words, i, i+1)
+			}
+		}
+	}
+}
+
+// search returns the score of every message id which matches the query. Phrase
+// matches are checked against the text of the message, which is looked up
+// with textOf.
+func (si *searchIndex) search(q SearchQuery, textOf func(id int) string) map[int]int {
+	var scores map[int]int
+
+	// AND together the scores for each part of the query
+	intersect := func(partial map[int]int) {
+		if scores == nil {
+			scores = partial
+			return
+		}
+		for id, score := range scores {
+			if s, ok := partial[id]; ok {
+				scores[id] = score + s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	for _, term := range q.terms {
+		partial := make(map[int]int)
+		for id, count := range si.postings[term] {
+			partial[id] = count
+		}
+		intersect(partial)
+	}
+
+	for _, prefix := range q.prefixes {
+		partial := make(map[int]int)
+		i, _ := slices.BinarySearch(si.words, prefix)
+		for ; i < len(si.words) && strings.HasPrefix(si.words[i], prefix); i++ {
+			for id, count := range si.postings[si.words[i]] {
+				partial[id] += count
+			}
+		}
+		intersect(partial)
+	}
+
+	for _, phrase := range q.phrases {
+		// only messages with every word in the phrase could match, start with
+		// the rarest word
+		rarest := phrase[0]
+		for _, word := range phrase {
+			if len(si.postings[word]) < len(si.postings[rarest]) {
+				rarest = word
+			}
+		}
+
+		partial := make(map[int]int)
+		for id := range si.postings[rarest] {
+			if count := countPhrase(Tokenize(textOf(id)), phrase); count > 0 {
+				partial[id] = count
+			}
+		}
+		intersect(partial)
+	}
+
+	return scores
+}
+
+// countPhrase returns how many times phrase appears in words.
+func countPhrase(words []string, phrase []string) int {
+	count := 0
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(phrase)], phrase) {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := ParseSearchQuery(`Race* "A man, a plan" kayak's`)
+	if err != nil {
+		t.Fatalf(`ParseSearchQuery() has err %+v, want nil`, err)
+	}
+
+	if !slices.Equal(q.terms, []string{"kayak", "s"}) {
+		t.Fatalf(`ParseSearchQuery() terms = %v, want [kayak s]`, q.terms)
+	}
+	if !slices.Equal(q.prefixes, []string{"race"}) {
+		t.Fatalf(`ParseSearchQuery() prefixes = %v, want [race]`, q.prefixes)
+	}
+	if len(q.phrases) != 1 || !slices.Equal(q.phrases[0], []string{"a", "man", "a", "plan"}) {
+		t.Fatalf(`ParseSearchQuery() phrases = %v, want [[a man a plan]]`, q.phrases)
+	}
+}
+
+func TestParseSearchQueryInvalid(t *testing.T) {
+	for _, raw := range []string{"", "   ", `"unclosed`, `!!! ""`} {
+		if _, err := ParseSearchQuery(raw); err == nil {
+			t.Fatalf(`ParseSearchQuery(%q) has nil err, want error`, raw)
+		}
+	}
+}
+
+func TestMessageOrchestratorSearch(t *testing.T) {
+	mo := NewMessages()
+
+	mo.Add("A man, a plan, a canal: Panama", PSettings{}) // 1
+	mo.Add("racecar racecar", PSettings{})                // 2
+	mo.Add("race to the car", PSettings{})                // 3
+	mo.Add("a plan for the man", PSettings{})             // 4
+	mo.Add("nothing to see here", PSettings{})            // 5
+
+	cases := []struct {
+		raw      string
+		expected []int
+	}{
+		{"racecar", []int{2}},
+		{"race*", []int{2, 3}},
+		{"RACE", []int{3}},
+		{"man plan", []int{1, 4}},
+		{`"a man a plan"`, []int{1}},
+		{`"plan for" man`, []int{4}},
+		{"the", []int{3, 4}},
+		{"palindrome", []int{}},
+	}
+
+	for _, c := range cases {
+		q, _ := ParseSearchQuery(c.raw)
+		hits, err := mo.Search(q)
+		if err != nil {
+			t.Fatalf(`mo.Search(%q) has err %+v, want nil`, c.raw, err)
+		}
+
+		ids := []int{}
+		for _, hit := range hits {
+			ids = append(ids, hit.msg.id)
+		}
+		if !slices.Equal(ids, c.expected) {
+			t.Fatalf(`mo.Search(%q) ids = %v, want %v`, c.raw, ids, c.expected)
+		}
+	}
+}
+
+func TestMessageOrchestratorSearchAfterChanges(t *testing.T) {
+	mo := NewMessages()
+
+	mo.Add("racecar", PSettings{})
+	mo.Add("kayak", PSettings{})
+	mo.Update(1, "level", PSettings{})
+	mo.Delete(2)
+
+	for _, raw := range []string{"racecar", "kayak"} {
+		q, _ := ParseSearchQuery(raw)
+		if hits, _ := mo.Search(q); len(hits) != 0 {
+			t.Fatalf(`len(mo.Search(%q)) = %d, want 0`, raw, len(hits))
+		}
+	}
+
+	q, _ := ParseSearchQuery("level")
+	hits, _ := mo.Search(q)
+	if len(hits) != 1 || hits[0].msg.id != 1 {
+		t.Fatalf(`mo.Search("level") = %v, want message 1`, hits)
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
 // SharedState contains all the information that a handler might need: every
 // handler is a method on this struct. As such, all fields and operations must
 // be safe for concurrent use.
@@ -8,8 +15,27 @@ package main
 // in closures, because I find having all shared state in one place makes it
 // easier to understand a service at a glance and reduces boilerplate code.
 type SharedState struct {
-	mo MessageOrchestrator
-	po WorkOrchestrator[Message, PWKey, PWResult]
+	// the message store of every tenant
+	tenants *Tenants
+	// the tenant this SharedState is scoped to, and its message store (see
+	// ForTenant). Both are empty in the SharedState shared by every tenant.
+	tenant string
+	mo     MessageOrchestrator
+	po     WorkOrchestrator[Message, PWKey, PWResult]
+	// every installed analyzer, including the palindrome one (done by po)
+	analyzers *AnalyzerRegistry
+	// requests handled, see CountRequests
+	metrics *Metrics
+	// how big message payloads can be, see ReadMessagePayload
+	limits ValidationLimits
+	// every API key, or nil if the API is open (see Authenticate)
+	keys *KeyStore
+	// how many requests each client can make, or nil if they're not limited
+	// (see RateLimit)
+	limiter *RateLimiter
+	// closed when the server starts shutting down, see BeginShutdown
+	shuttingDown chan struct{}
+	shutdownOnce *sync.Once
 }
 
 // MessageOrchestration is an interface for a service that can store and
@@ -17,26 +43,154 @@ type SharedState struct {
 // the underlying implementation (maybe switching to a database) without
 // changing the rest of the code.
 type MessageOrchestrator interface {
-	Add(text string) (Message, error)
+	Add(text string, settings PSettings) (Message, error)
 	Get(id int) (Message, bool, error)
-	Update(id int, text string) (Message, error)
+	Update(id int, text string, settings PSettings) (Message, error)
+	// CompareAndUpdate is like Update, but only if the message is still at
+	// revision rev. If it isn't, it returns ErrRevisionMismatch.
+	CompareAndUpdate(id int, text string, settings PSettings, rev int) (Message, error)
 	Delete(id int) error
+	// CompareAndDelete is like Delete, but only if the message is still at
+	// revision rev. If it isn't (or it doesn't exist), it returns
+	// ErrRevisionMismatch.
+	CompareAndDelete(id int, rev int) error
 	GetAll() ([]Message, error)
-	DeleteAll() error
+	// Stats returns how many messages (and revisions) there are, see
+	// MessageStats.
+	Stats() (MessageStats, error)
+	List(opts ListOptions) ([]Message, error)
+	Search(q SearchQuery) ([]SearchHit, error)
+	// DeleteAll removes every message, and returns what was removed.
+	DeleteAll() ([]Message, error)
+	// Revisions returns every revision of a message, oldest first, or false if
+	// the message doesn't exist.
+	Revisions(id int) ([]Revision, bool, error)
+	// SetRevisionResult records the palindrome result of a past revision.
+	SetRevisionResult(id int, rev int, isPalindrome int) error
+	// Apply runs a batch of operations in order, as a single change: nothing
+	// else can happen in between them. Each operation gets a result, in the
+	// same order (see MessageOpResult). If atomic is true, either every
+	// operation is applied or none are.
+	Apply(ops []MessageOp, atomic bool) ([]MessageOpResult, error)
+}
+
+// MessageStats is a summary of a MessageOrchestrator: how many messages there
+// are, how many revisions they have between them, and nextId, the id that was
+// most recently handed out (the next message gets nextId + 1).
+type MessageStats struct {
+	messages  int
+	revisions int
+	nextId    int
 }
 
-// Message is a simple struct for storing a message. It has three fields: an id
-// (integer, unique, ascending), a hash (string, calculated from the text,
-// hopefully unique), and the text (string, provided by the user). On adding a
-// message to Messages, all three fields will be populated.
+// MESSAGE_OP_CREATE, MESSAGE_OP_UPDATE, and MESSAGE_OP_DELETE are the things a
+// MessageOp can do.
+const (
+	MESSAGE_OP_CREATE = "create"
+	MESSAGE_OP_UPDATE = "update"
+	MESSAGE_OP_DELETE = "delete"
+)
+
+// MessageOp is one operation in a batch, for MessageOrchestrator.Apply.
+// Creates use text and settings, and id if it isn't 0 (the message gets that
+// id, which mustn't be taken, and it's never handed out again; otherwise it
+// gets the next one). Updates use id, text, and settings (empty settings keep
+// the message's current ones, like updateMessage), and deletes only use id. If
+// rev isn't 0, an update or delete only happens if the message is at that
+// revision.
+type MessageOp struct {
+	op       string
+	id       int
+	text     string
+	settings PSettings
+	rev      int
+}
+
+// MessageOpResult is the outcome of a MessageOp. Msg is the created or updated
+// message, or the message that was deleted, and old is what an updated message
+// was before. Err is ErrMessageNotFound, ErrRevisionMismatch,
+// ErrMessageExists, or ErrQuotaExceeded if the operation failed, or
+// ErrBatchAborted if it wasn't applied because another operation in an atomic
+// batch failed.
+type MessageOpResult struct {
+	msg Message
+	old Message
+	err error
+}
+
+// ErrMessageExists is the error of a MessageOp which creates a message with an
+// id that's already taken.
+var ErrMessageExists = errors.New("message already exists")
+
+// ErrBatchAborted is the error of every operation in an atomic batch which
+// would have worked, if another operation hadn't failed (see
+// MessageOrchestrator.Apply).
+var ErrBatchAborted = errors.New("batch aborted")
+
+// ErrRevisionMismatch is returned by MessageOrchestrator.CompareAndUpdate and
+// CompareAndDelete when the message was changed by someone else first.
+var ErrRevisionMismatch = errors.New("message revision mismatch")
+
+// ErrQuotaExceeded is returned when creating a message would give a tenant
+// more messages than its quota (see Messages.SetQuota).
+var ErrQuotaExceeded = errors.New("message quota exceeded")
+
+// ListOptions describes a page of messages, for MessageOrchestrator.List. Only
+// messages with IdGt < id < IdLt are included (0 means no bound). They're in
+// ascending order by id, unless Descending is true. At most Limit messages are
+// returned (0 means no limit).
+type ListOptions struct {
+	IdGt       int
+	IdLt       int
+	Limit      int
+	Descending bool
+}
+
+// Message is a simple struct for storing a message. It has eight fields: the
+// tenant it belongs to (see Tenants), an id (integer, unique within the
+// tenant, ascending), a hash (string, calculated from the text and
+// settings, hopefully unique), the text (string, provided by the user), the
+// settings used to decide if the text is a palindrome, a revision (integer, 1
+// when the message is created, then +1 every update), and when the message was
+// created and last updated. On adding a message to Messages, all eight fields
+// will be populated.
 //
 // Hash is used to de-duplicate work when calculating palindromes. If two
-// messages have the same text, then they will have the same hash, and so only
-// one palindrome calculation needs to be done.
+// messages have the same text and settings, then they will have the same hash,
+// and so only one palindrome calculation needs to be done. That's true across
+// tenants too: the hash doesn't depend on the tenant.
 type Message struct {
-	id   int
-	hash string
-	text string
+	tenant    string
+	id        int
+	hash      string
+	text      string
+	settings  PSettings
+	revision  int
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+// PSettings (aka PalindromeSettings) are chosen per message, and decide how its
+// text is checked. Profile is a normalization profile (like PROFILE_ASCII), and
+// mode decides what is compared (like MODE_WORD). An empty field means the
+// default (see PSettings.withDefaults).
+type PSettings struct {
+	profile string
+	mode    string
+}
+
+// Revision is one version of a message's text (and settings). Every time a
+// message is updated it gets a new revision, and the old ones are kept. Rev
+// starts at 1 and counts up, createdAt is when the message was changed to this
+// text, and isPalindrome is the palindrome result as of when the revision was
+// replaced (P_UNKNOWN for the current revision, or if work wasn't done yet).
+type Revision struct {
+	rev          int
+	text         string
+	settings     PSettings
+	hash         string
+	createdAt    time.Time
+	isPalindrome int
 }
 
 // WorkOrchestrator is an interface for helping manage long-running tasks, all
@@ -59,34 +213,120 @@ type WorkOrchestrator[D any, K any, R any] interface {
 	Poll(key K) (found bool, current R, onChange <-chan R, err error)
 	// Clear cancels all work and removes all results.
 	Clear() error
+	// Shutdown stops doing work. If drain is true, work that's already been
+	// added is finished first, unless ctx is done before then. Whatever work
+	// is left is cancelled. It returns ctx's error if it ran out of time.
+	Shutdown(ctx context.Context, drain bool) error
 }
 
 // PWResult (aka PalindromeWorkResult) is the result of a palindrome
-// calculation. It has two fields: isPalindrome (P_UNKNOWN, P_TRUE, or P_FALSE)
-// and done (bool).
+// calculation. It has seven fields: isPalindrome (P_UNKNOWN, P_TRUE, or
+// P_FALSE), status (PW_PENDING, PW_RUNNING, PW_DONE, PW_CANCELLED, or
+// PW_FAILED), done (bool, true once status won't change anymore),
+// queuePosition (1 for the front of the queue, 2 for the next, etc. or 0 if the
+// work isn't waiting in a queue), the settings used for the calculation, an
+// analysis of the palindromes inside the text (only set once status is
+// PW_DONE), and extra.
+//
+// Other analyzers (see Analyzer) use the same result type: status, done, and
+// queuePosition mean the same thing, and whatever they work out goes in extra,
+// which only that analyzer reads (see AnagramAnalyzer and StatsAnalyzer). It's
+// nil for palindrome results.
 type PWResult struct {
-	isPalindrome int
-	done         bool
+	isPalindrome  int
+	status        int
+	done          bool
+	queuePosition int
+	settings      PSettings
+	analysis      PAnalysis
+	extra         any
+}
+
+// PAnalysis (aka PalindromeAnalysis) describes the palindromes inside some
+// text, after it's been normalized. The longest palindromic substring is
+// longestLength units long (normalized characters, or whole words or lines,
+// depending on the mode), and came from longestStart to longestEnd in the
+// original text (rune offsets, end exclusive). maximalCount is the number of
+// maximal palindromic substrings: palindromes which can't be extended by a unit
+// on both sides. near says how close the text is to being a palindrome.
+type PAnalysis struct {
+	longestStart  int
+	longestEnd    int
+	longestLength int
+	maximalCount  int
+	near          PNearness
+}
+
+// PNearness (aka PalindromeNearness) describes how close some text is to being
+// a palindrome, after it's been normalized. insertions is the fewest units
+// which need to be inserted to make it a palindrome, and repaired is one
+// palindrome that can be made that way (normalized text). substitutions is the
+// fewest units which need to be replaced instead. score (aka palindromicity) is
+// between 0 and 1, the length of the longest palindromic subsequence divided by
+// the length of the text: 1 for a palindrome. If computed is false, none of the
+// other fields are set, because there was nothing to compare or the text was
+// too long (see NEAR_MAX_UNITS).
+type PNearness struct {
+	computed      bool
+	insertions    int
+	substitutions int
+	repaired      string
+	score         float64
 }
 
 // PWKey (aka PalindromeWorkKey) is the unique identifier for a piece of
-// palindrome calculation work. It has two fields: hash (string, hopefully
-// unique to some text) and messageId (integer, unique to a message). Hash
-// determines isPalindrome, while messageId determines onChange (each message
-// gets its own listener).
+// palindrome calculation work. It has three fields: hash (string, hopefully
+// unique to some text), tenant, and messageId (integer, unique to a message
+// within its tenant). Hash determines isPalindrome, while tenant and messageId
+// determine onChange (each message gets its own listener).
 type PWKey struct {
 	hash      string
+	tenant    string
 	messageId int
 }
 
-// NewSharedState initializes all fields so they're ready to use. It should be
-// called once at the beginning of the program.
-func NewSharedState() SharedState {
-	mo := NewMessages()
-	po := NewPalindromes()
+// MessageRef refers to a message, of any tenant. It's how Palindromes tells
+// its listeners apart.
+type MessageRef struct {
+	tenant string
+	id     int
+}
 
+// NewSharedState initializes all fields so they're ready to use. It should be
+// called once at the beginning of the program. Messages are stored in tenants
+// (see ForTenant), which could be in-memory (Messages) or on disk
+// (DurableMessages), and palindrome work is done by po, for every tenant.
+// Every other analyzer in analyzers is run on every message
+// too (po should be registered in analyzers as well, with PalindromeAnalyzer).
+func NewSharedState(tenants *Tenants, po WorkOrchestrator[Message, PWKey, PWResult], analyzers *AnalyzerRegistry) SharedState {
 	return SharedState{
-		mo: &mo,
-		po: &po,
+		tenants:      tenants,
+		po:           po,
+		analyzers:    analyzers,
+		metrics:      NewMetrics(),
+		limits:       DEFAULT_VALIDATION_LIMITS,
+		shuttingDown: make(chan struct{}),
+		shutdownOnce: &sync.Once{},
+	}
+}
+
+// BeginShutdown tells long-running handlers (event streams, and requests
+// waiting for a result) that the server is shutting down, so they should
+// respond with what they've got and finish up. Otherwise the server would have
+// to wait for them until its shutdown deadline. It's safe to call more than
+// once.
+func (ss *SharedState) BeginShutdown() {
+	ss.shutdownOnce.Do(func() {
+		close(ss.shuttingDown)
+	})
+}
+
+// isShuttingDown returns true once BeginShutdown has been called.
+func (ss *SharedState) isShuttingDown() bool {
+	select {
+	case <-ss.shuttingDown:
+		return true
+	default:
+		return false
 	}
 }
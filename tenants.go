@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// This file contains tenants: separate namespaces for messages, so several
+// teams can share one deployment without seeing (or deleting) each other's
+// messages. Every tenant has its own MessageOrchestrator, so ids, listing,
+// searching, exporting, and deleting everything are all per tenant. Palindrome
+// work isn't though: it's still shared by every message with the same hash,
+// whichever tenant it's in (see Palindromes.Add).
+//
+// A request's tenant comes from its API key, if it has one (see
+// Authenticate), otherwise from the X-Tenant-ID header, otherwise it's
+// DEFAULT_TENANT (see TenantOf). A tenant's store is only opened (created, if
+// it's new) when something is written to it, and can be restricted to the
+// tenants in TENANTS and API_KEYS_FILE (see Tenants.Restrict). Otherwise only
+// MAX_TENANTS stores can be opened (see Tenants.SetMaxTenants), so a client
+// can't use up the server's disk or file descriptors by making up tenants.
+
+// DEFAULT_TENANT is the tenant of requests which don't say otherwise. It's
+// where every message lived before there were tenants.
+const DEFAULT_TENANT = "default"
+
+// DEFAULT_MAX_TENANTS is how many tenants can be opened (see
+// Tenants.SetMaxTenants), unless MAX_TENANTS says otherwise (see main).
+const DEFAULT_MAX_TENANTS = 100
+
+// TENANT_HEADER is the request header which picks a tenant, if the request
+// doesn't have an API key.
+const TENANT_HEADER = "X-Tenant-ID"
+
+// TENANT_NAME_PATTERN is what a tenant name has to look like: lowercase
+// letters, digits, dashes, and underscores, starting with a letter or digit,
+// and at most 64 characters. It's safe to use as a directory name.
+var TENANT_NAME_PATTERN = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ValidateTenantName returns an error if name isn't a valid tenant name (see
+// TENANT_NAME_PATTERN).
+func ValidateTenantName(name string) error {
+	if !TENANT_NAME_PATTERN.MatchString(name) {
+		return fmt.Errorf("tenant %q must be 1 to 64 lowercase letters, digits, dashes, or underscores", name)
+	}
+	return nil
+}
+
+// TenantOpener creates (or loads) the message store of a tenant. The returned
+// function is called when the store is closed (see Tenants.Close).
+type TenantOpener func(tenant string) (MessageOrchestrator, func(), error)
+
+// Tenants holds the message store of every tenant. A tenant's store is opened
+// the first time it's written to, so tenants don't have to be set up ahead of
+// time (unless they're restricted, see Restrict), but only up to a limit (see
+// SetMaxTenants). It is safe for concurrent use.
+type Tenants struct {
+	lock   sync.Mutex
+	open   TenantOpener
+	stores map[string]MessageOrchestrator
+	// the only tenants whose stores can be opened, or nil for any tenant
+	allowed map[string]bool
+	// the most stores which can be open, unless they're in allowed. 0 means
+	// no limit.
+	maxOpen int
+	// called by Close, one per store
+	closers []func()
+}
+
+// NewTenants creates a Tenants with no stores open yet. Stores are opened with
+// open.
+func NewTenants(open TenantOpener) *Tenants {
+	return &Tenants{
+		open:   open,
+		stores: make(map[string]MessageOrchestrator),
+	}
+}
+
+// ErrTenantNotAllowed is returned by Tenants.Get when a tenant's store isn't
+// open, and can't be (see Tenants.Restrict and Tenants.SetMaxTenants).
+var ErrTenantNotAllowed = errors.New("tenant isn't configured")
+
+// Restrict only allows the stores of names (and DEFAULT_TENANT) to be opened
+// from now on. Stores which are already open stay open.
+func (t *Tenants) Restrict(names []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.allowed = map[string]bool{DEFAULT_TENANT: true}
+	for _, name := range names {
+		t.allowed[name] = true
+	}
+}
+
+// SetMaxTenants only allows max stores to be open at once (0 means no limit).
+// Tenants which Restrict allows can always be opened, and stores which are
+// already open stay open, even if there are more than max.
+func (t *Tenants) SetMaxTenants(max int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.maxOpen = max
+}
+
+// Get returns the message store of tenant, opening it if it isn't already. It
+// returns an error if the tenant's name isn't valid (see ValidateTenantName),
+// ErrTenantNotAllowed if it isn't one of the tenants it's restricted to, or
+// there are already too many open (see SetMaxTenants), or an error if its store
+// can't be opened.
+func (t *Tenants) Get(tenant string) (MessageOrchestrator, error) {
+	if err := ValidateTenantName(tenant); err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if mo, ok := t.stores[tenant]; ok {
+		return mo, nil
+	}
+	switch {
+	case t.allowed[tenant]:
+		// always allowed, however many are open
+	case t.allowed != nil:
+		return nil, fmt.Errorf("%w: %q", ErrTenantNotAllowed, tenant)
+	case t.maxOpen > 0 && len(t.stores) >= t.maxOpen:
+		return nil, fmt.Errorf("%w: %q, there are already %d tenants", ErrTenantNotAllowed, tenant, len(t.stores))
+	}
+
+	mo, closeMo, err := t.open(tenant)
+	if err != nil {
+		return nil, err
+	}
+	t.stores[tenant] = mo
+	t.closers = append(t.closers, closeMo)
+
+	return mo, nil
+}
+
+// Lookup returns the message store of tenant, if it's open. Unlike Get, it
+// never opens one.
+func (t *Tenants) Lookup(tenant string) (MessageOrchestrator, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	mo, ok := t.stores[tenant]
+	return mo, ok
+}
+
+// namedStore is the message store of a tenant.
+type namedStore struct {
+	name string
+	mo   MessageOrchestrator
+}
+
+// All returns the store of every tenant which has been opened, sorted by name.
+func (t *Tenants) All() []namedStore {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	out := make([]namedStore, 0, len(t.stores))
+	for _, name := range sortedKeys(t.stores) {
+		out = append(out, namedStore{name: name, mo: t.stores[name]})
+	}
+	return out
+}
+
+// Close closes every store. Tenants can't be used afterwards.
+func (t *Tenants) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, closeMo := range t.closers {
+		closeMo()
+	}
+	t.closers = nil
+}
+
+// ErrTenantMismatch is returned by TenantOf when the X-Tenant-ID header asks for
+// a different tenant than the request's API key belongs to.
+var ErrTenantMismatch = errors.New("tenant doesn't match the API key")
+
+// TenantOf returns the tenant a request is for. If it was made with an API key
+// (see APIKeyFromContext), that's the key's tenant; the X-Tenant-ID header can
+// be sent too, but it has to match (otherwise ErrTenantMismatch is returned).
+// Otherwise it's the header, or DEFAULT_TENANT if there's no header. The name
+// isn't validated, Tenants.Get does that.
+func TenantOf(r *http.Request) (string, error) {
+	header := r.Header.Get(TENANT_HEADER)
+
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		if header != "" && header != key.tenant {
+			return "", fmt.Errorf("%w: the API key %q belongs to tenant %q, not %q", ErrTenantMismatch, key.id, key.tenant, header)
+		}
+		return key.tenant, nil
+	}
+
+	if header != "" {
+		return header, nil
+	}
+	return DEFAULT_TENANT, nil
+}
+
+// ForTenant returns a copy of ss which is scoped to tenant: its mo is the
+// tenant's message store, so every message operation (see
+// message_operations.go) only sees that tenant's messages. Everything else is
+// shared. If open is false and the tenant's store isn't open yet, mo is an
+// empty in-memory store which isn't kept, so reading from a tenant that
+// doesn't exist doesn't create it (writing to mo would lose the messages).
+func (ss *SharedState) ForTenant(tenant string, open bool) (*SharedState, error) {
+	var mo MessageOrchestrator
+	if open {
+		var err error
+		if mo, err = ss.tenants.Get(tenant); err != nil {
+			return nil, err
+		}
+	} else if found, ok := ss.tenants.Lookup(tenant); ok {
+		mo = found
+	} else {
+		empty := NewTenantMessages(tenant)
+		mo = &empty
+	}
+
+	ts := *ss
+	ts.tenant = tenant
+	ts.mo = mo
+	return &ts, nil
+}
+
+// Tenanted turns a handler which works on a single tenant's messages (like
+// (*SharedState).CreateMessage) into one which runs it on the request's tenant
+// (see TenantOf and ForTenant). Only requests which can change messages (any
+// method but GET and HEAD) open the tenant's store, so a GET for a tenant
+// which doesn't exist sees no messages, and creates nothing. It returns 400 if
+// the tenant's name isn't valid, and 403 if it doesn't match the request's API
+// key, or the store isn't open and can't be (see Tenants.Restrict).
+func (ss *SharedState) Tenanted(handler func(*SharedState, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// find the tenant
+		tenant, err := TenantOf(r)
+		if err != nil {
+			WriteProblem(w, r, E_FORBIDDEN, err.Error())
+			return
+		}
+		if err := ValidateTenantName(tenant); err != nil {
+			WriteProblem(w, r, E_INVALID_TENANT, err.Error())
+			return
+		}
+
+		// and its messages
+		open := r.Method != http.MethodGet && r.Method != http.MethodHead
+		ts, err := ss.ForTenant(tenant, open)
+		if errors.Is(err, ErrTenantNotAllowed) {
+			WriteProblem(w, r, E_FORBIDDEN, err.Error())
+			return
+		} else if err != nil {
+			log.Println(err)
+			WriteProblem(w, r, E_INTERNAL, "")
+			return
+		}
+
+		handler(ts, w, r)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newFakeTenants returns in-memory Tenants, and a count of how many stores
+// have been opened.
+func newFakeTenants() (*Tenants, *int) {
+	opened := 0
+	return NewTenants(func(tenant string) (MessageOrchestrator, func(), error) {
+		opened++
+		mo := NewTenantMessages(tenant)
+		return &mo, func() {}, nil
+	}), &opened
+}
+
+func TestTenantsGet(t *testing.T) {
+	tenants, opened := newFakeTenants()
+
+	a, err := tenants.Get("team-a")
+	if err != nil {
+		t.Fatalf(`tenants.Get("team-a") has err %+v, want nil`, err)
+	}
+	again, _ := tenants.Get("team-a")
+	if a != again || *opened != 1 {
+		t.Fatalf(`tenants.Get("team-a") twice opened %d stores, want 1`, *opened)
+	}
+
+	msg, _ := a.Add("racecar", PSettings{})
+	if msg.tenant != "team-a" {
+		t.Fatalf(`a.Add("racecar") tenant = %q, want "team-a"`, msg.tenant)
+	}
+	b, _ := tenants.Get("team-b")
+	if _, found, _ := b.Get(msg.id); found {
+		t.Fatalf(`b.Get(%d) found a message of another tenant`, msg.id)
+	}
+
+	for _, name := range []string{"", "Team", "-a", "a/b", "../a"} {
+		if _, err := tenants.Get(name); err == nil {
+			t.Fatalf(`tenants.Get(%q) has no err, want one`, name)
+		}
+	}
+
+	all := tenants.All()
+	if len(all) != 2 || all[0].name != "team-a" || all[1].name != "team-b" {
+		t.Fatalf(`tenants.All() = %+v, want team-a and team-b`, all)
+	}
+
+	// looking a tenant up doesn't open it
+	if mo, ok := tenants.Lookup("team-a"); !ok || mo != a {
+		t.Fatalf(`tenants.Lookup("team-a") = %v, %t, want team-a's store`, mo, ok)
+	}
+	if _, ok := tenants.Lookup("team-c"); ok || *opened != 2 {
+		t.Fatalf(`tenants.Lookup("team-c") found it, or opened a store`)
+	}
+
+	// once restricted, only the tenants allowed (and ones already open) can
+	// be opened
+	tenants.Restrict([]string{"team-c"})
+	for _, name := range []string{"team-a", "team-c", DEFAULT_TENANT} {
+		if _, err := tenants.Get(name); err != nil {
+			t.Fatalf(`tenants.Get(%q) after Restrict has err %+v, want nil`, name, err)
+		}
+	}
+	if _, err := tenants.Get("team-d"); !errors.Is(err, ErrTenantNotAllowed) {
+		t.Fatalf(`tenants.Get("team-d") after Restrict has err %+v, want %+v`, err, ErrTenantNotAllowed)
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	key := APIKey{id: "reader", tenant: "team-a"}
+
+	tests := []struct {
+		header string
+		key    bool
+		tenant string
+		err    error
+	}{
+		{"", false, DEFAULT_TENANT, nil},
+		{"team-b", false, "team-b", nil},
+		{"", true, "team-a", nil},
+		{"team-a", true, "team-a", nil},
+		{"team-b", true, "", ErrTenantMismatch},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/messages", nil)
+		if test.header != "" {
+			r.Header.Set(TENANT_HEADER, test.header)
+		}
+		if test.key {
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+		}
+
+		tenant, err := TenantOf(r)
+		if tenant != test.tenant || !errors.Is(err, test.err) {
+			t.Fatalf(`TenantOf(header %q, key %t) = %q, %+v, want %q, %+v`, test.header, test.key, tenant, err, test.tenant, test.err)
+		}
+	}
+}
+
+func TestTenanted(t *testing.T) {
+	tenants, opened := newFakeTenants()
+	tenants.Restrict([]string{"team-a", "team-b"})
+	ss := SharedState{tenants: tenants}
+	handler := ss.Tenanted(func(ts *SharedState, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Tenant", ts.tenant)
+		if r.Method == "POST" {
+			ts.mo.Add("racecar", PSettings{})
+		}
+		all, _ := ts.mo.GetAll()
+		w.Header().Set("X-Count", strconv.Itoa(len(all)))
+	})
+
+	tests := []struct {
+		method string
+		header string
+		status int
+		tenant string
+		count  string
+		opened int
+	}{
+		{"GET", "", http.StatusOK, DEFAULT_TENANT, "0", 0},
+		{"GET", "team-a", http.StatusOK, "team-a", "0", 0},
+		{"POST", "team-a", http.StatusOK, "team-a", "1", 1},
+		{"GET", "team-a", http.StatusOK, "team-a", "1", 1},
+		{"GET", "team-c", http.StatusOK, "team-c", "0", 1},
+		{"POST", "team-c", http.StatusForbidden, "", "", 1},
+		{"GET", "Not A Tenant", http.StatusBadRequest, "", "", 1},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/messages", nil)
+		if test.header != "" {
+			r.Header.Set(TENANT_HEADER, test.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != test.status || w.Header().Get("X-Tenant") != test.tenant || w.Header().Get("X-Count") != test.count {
+			t.Fatalf(`%s with %s %q status = %d, tenant = %q, count = %q, want %d, %q, %q`, test.method, TENANT_HEADER, test.header, w.Code, w.Header().Get("X-Tenant"), w.Header().Get("X-Count"), test.status, test.tenant, test.count)
+		}
+		if *opened != test.opened {
+			t.Fatalf(`%s with %s %q opened %d stores, want %d`, test.method, TENANT_HEADER, test.header, *opened, test.opened)
+		}
+	}
+}
+
+func TestTenantedMaxTenants(t *testing.T) {
+	tenants, opened := newFakeTenants()
+	tenants.SetMaxTenants(2)
+	ss := SharedState{tenants: tenants}
+	handler := ss.Tenanted(func(ts *SharedState, w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"team-a", http.StatusOK},
+		{"team-b", http.StatusOK},
+		{"team-c", http.StatusForbidden},
+		{"team-a", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/messages", nil)
+		r.Header.Set(TENANT_HEADER, test.header)
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != test.status {
+			t.Fatalf(`POST with %s %q status = %d, want %d`, TENANT_HEADER, test.header, w.Code, test.status)
+		}
+	}
+	if *opened != 2 {
+		t.Fatalf(`opened %d stores, want 2`, *opened)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file contains the validation of message payloads (creating and updating
+// messages, and the operations of a batch). Instead of stopping at the first
+// problem, as many as possible are collected, each one for a specific field
+// (see FieldError), so clients can fix them all at once.
+
+// ValidationLimits are the limits of request bodies and message text. They can
+// be set with MAX_BODY_BYTES, MAX_BATCH_BYTES, MAX_IMPORT_BYTES,
+// MAX_TEXT_BYTES, and MAX_TEXT_RUNES (see main).
+type ValidationLimits struct {
+	// the most bytes the body of a request to create or update a message can
+	// have
+	maxBodyBytes int64
+	// the most bytes the body of a batch can have
+	maxBatchBytes int64
+	// the most bytes the body of an import can have
+	maxImportBytes int64
+	// the most bytes a message's text can have (as UTF-8)
+	maxTextBytes int
+	// the most characters (code points) a message's text can have
+	maxTextRunes int
+}
+
+// DEFAULT_VALIDATION_LIMITS are used if they're not set in the environment.
+// The body can be a lot bigger than the text, as characters in a JSON string can
+// be escaped (up to 12 bytes for one character). Batches and imports have many
+// messages, so they get more room, but still not so much that one request can
+// use up the server's memory (or keep it busy for hours).
+var DEFAULT_VALIDATION_LIMITS = ValidationLimits{
+	maxBodyBytes:   1 << 20,
+	maxBatchBytes:  32 << 20,
+	maxImportBytes: 256 << 20,
+	maxTextBytes:   64 << 10,
+	maxTextRunes:   16 << 10,
+}
+
+// The codes of FieldErrors: why a field is invalid.
+const (
+	// the field is missing, or empty
+	FIELD_REQUIRED = "required"
+	// the field isn't one we know about
+	FIELD_UNKNOWN = "unknown"
+	// the field has the wrong JSON type, like a number instead of a string
+	FIELD_WRONG_TYPE = "wrong_type"
+	// the field isn't valid UTF-8
+	FIELD_INVALID_UTF8 = "invalid_utf8"
+	// the field is longer than it's allowed to be
+	FIELD_TOO_LONG = "too_long"
+	// the field isn't one of the values allowed
+	FIELD_INVALID = "invalid"
+)
+
+// FieldError says what's wrong with one field of a payload. field is the name
+// of the field in the JSON payload, like "text" (or "operations[2].text" for a
+// batch), code is one of the FIELD_ constants, and detail is human-readable.
+type FieldError struct {
+	field  string
+	code   string
+	detail string
+}
+
+// ValidationError is returned when a payload has one or more invalid fields.
+type ValidationError struct {
+	fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	details := make([]string, 0, len(e.fields))
+	for _, f := range e.fields {
+		details = append(details, f.detail)
+	}
+	return strings.Join(details, "; ")
+}
+
+// validationErrorOrNil returns a *ValidationError if there are any fields,
+// otherwise nil (not a nil *ValidationError, which isn't a nil error).
+func validationErrorOrNil(fields []FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &ValidationError{fields: fields}
+}
+
+// ReadMessagePayload reads the body of a request to create or update a message
+// (see DecodeStrict), then validates it (see ValidateMessage). It returns the
+// payload and its settings. The error is a *http.MaxBytesError if the body is
+// too big, a *ValidationError if any fields are invalid, otherwise the body
+// isn't valid JSON.
+func ReadMessagePayload[T CreateMessageRequestData | UpdateMessageRequestData](w http.ResponseWriter, r *http.Request, limits ValidationLimits) (T, PSettings, error) {
+	var payload T
+	if err := DecodeStrict(w, r, limits.maxBodyBytes, &payload); err != nil {
+		return payload, PSettings{}, err
+	}
+
+	// both types have the same fields
+	fields := CreateMessageRequestData(payload)
+	settings, err := ValidateMessage(fields.Text, fields.Profile, fields.Mode, limits)
+	return payload, settings, err
+}
+
+// DecodeStrict reads a JSON object, of at most maxBytes (0 means no limit),
+// from the body of a request into dst, which has to point to a struct. Unlike
+// a plain json.Decoder, it doesn't allow unknown fields (see jsonFieldNames),
+// invalid UTF-8 (which would otherwise be silently replaced), or anything
+// after the object. Every unknown field or field with invalid UTF-8 is
+// reported, but only the first field with the wrong type is (that's all
+// json.Decoder tells us).
+func DecodeStrict(w http.ResponseWriter, r *http.Request, maxBytes int64, dst any) error {
+	reader := r.Body
+	if maxBytes > 0 {
+		reader = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	// check the raw bytes of each field, before they're decoded
+	var raw map[string]json.RawMessage
+	var typeErr *json.UnmarshalTypeError
+	if err := json.Unmarshal(body, &raw); errors.As(err, &typeErr) {
+		return errors.New("the body must be a JSON object")
+	} else if err != nil {
+		return err
+	}
+	fields := []FieldError{}
+	for _, name := range sortedKeys(raw) {
+		if !utf8.Valid(raw[name]) || !utf8.ValidString(name) {
+			name = strings.ToValidUTF8(name, "\uFFFD")
+			fields = append(fields, FieldError{field: name, code: FIELD_INVALID_UTF8, detail: fmt.Sprintf("%s isn't valid UTF-8", name)})
+		}
+	}
+	if len(fields) > 0 {
+		return validationErrorOrNil(fields)
+	}
+	known := jsonFieldNames(reflect.TypeOf(dst))
+	for _, name := range sortedKeys(raw) {
+		if !slices.ContainsFunc(known, func(k string) bool { return strings.EqualFold(k, name) }) {
+			fields = append(fields, FieldError{field: name, code: FIELD_UNKNOWN, detail: fmt.Sprintf("%s isn't a known field", name)})
+		}
+	}
+	if len(fields) > 0 {
+		return validationErrorOrNil(fields)
+	}
+
+	// then decode them properly
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(dst)
+	if errors.As(err, &typeErr) {
+		return validationErrorOrNil([]FieldError{{field: typeErr.Field, code: FIELD_WRONG_TYPE, detail: fmt.Sprintf("%s must be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)}})
+	}
+	return err
+}
+
+// jsonFieldNames returns the names encoding/json uses for the fields of a
+// struct (or a pointer to one): the name in the json tag if there is one,
+// otherwise the name of the field. Unexported fields and fields tagged "-"
+// are left out, and the fields of embedded structs are included, like
+// json.Unmarshal does. Names are matched without case, also like
+// json.Unmarshal.
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	names := []string{}
+	for _, f := range reflect.VisibleFields(t) {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case len(f.Index) > 1:
+			// a field of an embedded struct, found with the struct below
+			continue
+		case f.Anonymous && name == "":
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		case !f.IsExported() || name == "-":
+			continue
+		case name == "":
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// ValidateMessage checks the fields of a message payload: text is required
+// (it can't be empty), has to be valid UTF-8, and can't be longer than the
+// limits; profile and mode have to be empty or valid (see ParseSettings). It
+// returns the settings, or a *ValidationError with every invalid field.
+func ValidateMessage(text string, profile string, mode string, limits ValidationLimits) (PSettings, error) {
+	fields := ValidateText("text", text, limits)
+
+	// one at a time, so both can be reported
+	if _, err := ParseSettings(profile, ""); err != nil {
+		fields = append(fields, FieldError{field: "profile", code: FIELD_INVALID, detail: err.Error()})
+	}
+	if _, err := ParseSettings("", mode); err != nil {
+		fields = append(fields, FieldError{field: "mode", code: FIELD_INVALID, detail: err.Error()})
+	}
+
+	if err := validationErrorOrNil(fields); err != nil {
+		return PSettings{}, err
+	}
+	return PSettings{profile: profile, mode: mode}, nil
+}
+
+// ValidateText checks the text of a message (see ValidateMessage). field is
+// its name, for the FieldErrors.
+func ValidateText(field string, text string, limits ValidationLimits) []FieldError {
+	switch {
+	case text == "":
+		return []FieldError{{field: field, code: FIELD_REQUIRED, detail: fmt.Sprintf("%s is required", field)}}
+	case !utf8.ValidString(text):
+		return []FieldError{{field: field, code: FIELD_INVALID_UTF8, detail: fmt.Sprintf("%s isn't valid UTF-8", field)}}
+	case limits.maxTextBytes > 0 && len(text) > limits.maxTextBytes:
+		return []FieldError{{field: field, code: FIELD_TOO_LONG, detail: fmt.Sprintf("%s can be at most %d bytes", field, limits.maxTextBytes)}}
+	case limits.maxTextRunes > 0 && utf8.RuneCountInString(text) > limits.maxTextRunes:
+		return []FieldError{{field: field, code: FIELD_TOO_LONG, detail: fmt.Sprintf("%s can be at most %d characters", field, limits.maxTextRunes)}}
+	default:
+		return nil
+	}
+}
+
+// WritePayloadProblem responds to a request whose payload couldn't be read
+// (see ReadMessagePayload and DecodeStrict). If the payload had invalid fields,
+// the response has code, and says what's wrong with each field (see
+// ValidationProblemResponseData). If the body was too big, it's 413, otherwise
+// the body wasn't valid JSON.
+func WritePayloadProblem(w http.ResponseWriter, r *http.Request, code ErrorCode, err error) {
+	var tooBig *http.MaxBytesError
+	var invalid *ValidationError
+	switch {
+	case errors.As(err, &tooBig):
+		WriteProblem(w, r, E_BODY_TOO_LARGE, fmt.Sprintf("the body can be at most %d bytes", tooBig.Limit))
+	case errors.As(err, &invalid):
+		data := ValidationProblemResponseData{
+			ProblemResponseData: NewProblem(r, code, invalid.Error()),
+			Errors:              []FieldErrorResponseItem{},
+		}
+		for _, f := range invalid.fields {
+			data.Errors = append(data.Errors, FieldErrorResponseItem{Field: f.field, Code: f.code, Detail: f.detail})
+		}
+
+		w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+		w.WriteHeader(data.Status)
+		json.NewEncoder(w).Encode(data)
+	default:
+		WriteProblem(w, r, E_INVALID_JSON, err.Error())
+	}
+}
+
+// sortedKeys returns the keys of a map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadMessagePayload(t *testing.T) {
+	limits := ValidationLimits{maxBodyBytes: 100, maxTextBytes: 12, maxTextRunes: 8}
+
+	tests := []struct {
+		body   string
+		fields []string // invalid fields, nil if it should be read
+		codes  []string
+	}{
+		{body: `{"text": "racecar", "mode": "char"}`},
+		{body: `{"text": "éé"}`},
+		{body: `{}`, fields: []string{"text"}, codes: []string{FIELD_REQUIRED}},
+		{body: `{"text": ""}`, fields: []string{"text"}, codes: []string{FIELD_REQUIRED}},
+		{body: `{"txt": "x"}`, fields: []string{"txt"}, codes: []string{FIELD_UNKNOWN}},
+		{body: `{"Text": "racecar", "txt": "x", "mood": "x"}`, fields: []string{"mood", "txt"}, codes: []string{FIELD_UNKNOWN, FIELD_UNKNOWN}},
+		{body: `{"text": 5}`, fields: []string{"text"}, codes: []string{FIELD_WRONG_TYPE}},
+		{body: "{\"text\": \"a\xffb\"}", fields: []string{"text"}, codes: []string{FIELD_INVALID_UTF8}},
+		{body: `{"text": "abcdefghi"}`, fields: []string{"text"}, codes: []string{FIELD_TOO_LONG}},
+		{body: `{"text": "ééééééé"}`, fields: []string{"text"}, codes: []string{FIELD_TOO_LONG}},
+		{body: `{"profile": "nope", "mode": "nope"}`, fields: []string{"text", "profile", "mode"}, codes: []string{FIELD_REQUIRED, FIELD_INVALID, FIELD_INVALID}},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/messages", strings.NewReader(test.body))
+		_, _, err := ReadMessagePayload[CreateMessageRequestData](httptest.NewRecorder(), r, limits)
+
+		if test.fields == nil {
+			if err != nil {
+				t.Fatalf(`ReadMessagePayload(%s) has err %+v, want nil`, test.body, err)
+			}
+			continue
+		}
+
+		var ve *ValidationError
+		if !errors.As(err, &ve) {
+			t.Fatalf(`ReadMessagePayload(%s) has err %+v, want *ValidationError`, test.body, err)
+		}
+		if len(ve.fields) != len(test.fields) {
+			t.Fatalf(`ReadMessagePayload(%s) fields = %+v, want %v`, test.body, ve.fields, test.fields)
+		}
+		for i, f := range ve.fields {
+			if f.field != test.fields[i] || f.code != test.codes[i] {
+				t.Fatalf(`ReadMessagePayload(%s) fields[%d] = %+v, want %s %s`, test.body, i, f, test.fields[i], test.codes[i])
+			}
+		}
+	}
+}
+
+func TestReadMessagePayloadNotJSON(t *testing.T) {
+	for _, body := range []string{``, `{`, `[]`, `{"text": "a"} {}`} {
+		r := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+		_, _, err := ReadMessagePayload[UpdateMessageRequestData](httptest.NewRecorder(), r, DEFAULT_VALIDATION_LIMITS)
+
+		var ve *ValidationError
+		if err == nil || errors.As(err, &ve) {
+			t.Fatalf(`ReadMessagePayload(%s) has err %+v, want a JSON error`, body, err)
+		}
+	}
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	type Inner struct {
+		A string `json:"a"`
+		B string
+	}
+	type inner struct {
+		C string `json:"c"`
+	}
+	type outer struct {
+		Inner
+		inner
+		Named   Inner  `json:"named"`
+		D       string `json:"d,omitempty"`
+		Skipped string `json:"-"`
+		hidden  string
+	}
+
+	names := jsonFieldNames(reflect.TypeOf(&outer{}))
+	if want := []string{"a", "B", "c", "named", "d"}; !slices.Equal(names, want) {
+		t.Fatalf(`jsonFieldNames(outer) = %v, want %v`, names, want)
+	}
+	if names := jsonFieldNames(reflect.TypeOf(5)); names != nil {
+		t.Fatalf(`jsonFieldNames(int) = %v, want nil`, names)
+	}
+}
+
+func TestBatchMessagesTooBig(t *testing.T) {
+	ss := SharedState{limits: ValidationLimits{maxBatchBytes: 16}}
+	body := `{"operations": [{"op": "create", "text": "racecar"}]}`
+
+	w := httptest.NewRecorder()
+	ss.BatchMessages(w, httptest.NewRequest("POST", "/messages:batch", strings.NewReader(body)))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"code":"body_too_large"`) {
+		t.Fatalf(`BatchMessages(%d bytes) = %d %s, want 413 %s`, len(body), w.Code, w.Body, E_BODY_TOO_LARGE)
+	}
+}
+
+func TestWritePayloadProblem(t *testing.T) {
+	limits := ValidationLimits{maxBodyBytes: 10}
+
+	// too big
+	r := httptest.NewRequest("POST", "/messages", strings.NewReader(`{"text": "racecar"}`))
+	w := httptest.NewRecorder()
+	_, _, err := ReadMessagePayload[CreateMessageRequestData](w, r, limits)
+	WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf(`WritePayloadProblem(%v) status = %d, want 413`, err, w.Code)
+	}
+
+	// invalid fields
+	r = httptest.NewRequest("POST", "/messages", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	_, _, err = ReadMessagePayload[CreateMessageRequestData](w, r, limits)
+	WritePayloadProblem(w, r, E_INVALID_MESSAGE, err)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf(`WritePayloadProblem(%v) status = %d, want 400`, err, w.Code)
+	}
+
+	var data ValidationProblemResponseData
+	json.NewDecoder(w.Body).Decode(&data)
+	if data.Code != E_INVALID_MESSAGE || len(data.Errors) != 1 || data.Errors[0].Field != "text" {
+		t.Fatalf(`WritePayloadProblem(%v) body = %+v, want invalid_message with a text error`, err, data)
+	}
+}